@@ -0,0 +1,569 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// Archive is a tar (optionally compressed), zip or plain directory storage of files, see OpenArchive.
+// The entry list is read once and kept until the next Append
+type Archive interface {
+	// List returns the entry names in archive order
+	List() ([]string, error)
+	// Open returns a reader of name, the error wraps ErrNotInArchive if it is missing
+	Open(name string) (io.ReadCloser, error)
+	// Read returns content of name (the latest version if it was appended more than once),
+	// the error wraps ErrNotInArchive if it is missing
+	Read(name string) ([]byte, error)
+	// Append adds name with buf data
+	Append(name string, buf []byte) error
+	// Stat returns file info of name, the error wraps ErrNotInArchive if it is missing
+	Stat(name string) (os.FileInfo, error)
+	// Walk calls fn for each entry in archive order, stops at the first error
+	Walk(fn func(name string, info os.FileInfo) error) error
+	// Find looks for search string in the latest version of each name, returns filenames and matches
+	Find(search string) (map[string]string, error)
+	// Close releases the archive file
+	Close() error
+}
+
+// OpenArchive returns the Archive for name, a directory or by its extension (.zip, .tar, .tar.gz, .tgz, ...)
+func OpenArchive(name string) (Archive, error) {
+	return OpenArchiveFS(fs, name)
+}
+
+// OpenArchiveFS returns the Archive for name on given (afero) filesystem, a directory or by its extension
+func OpenArchiveFS(filesystem afero.Fs, name string) (Archive, error) {
+	filesystem = orDefaultFS(filesystem)
+	var b archiveBackend
+	fi, err := filesystem.Stat(name)
+	switch {
+	case err == nil && fi.IsDir(), err != nil && strings.HasSuffix(name, "/"):
+		b = &dirBackend{fs: filesystem, root: name}
+	case strings.EqualFold(filepath.Ext(name), ".zip"):
+		b = &zipBackend{fs: filesystem, name: name}
+	case strings.EqualFold(filepath.Ext(name), ".tar"), CompressionFromName(name) != CompressNone:
+		b = &tarBackend{fs: filesystem, name: name}
+	default:
+		return nil, fmt.Errorf("unknown archive format for %s", name)
+	}
+	a := &archive{name: name, backend: b}
+	if _, err := a.index(); err != nil {
+		b.close()
+		return nil, err
+	}
+	return a, nil
+}
+
+type archiveEntry struct {
+	name   string
+	info   os.FileInfo
+	offset int64
+	index  int
+	zf     *zip.File
+	// encrypted tar entries are decrypted with keyID when read
+	keyID     string
+	encrypted bool
+	// link is the target name of a tar hard link, target the entry it resolves to
+	link   string
+	target *archiveEntry
+}
+
+// linkInfo is the file info of a hard link with the size of its target
+type linkInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i linkInfo) Size() int64 {
+	return i.size
+}
+
+// resolveLinks points hard links at the latest earlier entry with their target name
+func resolveLinks(entries []archiveEntry) {
+	last := map[string]*archiveEntry{}
+	for i := range entries {
+		e := &entries[i]
+		if t := last[e.link]; e.link != "" && t != nil {
+			// a link to a link shares its data
+			if t.target != nil {
+				t = t.target
+			}
+			e.target = t
+			e.info = linkInfo{e.info, t.info.Size()}
+		}
+		last[e.name] = e
+	}
+}
+
+// archiveBackend is the storage specific part of an Archive
+type archiveBackend interface {
+	// load returns the entries, none if the archive doesn't exist yet
+	load() ([]archiveEntry, error)
+	open(e *archiveEntry) (io.ReadCloser, error)
+	// each calls fn with the content of each entry in one pass where possible
+	each(entries []archiveEntry, fn func(e *archiveEntry, r io.Reader) error) error
+	append(name string, buf []byte) error
+	close() error
+}
+
+type archive struct {
+	name    string
+	backend archiveBackend
+	entries []archiveEntry
+	loaded  bool
+}
+
+func (a *archive) index() ([]archiveEntry, error) {
+	if !a.loaded {
+		entries, err := a.backend.load()
+		if err != nil {
+			return nil, err
+		}
+		resolveLinks(entries)
+		a.entries, a.loaded = entries, true
+	}
+	return a.entries, nil
+}
+
+func (a *archive) entry(name string) (*archiveEntry, error) {
+	entries, err := a.index()
+	if err != nil {
+		return nil, err
+	}
+	// the latest version wins when a name was appended more than once
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].name == name {
+			return &entries[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%s in %s: %w", name, a.name, ErrNotInArchive)
+}
+
+func (a *archive) List() ([]string, error) {
+	entries, err := a.index()
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, e := range entries {
+		if !isTarBlob(e.name) {
+			ret = append(ret, e.name)
+		}
+	}
+	return ret, nil
+}
+
+func (a *archive) Open(name string) (io.ReadCloser, error) {
+	e, err := a.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	if e.target != nil {
+		e = e.target
+	}
+	return a.backend.open(e)
+}
+
+func (a *archive) Read(name string) ([]byte, error) {
+	r, err := a.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &CorruptArchiveError{a.name, err}
+	}
+	return bs, nil
+}
+
+func (a *archive) Append(name string, buf []byte) error {
+	a.loaded, a.entries = false, nil
+	return a.backend.append(name, buf)
+}
+
+func (a *archive) Stat(name string) (os.FileInfo, error) {
+	e, err := a.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+func (a *archive) Walk(fn func(name string, info os.FileInfo) error) error {
+	entries, err := a.index()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if isTarBlob(e.name) {
+			continue
+		}
+		if err := fn(e.name, e.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *archive) Find(search string) (map[string]string, error) {
+	entries, err := a.index()
+	if err != nil {
+		return nil, err
+	}
+	matches := map[int]string{}
+	err = a.backend.each(entries, func(e *archiveEntry, r io.Reader) error {
+		match, ok, err := findSnippetReader(r, search)
+		if err != nil {
+			return &CorruptArchiveError{a.name, err}
+		}
+		if ok {
+			matches[e.index] = match
+		}
+		return nil
+	})
+	// only the latest version of a name is reported, as Read returns it, hard links match with the data
+	// of their target, deduplicated payloads are reported by link name
+	latest := map[string]*archiveEntry{}
+	for i := range entries {
+		latest[entries[i].name] = &entries[i]
+	}
+	res := map[string]string{}
+	for name, e := range latest {
+		if isTarBlob(name) {
+			continue
+		}
+		if e.target != nil {
+			e = e.target
+		}
+		if match, ok := matches[e.index]; ok {
+			res[name] = match
+		}
+	}
+	return res, err
+}
+
+func (a *archive) Close() error {
+	a.loaded, a.entries = false, nil
+	return a.backend.close()
+}
+
+// countingReader tracks the position in r, seeking is passed through so tar can skip entry data
+type countingReader struct {
+	r   io.ReadSeeker
+	pos int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := c.r.Seek(offset, whence)
+	if err == nil {
+		c.pos = pos
+	}
+	return pos, err
+}
+
+type tarBackend struct {
+	fs          afero.Fs
+	name        string
+	f           afero.File
+	compression Compression
+}
+
+// reader returns a tar reader from the start of the archive
+func (b *tarBackend) reader() (*tar.Reader, *countingReader, func(), error) {
+	if _, err := b.f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, nil, err
+	}
+	if b.compression != CompressNone {
+		tr, done, err := openTar(b.f, b.name)
+		return tr, nil, done, err
+	}
+	cr := &countingReader{r: b.f}
+	return tar.NewReader(cr), cr, func() {}, nil
+}
+
+func (b *tarBackend) load() ([]archiveEntry, error) {
+	if b.f == nil {
+		f, err := b.fs.Open(b.name)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		head := make([]byte, 6)
+		n, _ := io.ReadFull(f, head)
+		b.f, b.compression = f, DetectCompression(head[:n])
+	}
+	if b.compression == CompressNone {
+		if idx, err := loadTarIndex(b.fs, b.name, b.f); err == nil {
+			entries := make([]archiveEntry, len(idx.entries))
+			for i, e := range idx.entries {
+				entries[i] = archiveEntry{name: e.Name, info: e.FileInfo(), offset: e.Offset, index: i, keyID: e.Key, encrypted: e.Encrypted, link: e.Link}
+			}
+			return entries, nil
+		}
+	}
+	tr, cr, done, err := b.reader()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	var entries []archiveEntry
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, &CorruptArchiveError{b.name, err}
+		}
+		e := archiveEntry{name: hdr.Name, info: hdr.FileInfo(), index: len(entries)}
+		e.keyID, e.encrypted = tarEncryption(hdr)
+		if hdr.Typeflag == tar.TypeLink {
+			e.link = hdr.Linkname
+		}
+		if cr != nil {
+			e.offset = cr.pos
+		}
+		entries = append(entries, e)
+	}
+}
+
+func (b *tarBackend) open(e *archiveEntry) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	if b.compression == CompressNone {
+		rc = ioutil.NopCloser(io.NewSectionReader(b.f, e.offset, e.info.Size()))
+	} else {
+		tr, _, done, err := b.reader()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i <= e.index; i++ {
+			if _, err := tr.Next(); err != nil {
+				done()
+				return nil, &CorruptArchiveError{b.name, err}
+			}
+		}
+		rc = readCloser{tr, done}
+	}
+	if !e.encrypted {
+		return rc, nil
+	}
+	defer rc.Close()
+	r, err := b.decrypt(e, rc)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+// decrypt returns a reader of the decrypted data of an encrypted entry read from r
+func (b *tarBackend) decrypt(e *archiveEntry, r io.Reader) (io.Reader, error) {
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &CorruptArchiveError{b.name, err}
+	}
+	plain, err := decryptEntry(e.name, e.keyID, bs)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(plain), nil
+}
+
+func (b *tarBackend) each(entries []archiveEntry, fn func(e *archiveEntry, r io.Reader) error) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	tr, _, done, err := b.reader()
+	if err != nil {
+		return err
+	}
+	defer done()
+	for i := range entries {
+		if _, err := tr.Next(); err != nil {
+			return &CorruptArchiveError{b.name, err}
+		}
+		var r io.Reader = tr
+		if entries[i].encrypted {
+			if r, err = b.decrypt(&entries[i], tr); err != nil {
+				return err
+			}
+		}
+		if err := fn(&entries[i], r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *tarBackend) append(name string, buf []byte) error {
+	if err := b.close(); err != nil {
+		return err
+	}
+	return WriteTarFS(b.fs, b.name, name, buf)
+}
+
+func (b *tarBackend) close() error {
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Close()
+	b.f = nil
+	return err
+}
+
+// readCloser calls done on Close
+type readCloser struct {
+	io.Reader
+	done func()
+}
+
+func (r readCloser) Close() error {
+	r.done()
+	return nil
+}
+
+type zipBackend struct {
+	fs   afero.Fs
+	name string
+	f    afero.File
+}
+
+func (b *zipBackend) load() ([]archiveEntry, error) {
+	f, err := b.fs.Open(b.name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	zr, err := openZip(f, b.name)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	b.close()
+	b.f = f
+	var entries []archiveEntry
+	for _, zf := range zr.File {
+		entries = append(entries, archiveEntry{name: zf.Name, info: zf.FileInfo(), index: len(entries), zf: zf})
+	}
+	return entries, nil
+}
+
+func (b *zipBackend) open(e *archiveEntry) (io.ReadCloser, error) {
+	r, err := e.zf.Open()
+	if err != nil {
+		return nil, &CorruptArchiveError{b.name, err}
+	}
+	return r, nil
+}
+
+func (b *zipBackend) each(entries []archiveEntry, fn func(e *archiveEntry, r io.Reader) error) error {
+	for i := range entries {
+		r, err := b.open(&entries[i])
+		if err != nil {
+			return err
+		}
+		err = fn(&entries[i], r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *zipBackend) append(name string, buf []byte) error {
+	if err := b.close(); err != nil {
+		return err
+	}
+	return WriteZipFS(b.fs, b.name, name, buf)
+}
+
+func (b *zipBackend) close() error {
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Close()
+	b.f = nil
+	return err
+}
+
+// dirBackend stores entries as files under root, entry names are slash separated relative paths
+type dirBackend struct {
+	fs   afero.Fs
+	root string
+}
+
+func (b *dirBackend) load() ([]archiveEntry, error) {
+	var entries []archiveEntry
+	err := afero.Walk(b.fs, b.root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == b.root {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(b.root, p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, archiveEntry{name: filepath.ToSlash(rel), info: info, index: len(entries)})
+		return nil
+	})
+	return entries, err
+}
+
+func (b *dirBackend) path(name string) string {
+	return filepath.Join(b.root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (b *dirBackend) open(e *archiveEntry) (io.ReadCloser, error) {
+	return b.fs.Open(b.path(e.name))
+}
+
+func (b *dirBackend) each(entries []archiveEntry, fn func(e *archiveEntry, r io.Reader) error) error {
+	for i := range entries {
+		r, err := b.open(&entries[i])
+		if err != nil {
+			return err
+		}
+		err = fn(&entries[i], r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *dirBackend) append(name string, buf []byte) error {
+	p := b.path(name)
+	if err := b.fs.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return afero.WriteFile(b.fs, p, buf, 0644)
+}
+
+func (b *dirBackend) close() error {
+	return nil
+}
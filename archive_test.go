@@ -0,0 +1,176 @@
+package filehelper
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/shoobyban/mxj"
+	"github.com/spf13/afero"
+)
+
+func TestArchive(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	for _, name := range []string{"data.zip", "data.tar", "data.tgz", "data/"} {
+		a, err := OpenArchiveFS(mfs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range []string{"a.txt", "b.txt"} {
+			if err := a.Append(entry, []byte("content of "+entry)); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		list, err := a.List()
+		if err != nil || !reflect.DeepEqual(list, []string{"a.txt", "b.txt"}) {
+			t.Errorf("%s list: %#v %v", name, list, err)
+		}
+		if bs, err := a.Read("a.txt"); err != nil || string(bs) != "content of a.txt" {
+			t.Errorf("%s read: %#v %v", name, string(bs), err)
+		}
+		if _, err := a.Read("c.txt"); !errors.Is(err, ErrNotInArchive) {
+			t.Errorf("%s: expected ErrNotInArchive, got %v", name, err)
+		}
+		if found, err := a.Find("of b"); err != nil || !reflect.DeepEqual(found, map[string]string{"b.txt": "nt of b.tx"}) {
+			t.Errorf("%s find: %#v %v", name, found, err)
+		}
+		if info, err := a.Stat("b.txt"); err != nil || info.Size() != 16 {
+			t.Errorf("%s stat: %v", name, err)
+		}
+		walked := 0
+		a.Walk(func(name string, info os.FileInfo) error {
+			walked++
+			return nil
+		})
+		if walked != 2 {
+			t.Errorf("%s walk: %d entries", name, walked)
+		}
+		a.Append("c.txt", []byte("old foo"))
+		a.Append("c.txt", []byte("new"))
+		if found, err := a.Find("foo"); err != nil || len(found) != 0 {
+			t.Errorf("%s find replaced: %#v %v", name, found, err)
+		}
+		if bs, err := a.Read("c.txt"); err != nil || string(bs) != "new" {
+			t.Errorf("%s read replaced: %q %v", name, bs, err)
+		}
+		if err := a.Close(); err != nil {
+			t.Errorf("%s close: %v", name, err)
+		}
+	}
+	if tmps, _ := afero.Glob(mfs, "data.zip.tmp*"); len(tmps) != 0 {
+		t.Errorf("temporary zip file left behind: %v", tmps)
+	}
+	if _, err := OpenArchiveFS(mfs, "data.rar"); err == nil {
+		t.Errorf("expected error for unknown format")
+	}
+	afero.WriteFile(mfs, "bad.zip", []byte("not a zip"), 0644)
+	var corrupt *CorruptArchiveError
+	if _, err := ListZipFS(mfs, "bad.zip"); !errors.As(err, &corrupt) {
+		t.Errorf("expected CorruptArchiveError, got %v", err)
+	}
+	if err := WriteZipFS(mfs, "bad.zip", "a.txt", []byte("a")); !errors.As(err, &corrupt) {
+		t.Errorf("expected CorruptArchiveError on append, got %v", err)
+	}
+}
+
+func TestWriteZip(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := WriteZipFS(mfs, "data.zip", fmt.Sprintf("%02d.txt", i), []byte("x")); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if list, err := ListZipFS(mfs, "data.zip"); err != nil || len(list) != 20 {
+		t.Errorf("concurrent appends lost entries: %d %v", len(list), err)
+	}
+	if tmps, _ := afero.Glob(mfs, "data.zip.tmp*"); len(tmps) != 0 {
+		t.Errorf("temporary zip file left behind: %v", tmps)
+	}
+
+	afero.WriteFile(mfs, "private.zip", nil, 0600)
+	WriteZipFS(mfs, "private.zip", "a.txt", []byte("first"))
+	WriteZipFS(mfs, "private.zip", "a.txt", []byte("second"))
+	if fi, err := mfs.Stat("private.zip"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("zip mode not preserved: %v", err)
+	}
+	if bs, err := ReadZipFS(mfs, "private.zip", "a.txt"); err != nil || string(bs) != "second" {
+		t.Errorf("expected latest duplicate, got %q %v", bs, err)
+	}
+	if found, err := FindInZipFS(mfs, "private.zip", "first"); err != nil || len(found) != 0 {
+		t.Errorf("superseded entry searched: %#v %v", found, err)
+	}
+
+	// existing entries are copied as stored, even with a compression method this package can't read
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.CreateRaw(&zip.FileHeader{Name: "custom.bin", Method: 99, CompressedSize64: 3, UncompressedSize64: 3})
+	w.Write([]byte("raw"))
+	zw.Close()
+	afero.WriteFile(mfs, "custom.zip", buf.Bytes(), 0644)
+	if err := WriteZipFS(mfs, "custom.zip", "a.txt", []byte("a")); err != nil {
+		t.Fatalf("append to custom method zip: %v", err)
+	}
+	if list, err := ListZipFS(mfs, "custom.zip"); err != nil || !reflect.DeepEqual(list, []string{"custom.bin", "a.txt"}) {
+		t.Errorf("custom method zip: %#v %v", list, err)
+	}
+}
+
+func TestArchiveFs(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	a, err := OpenArchiveFS(mfs, "bundle.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Append("templates/hello.tmpl", []byte(`Hello {{.name}}`))
+	a.Append("data/order.json", []byte(`{"id":"1"}`))
+	a.Append("data/lines/1.csv", []byte("sku,qty\nA,1\n"))
+	afs := NewArchiveFs(a)
+
+	if out, err := ProcessTemplateFileFS(afs, "/templates/hello.tmpl", map[string]string{"name": "World"}); err != nil || string(out) != "Hello World" {
+		t.Errorf("template: %#v %v", out, err)
+	}
+	p := NewParser()
+	p.RegisterFS(afs)
+	if v, err := p.ReadStruct("data/order.json", "json"); err != nil || !reflect.DeepEqual(v, mxj.Map{"id": "1"}) {
+		t.Errorf("parser: %#v %v", v, err)
+	}
+	f, err := afs.Open("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, _ := f.Readdirnames(-1)
+	if !reflect.DeepEqual(names, []string{"lines", "order.json"}) {
+		t.Errorf("readdir: %#v", names)
+	}
+	if info, err := afs.Stat("data/lines"); err != nil || !info.IsDir() {
+		t.Errorf("stat dir: %v", err)
+	}
+	if _, err := afs.Stat("missing.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected not exist, got %v", err)
+	}
+	if _, err := afs.Create("new.txt"); err == nil {
+		t.Errorf("expected read-only error")
+	}
+	bs, _ := afero.ReadFile(afs, "data/lines/1.csv")
+	if string(bs) != "sku,qty\nA,1\n" {
+		t.Errorf("read: %#v", string(bs))
+	}
+	r, _ := a.Open("data/order.json")
+	bs, _ = ioutil.ReadAll(r)
+	r.Close()
+	if string(bs) != `{"id":"1"}` {
+		t.Errorf("open: %#v", string(bs))
+	}
+}
@@ -0,0 +1,248 @@
+package filehelper
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// ArchiveFs exposes an Archive as a read-only afero filesystem, directories are derived from entry names,
+// so templates (ProcessTemplateFileFS) and parsers (Parser.RegisterFS) can read straight from archives
+type ArchiveFs struct {
+	a Archive
+}
+
+// NewArchiveFs returns a read-only afero filesystem of a
+func NewArchiveFs(a Archive) *ArchiveFs {
+	return &ArchiveFs{a}
+}
+
+// archivePath returns the slash separated entry name of name, "" for the root
+func archivePath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.Replace(name, "\\", "/", -1)), "/")
+}
+
+// Name of the filesystem
+func (f *ArchiveFs) Name() string {
+	return "ArchiveFs"
+}
+
+// Stat returns file info of a file or directory
+func (f *ArchiveFs) Stat(name string) (os.FileInfo, error) {
+	p := archivePath(name)
+	if info, err := f.a.Stat(p); err == nil {
+		return info, nil
+	} else if !errors.Is(err, ErrNotInArchive) {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	children, err := f.readdir(p)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if children == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return archiveDirInfo(path.Base("/" + p)), nil
+}
+
+// readdir returns the entries directly under directory p, nil if p is not a directory
+func (f *ArchiveFs) readdir(p string) ([]os.FileInfo, error) {
+	prefix := p + "/"
+	if p == "" {
+		prefix = ""
+	}
+	var children []os.FileInfo
+	seen := map[string]int{}
+	err := f.a.Walk(func(name string, info os.FileInfo) error {
+		if !strings.HasPrefix(name, prefix) || name == prefix {
+			return nil
+		}
+		child := strings.TrimPrefix(name, prefix)
+		if i := strings.Index(child, "/"); i >= 0 {
+			if child = child[:i]; seen[child] == 0 {
+				children = append(children, archiveDirInfo(child))
+				seen[child] = len(children)
+			}
+		} else if info.IsDir() {
+			return nil
+		} else if i := seen[child]; i > 0 {
+			// later versions replace earlier ones
+			children[i-1] = info
+		} else {
+			children = append(children, info)
+			seen[child] = len(children)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if children == nil && p == "" {
+		children = []os.FileInfo{}
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	return children, nil
+}
+
+// Open opens a file or directory for reading
+func (f *ArchiveFs) Open(name string) (afero.File, error) {
+	p := archivePath(name)
+	info, err := f.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	af := &archiveFile{name: name, info: info}
+	if info.IsDir() {
+		if af.dir, err = f.readdir(p); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		af.Reader = bytes.NewReader(nil)
+		return af, nil
+	}
+	bs, err := f.a.Read(p)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	af.Reader = bytes.NewReader(bs)
+	return af, nil
+}
+
+// OpenFile opens a file for reading, other flags return an error
+func (f *ArchiveFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+	}
+	return f.Open(name)
+}
+
+// Create is not supported
+func (f *ArchiveFs) Create(name string) (afero.File, error) {
+	return nil, &os.PathError{Op: "create", Path: name, Err: syscall.EPERM}
+}
+
+// Mkdir is not supported
+func (f *ArchiveFs) Mkdir(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+// MkdirAll is not supported
+func (f *ArchiveFs) MkdirAll(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: syscall.EPERM}
+}
+
+// Remove is not supported
+func (f *ArchiveFs) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+// RemoveAll is not supported
+func (f *ArchiveFs) RemoveAll(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: syscall.EPERM}
+}
+
+// Rename is not supported
+func (f *ArchiveFs) Rename(oldname, newname string) error {
+	return &os.PathError{Op: "rename", Path: oldname, Err: syscall.EPERM}
+}
+
+// Chmod is not supported
+func (f *ArchiveFs) Chmod(name string, mode os.FileMode) error {
+	return &os.PathError{Op: "chmod", Path: name, Err: syscall.EPERM}
+}
+
+// Chown is not supported
+func (f *ArchiveFs) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: syscall.EPERM}
+}
+
+// Chtimes is not supported
+func (f *ArchiveFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: name, Err: syscall.EPERM}
+}
+
+// archiveDirInfo is the file info of a directory derived from entry names
+type archiveDirInfo string
+
+func (d archiveDirInfo) Name() string       { return string(d) }
+func (d archiveDirInfo) Size() int64        { return 0 }
+func (d archiveDirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (d archiveDirInfo) ModTime() time.Time { return time.Time{} }
+func (d archiveDirInfo) IsDir() bool        { return true }
+func (d archiveDirInfo) Sys() interface{}   { return nil }
+
+// archiveFile is an opened (read into memory) file or directory of an ArchiveFs
+type archiveFile struct {
+	*bytes.Reader
+	name string
+	info os.FileInfo
+	dir  []os.FileInfo
+}
+
+func (f *archiveFile) Close() error {
+	return nil
+}
+
+func (f *archiveFile) Name() string {
+	return f.name
+}
+
+func (f *archiveFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *archiveFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if count <= 0 {
+		res := f.dir
+		f.dir = nil
+		return res, nil
+	}
+	if len(f.dir) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.dir) {
+		count = len(f.dir)
+	}
+	res := f.dir[:count]
+	f.dir = f.dir[count:]
+	return res, nil
+}
+
+func (f *archiveFile) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	return names, err
+}
+
+func (f *archiveFile) Sync() error {
+	return nil
+}
+
+func (f *archiveFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EPERM}
+}
+
+func (f *archiveFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EPERM}
+}
+
+func (f *archiveFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EPERM}
+}
+
+func (f *archiveFile) WriteString(s string) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EPERM}
+}
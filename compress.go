@@ -0,0 +1,126 @@
+package filehelper
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression of a tar archive
+type Compression int
+
+// Supported compressions, bzip2 can only be read
+const (
+	CompressNone Compression = iota
+	CompressGzip
+	CompressBzip2
+	CompressZstd
+	CompressXz
+)
+
+var compressionMagic = []struct {
+	c     Compression
+	magic []byte
+}{
+	{CompressGzip, []byte{0x1f, 0x8b}},
+	{CompressBzip2, []byte("BZh")},
+	{CompressZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+var compressionExt = []struct {
+	c   Compression
+	ext []string
+}{
+	{CompressGzip, []string{".tar.gz", ".tgz"}},
+	{CompressBzip2, []string{".tar.bz2", ".tbz2", ".tbz"}},
+	{CompressZstd, []string{".tar.zst", ".tzst"}},
+	{CompressXz, []string{".tar.xz", ".txz"}},
+}
+
+func (c Compression) String() string {
+	switch c {
+	case CompressGzip:
+		return "gzip"
+	case CompressBzip2:
+		return "bzip2"
+	case CompressZstd:
+		return "zstd"
+	case CompressXz:
+		return "xz"
+	}
+	return "none"
+}
+
+// DetectCompression returns the compression of content by its first (up to 6) magic bytes
+func DetectCompression(head []byte) Compression {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.c
+		}
+	}
+	return CompressNone
+}
+
+// CompressionFromName returns the compression of an archive by its extension (.tar.gz, .tgz, .tar.zst, .tar.xz, ...)
+func CompressionFromName(name string) Compression {
+	name = strings.ToLower(name)
+	for _, e := range compressionExt {
+		for _, ext := range e.ext {
+			if strings.HasSuffix(name, ext) {
+				return e.c
+			}
+		}
+	}
+	return CompressNone
+}
+
+// decompressReader detects compression of r and returns a reader of the decompressed stream,
+// concatenated members (appends) are read as one stream
+func decompressReader(r io.Reader) (io.Reader, func(), error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(6)
+	switch DetectCompression(head) {
+	case CompressGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() { zr.Close() }, nil
+	case CompressBzip2:
+		return bzip2.NewReader(br), func() {}, nil
+	case CompressZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	case CompressXz:
+		zr, err := xz.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, func() {}, nil
+	}
+	return br, func() {}, nil
+}
+
+// compressWriter returns a writer producing one compressed member with c onto w
+func compressWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	case CompressXz:
+		return xz.NewWriter(w)
+	}
+	return nil, fmt.Errorf("writing %s compressed archives is not supported", c)
+}
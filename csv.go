@@ -7,11 +7,11 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 	"reflect"
 
 	csvmap "github.com/recursionpharma/go-csv-map"
 	"github.com/shoobyban/slog"
+	"github.com/spf13/afero"
 )
 
 // WriteCSV writes headers and rows into a given file handle and reads it back as []byte
@@ -27,11 +27,16 @@ func WriteCSV(file io.ReadWriter, columns []string, rows []map[string]interface{
 
 // ReadCSV reads csv into []map[string]string + []string for headers
 func ReadCSV(filename string) ([]map[string]string, []string, error) {
-	csvFile, err := os.Open(filename)
-	defer csvFile.Close()
+	return ReadCSVFS(fs, filename)
+}
+
+// ReadCSVFS reads csv from given (afero) filesystem into []map[string]string + []string for headers
+func ReadCSVFS(filesystem afero.Fs, filename string) ([]map[string]string, []string, error) {
+	csvFile, err := orDefaultFS(filesystem).Open(filename)
 	if err != nil {
 		return nil, nil, err
 	}
+	defer csvFile.Close()
 	r := csvmap.NewReader(bufio.NewReader(csvFile))
 	r.Columns, err = r.ReadHeader()
 	if err != nil {
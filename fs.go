@@ -0,0 +1,30 @@
+package filehelper
+
+import (
+	"github.com/spf13/afero"
+)
+
+// fs is the package default filesystem, used by every function that doesn't take one
+var fs afero.Fs = afero.NewOsFs()
+
+// RegisterFS (afero) virtual filesystem as the package default for all file operations.
+// Passing nil restores the OS filesystem.
+func RegisterFS(filesystem afero.Fs) {
+	if filesystem == nil {
+		filesystem = afero.NewOsFs()
+	}
+	fs = filesystem
+}
+
+// DefaultFS returns the package default (afero) filesystem
+func DefaultFS() afero.Fs {
+	return fs
+}
+
+// orDefaultFS returns filesystem, or the package default if it is nil
+func orDefaultFS(filesystem afero.Fs) afero.Fs {
+	if filesystem == nil {
+		return fs
+	}
+	return filesystem
+}
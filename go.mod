@@ -2,12 +2,20 @@ module github.com/shoobyban/filehelper
 
 require (
 	github.com/kennygrant/sanitize v1.2.4
+	github.com/klauspost/compress v1.12.3
 	github.com/recursionpharma/go-csv-map v0.0.0-20160524001940-792523c65ae9
 	github.com/shoobyban/mxj v1.8.5
 	github.com/shoobyban/slog v0.0.0-20190209173919-7f513f7a44c1
-	github.com/smartystreets/goconvey v1.6.4 // indirect
-	github.com/spf13/afero v1.2.1
+	github.com/spf13/afero v1.6.0
 	github.com/spf13/cast v1.3.0
+	github.com/ulikunitz/xz v0.5.12
+)
+
+require (
+	github.com/golang/snappy v0.0.3 // indirect
+	github.com/smartystreets/goconvey v1.6.4 // indirect
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
+	golang.org/x/text v0.3.3 // indirect
 )
 
-go 1.13
+go 1.17
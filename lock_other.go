@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package filehelper
+
+import "github.com/spf13/afero"
+
+// flockFile is a no-op where flock is not available, only the in-process lock applies
+func flockFile(f afero.File) (func(), error) {
+	return func() {}, nil
+}
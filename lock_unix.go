@@ -0,0 +1,22 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package filehelper
+
+import (
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+// flockFile takes an exclusive advisory lock on f if it is (backed by) an OS file, returns the unlock function
+func flockFile(f afero.File) (func(), error) {
+	osf, ok := osFile(f)
+	if !ok {
+		return func() {}, nil
+	}
+	if err := syscall.Flock(int(osf.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	return func() { syscall.Flock(int(osf.Fd()), syscall.LOCK_UN) }, nil
+}
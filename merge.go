@@ -0,0 +1,162 @@
+package filehelper
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/shoobyban/mxj"
+)
+
+// SliceStrategy tells Merge how to combine slices present in both documents
+type SliceStrategy int
+
+const (
+	// SliceReplace uses the overlay slice
+	SliceReplace SliceStrategy = iota
+	// SliceAppend appends the overlay items to the base slice
+	SliceAppend
+	// SliceMergeByKey deep merges items having the same MergeOptions.Key value and appends the rest
+	SliceMergeByKey
+)
+
+// MergeOptions configures Merge
+type MergeOptions struct {
+	Slices SliceStrategy
+	// Key is the item field matched by SliceMergeByKey
+	Key string
+	// KeepBase keeps the base value on conflicts instead of the overlay value
+	KeepBase bool
+}
+
+// MergeConflict is a JSON Pointer path where base and overlay have different values that can't be merged
+type MergeConflict struct {
+	Path    string
+	Base    interface{}
+	Overlay interface{}
+}
+
+func (c MergeConflict) String() string {
+	return fmt.Sprintf("%s: %#v <> %#v", c.Path, c.Base, c.Overlay)
+}
+
+// Merge deep merges overlay into a copy of base (maps and slices as returned by Parser).
+// Maps are merged key by key, slices according to opts.Slices, scalars are taken from the
+// overlay (or base with opts.KeepBase) and reported as conflicts if they differ.
+// With SliceAppend and SliceMergeByKey a map merged with a slice is handled as a one item slice,
+// as mxj returns single XML elements as maps.
+func Merge(base, overlay interface{}, opts MergeOptions) (interface{}, []MergeConflict, error) {
+	if opts.Slices == SliceMergeByKey && opts.Key == "" {
+		return nil, nil, errors.New("merge by key needs a key")
+	}
+	conflicts := []MergeConflict{}
+	res := mergeValues("", deepCopy(base), deepCopy(overlay), opts, &conflicts)
+	if _, ok := base.(mxj.Map); ok {
+		if m, ok := res.(map[string]interface{}); ok {
+			return mxj.Map(m), conflicts, nil
+		}
+	}
+	return res, conflicts, nil
+}
+
+// MergeAll merges layers in order, each one overlaying the result of the previous ones
+func MergeAll(opts MergeOptions, layers ...interface{}) (interface{}, []MergeConflict, error) {
+	if len(layers) == 0 {
+		return nil, nil, errors.New("nothing to merge")
+	}
+	res := layers[0]
+	conflicts := []MergeConflict{}
+	for _, layer := range layers[1:] {
+		var c []MergeConflict
+		var err error
+		if res, c, err = Merge(res, layer, opts); err != nil {
+			return nil, nil, err
+		}
+		conflicts = append(conflicts, c...)
+	}
+	return res, conflicts, nil
+}
+
+func mergeValues(path string, base, overlay interface{}, opts MergeOptions, conflicts *[]MergeConflict) interface{} {
+	mb, okb := base.(map[string]interface{})
+	mo, oko := overlay.(map[string]interface{})
+	if okb && oko {
+		for _, k := range sortedKeys(mo) {
+			v := mo[k]
+			if bv, ok := mb[k]; ok {
+				mb[k] = mergeValues(path+"/"+escapePointer(k), bv, v, opts, conflicts)
+			} else {
+				mb[k] = v
+			}
+		}
+		return mb
+	}
+	sb, okb := base.([]interface{})
+	so, oko := overlay.([]interface{})
+	if opts.Slices != SliceReplace && (okb || oko) {
+		if !okb && base != nil {
+			if _, ok := base.(map[string]interface{}); ok {
+				sb, okb = []interface{}{base}, true
+			}
+		}
+		if !oko && overlay != nil {
+			if _, ok := overlay.(map[string]interface{}); ok {
+				so, oko = []interface{}{overlay}, true
+			}
+		}
+	}
+	if okb && oko {
+		switch opts.Slices {
+		case SliceAppend:
+			return append(sb, so...)
+		case SliceMergeByKey:
+			return mergeByKey(path, sb, so, opts, conflicts)
+		}
+		return so
+	}
+	if reflect.DeepEqual(base, overlay) {
+		return base
+	}
+	*conflicts = append(*conflicts, MergeConflict{Path: path, Base: base, Overlay: overlay})
+	if opts.KeepBase {
+		return base
+	}
+	return overlay
+}
+
+func mergeByKey(path string, base, overlay []interface{}, opts MergeOptions, conflicts *[]MergeConflict) []interface{} {
+	index := map[string]int{}
+	for i, item := range base {
+		if m, ok := item.(map[string]interface{}); ok {
+			if k, ok := m[opts.Key]; ok {
+				index[fmt.Sprintf("%v", k)] = i
+			}
+		}
+	}
+	for _, item := range overlay {
+		if m, ok := item.(map[string]interface{}); ok {
+			if k, ok := m[opts.Key]; ok {
+				if i, ok := index[fmt.Sprintf("%v", k)]; ok {
+					base[i] = mergeValues(path+"/"+strconv.Itoa(i), base[i], item, opts, conflicts)
+					continue
+				}
+				index[fmt.Sprintf("%v", k)] = len(base)
+			}
+		}
+		base = append(base, item)
+	}
+	return base
+}
+
+// mergeLayers is the merge template function, overlay wins and slices are replaced
+func mergeLayers(layers ...interface{}) (interface{}, error) {
+	res, _, err := MergeAll(MergeOptions{}, layers...)
+	return res, err
+}
+
+// mergeLayersByKey is the mergeByKey template function, slice items are merged by key
+func mergeLayersByKey(key string, layers ...interface{}) (interface{}, error) {
+	res, _, err := MergeAll(MergeOptions{Slices: SliceMergeByKey, Key: key}, layers...)
+	return res, err
+}
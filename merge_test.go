@@ -0,0 +1,95 @@
+package filehelper
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testMergeStruct struct {
+	Base      interface{}
+	Overlay   interface{}
+	Options   MergeOptions
+	Result    interface{}
+	Conflicts []MergeConflict
+}
+
+func TestMerge(t *testing.T) {
+	base := map[string]interface{}{
+		"name":  "base",
+		"flags": map[string]interface{}{"a": true, "b": false},
+		"products": []interface{}{
+			map[string]interface{}{"sku": "A", "price": "1.00", "stock": "5"},
+			map[string]interface{}{"sku": "B", "price": "2.00"},
+		},
+	}
+	overlay := map[string]interface{}{
+		"name":     "supplier",
+		"flags":    map[string]interface{}{"b": true, "c": true},
+		"products": map[string]interface{}{"sku": "B", "price": "2.50", "stock": "1"},
+	}
+	tests := map[string]testMergeStruct{
+		"replace": {
+			Base:    base,
+			Overlay: overlay,
+			Result: map[string]interface{}{
+				"name":     "supplier",
+				"flags":    map[string]interface{}{"a": true, "b": true, "c": true},
+				"products": map[string]interface{}{"sku": "B", "price": "2.50", "stock": "1"},
+			},
+			Conflicts: []MergeConflict{
+				{Path: "/flags/b", Base: false, Overlay: true},
+				{Path: "/name", Base: "base", Overlay: "supplier"},
+				{Path: "/products", Base: base["products"], Overlay: overlay["products"]},
+			},
+		},
+		"append": {
+			Base:    map[string]interface{}{"a": []interface{}{"1"}},
+			Overlay: map[string]interface{}{"a": []interface{}{"2", "3"}},
+			Options: MergeOptions{Slices: SliceAppend},
+			Result:  map[string]interface{}{"a": []interface{}{"1", "2", "3"}},
+		},
+		"bykey": {
+			Base:    base,
+			Overlay: overlay,
+			Options: MergeOptions{Slices: SliceMergeByKey, Key: "sku", KeepBase: true},
+			Result: map[string]interface{}{
+				"name":  "base",
+				"flags": map[string]interface{}{"a": true, "b": false, "c": true},
+				"products": []interface{}{
+					map[string]interface{}{"sku": "A", "price": "1.00", "stock": "5"},
+					map[string]interface{}{"sku": "B", "price": "2.00", "stock": "1"},
+				},
+			},
+			Conflicts: []MergeConflict{
+				{Path: "/flags/b", Base: false, Overlay: true},
+				{Path: "/name", Base: "base", Overlay: "supplier"},
+				{Path: "/products/1/price", Base: "2.00", Overlay: "2.50"},
+			},
+		},
+	}
+	for name, test := range tests {
+		res, conflicts, err := Merge(test.Base, test.Overlay, test.Options)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, test.Result) {
+			t.Errorf("%s: %#v != %#v", name, res, test.Result)
+		}
+		if len(conflicts) != len(test.Conflicts) || (len(conflicts) > 0 && !reflect.DeepEqual(conflicts, test.Conflicts)) {
+			t.Errorf("%s: conflicts %v != %v", name, conflicts, test.Conflicts)
+		}
+	}
+	if base["name"] != "base" {
+		t.Errorf("merge modified the base document")
+	}
+	if _, _, err := Merge(base, overlay, MergeOptions{Slices: SliceMergeByKey}); err == nil {
+		t.Errorf("expected error for merge by key without key")
+	}
+
+	res, err := Template(`{{ $m := mergeByKey "sku" .base .overlay }}{{ range $m.products }}{{ .sku }}:{{ .price }} {{ end }}{{ $m.name }}`,
+		map[string]interface{}{"base": base, "overlay": overlay})
+	if err != nil || res != "A:1.00 B:2.50 supplier" {
+		t.Errorf("template: %#v %v", res, err)
+	}
+}
@@ -0,0 +1,287 @@
+package filehelper
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/shoobyban/mxj"
+)
+
+// PatchOperation is a single JSON Patch (RFC 6902) operation
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Patch is a JSON Patch (RFC 6902) change list, marshals to and from the standard JSON form
+type Patch []PatchOperation
+
+// MarshalJSON keeps value for add, replace and test even if it is null
+func (op PatchOperation) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{"op": op.Op, "path": op.Path}
+	switch op.Op {
+	case "add", "replace", "test":
+		m["value"] = op.Value
+	case "move", "copy":
+		m["from"] = op.From
+	}
+	return json.Marshal(m)
+}
+
+// Diff compares two parsed documents (maps and slices as returned by Parser)
+// and returns the operations turning a into b
+func Diff(a, b interface{}) Patch {
+	patch := Patch{}
+	diffValues("", a, b, &patch)
+	return patch
+}
+
+func diffValues(path string, a, b interface{}, patch *Patch) {
+	ma, oka := mapValue(a)
+	mb, okb := mapValue(b)
+	if oka && okb {
+		for _, k := range sortedKeys(ma) {
+			if _, ok := mb[k]; !ok {
+				*patch = append(*patch, PatchOperation{Op: "remove", Path: path + "/" + escapePointer(k)})
+			}
+		}
+		for _, k := range sortedKeys(mb) {
+			if va, ok := ma[k]; ok {
+				diffValues(path+"/"+escapePointer(k), va, mb[k], patch)
+			} else {
+				*patch = append(*patch, PatchOperation{Op: "add", Path: path + "/" + escapePointer(k), Value: mb[k]})
+			}
+		}
+		return
+	}
+	sa, oka := sliceValue(a)
+	sb, okb := sliceValue(b)
+	if oka && okb {
+		common := len(sa)
+		if len(sb) < common {
+			common = len(sb)
+		}
+		for i := 0; i < common; i++ {
+			diffValues(path+"/"+strconv.Itoa(i), sa[i], sb[i], patch)
+		}
+		for i := len(sa) - 1; i >= common; i-- {
+			*patch = append(*patch, PatchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		for i := common; i < len(sb); i++ {
+			*patch = append(*patch, PatchOperation{Op: "add", Path: path + "/" + strconv.Itoa(i), Value: sb[i]})
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*patch = append(*patch, PatchOperation{Op: "replace", Path: path, Value: b})
+	}
+}
+
+// ApplyPatch applies patch to a copy of doc and returns the result, doc is left unchanged
+func ApplyPatch(doc interface{}, patch Patch) (interface{}, error) {
+	res := deepCopy(doc)
+	var err error
+	for i, op := range patch {
+		if res, err = applyOperation(res, op); err != nil {
+			return nil, fmt.Errorf("patch operation %d (%s %s): %v", i, op.Op, op.Path, err)
+		}
+	}
+	if _, ok := doc.(mxj.Map); ok {
+		if m, ok := res.(map[string]interface{}); ok {
+			return mxj.Map(m), nil
+		}
+	}
+	return res, nil
+}
+
+func applyOperation(doc interface{}, op PatchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add", "replace", "remove":
+		res, _, err := pointerApply(doc, path, op.Op, deepCopy(op.Value))
+		return res, err
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" && isPointerPrefix(from, path) && len(from) < len(path) {
+			return nil, fmt.Errorf("can't move %s into itself", op.From)
+		}
+		action := "get"
+		if op.Op == "move" {
+			action = "remove"
+		}
+		doc, value, err := pointerApply(doc, from, action, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, _, err := pointerApply(doc, path, "add", deepCopy(value))
+		return res, err
+	case "test":
+		_, value, err := pointerApply(doc, path, "get", nil)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(normalise(value), normalise(op.Value)) {
+			return nil, fmt.Errorf("test failed, %#v != %#v", value, op.Value)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// pointerApply runs action (add, replace, remove or get) at path inside node,
+// returns the new node and the affected (previous) value
+func pointerApply(node interface{}, path []string, action string, value interface{}) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		switch action {
+		case "get":
+			return node, node, nil
+		case "remove":
+			return nil, node, nil
+		}
+		return value, node, nil
+	}
+	token, last := path[0], len(path) == 1
+	if m, ok := node.(map[string]interface{}); ok {
+		child, exists := m[token]
+		if !last {
+			if !exists {
+				return nil, nil, fmt.Errorf("path /%s not found", token)
+			}
+			newChild, old, err := pointerApply(child, path[1:], action, value)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[token] = newChild
+			return m, old, nil
+		}
+		if !exists && action != "add" {
+			return nil, nil, fmt.Errorf("key %q not found", token)
+		}
+		switch action {
+		case "add", "replace":
+			m[token] = value
+		case "remove":
+			delete(m, token)
+		}
+		return m, child, nil
+	}
+	if s, ok := node.([]interface{}); ok {
+		i := len(s)
+		if token != "-" || action != "add" || !last {
+			var err error
+			if i, err = strconv.Atoi(token); err != nil || i < 0 || i > len(s) || (i == len(s) && action != "add") {
+				return nil, nil, fmt.Errorf("invalid index %q for array of %d", token, len(s))
+			}
+		}
+		if !last {
+			newChild, old, err := pointerApply(s[i], path[1:], action, value)
+			if err != nil {
+				return nil, nil, err
+			}
+			s[i] = newChild
+			return s, old, nil
+		}
+		switch action {
+		case "add":
+			s = append(s, nil)
+			copy(s[i+1:], s[i:])
+			s[i] = value
+			return s, nil, nil
+		case "replace":
+			old := s[i]
+			s[i] = value
+			return s, old, nil
+		case "remove":
+			old := s[i]
+			return append(s[:i], s[i+1:]...), old, nil
+		}
+		return s, s[i], nil
+	}
+	return nil, nil, fmt.Errorf("can't descend into %T at %q", node, token)
+}
+
+// deepCopy copies maps and slices recursively, normalising them to
+// map[string]interface{} and []interface{}
+func deepCopy(v interface{}) interface{} {
+	if m, ok := mapValue(v); ok {
+		ret := make(map[string]interface{}, len(m))
+		for k, item := range m {
+			ret[k] = deepCopy(item)
+		}
+		return ret
+	}
+	if s, ok := sliceValue(v); ok {
+		ret := make([]interface{}, len(s))
+		for i, item := range s {
+			ret[i] = deepCopy(item)
+		}
+		return ret
+	}
+	return v
+}
+
+// normalise makes values comparable regardless of map/slice types and number types
+func normalise(v interface{}) interface{} {
+	v = deepCopy(v)
+	if isNumber(v) {
+		f, _ := strconv.ParseFloat(fmt.Sprintf("%v", v), 64)
+		return f
+	}
+	if m, ok := v.(map[string]interface{}); ok {
+		for k, item := range m {
+			m[k] = normalise(item)
+		}
+	}
+	if s, ok := v.([]interface{}); ok {
+		for i, item := range s {
+			s[i] = normalise(item)
+		}
+	}
+	return v
+}
+
+func escapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+func unescapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into unescaped tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = unescapePointer(t)
+	}
+	return tokens, nil
+}
+
+func isPointerPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
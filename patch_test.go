@@ -0,0 +1,92 @@
+package filehelper
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/shoobyban/mxj"
+)
+
+type testPatchStruct struct {
+	Doc    interface{}
+	Patch  string
+	Result interface{}
+}
+
+func TestDiff(t *testing.T) {
+	p := NewParser()
+	yesterday, _ := p.ParseStruct([]byte(`<catalog><product><sku>A</sku><price>1.00</price></product><product><sku>B/1</sku><price>2.00</price></product><product><sku>C</sku></product><note>old</note></catalog>`), "xml")
+	today, _ := p.ParseStruct([]byte(`<catalog><product><sku>A</sku><price>1.50</price></product><product><sku>B/1</sku><price>2.00</price><stock>3</stock></product><updated>today</updated></catalog>`), "xml")
+
+	patch := Diff(yesterday, today)
+	expected := `[{"op":"remove","path":"/catalog/note"},{"op":"replace","path":"/catalog/product/0/price","value":"1.50"},{"op":"add","path":"/catalog/product/1/stock","value":"3"},{"op":"remove","path":"/catalog/product/2"},{"op":"add","path":"/catalog/updated","value":"today"}]`
+	bs, _ := json.Marshal(patch)
+	if string(bs) != expected {
+		t.Errorf("diff: %s != %s", bs, expected)
+	}
+
+	res, err := ApplyPatch(yesterday, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, today) {
+		t.Errorf("apply: %#v != %#v", res, today)
+	}
+	if len(Diff(res, today)) != 0 {
+		t.Errorf("expected no differences")
+	}
+	if _, ok := yesterday.(mxj.Map)["catalog"].(map[string]interface{})["note"]; !ok {
+		t.Errorf("apply modified the original document")
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	doc := map[string]interface{}{"a": map[string]interface{}{"b/c": "x", "list": []interface{}{"1", "2"}}, "d": nil}
+	tests := map[string]testPatchStruct{
+		"add": {
+			Doc:    doc,
+			Patch:  `[{"op":"add","path":"/a/list/1","value":"1.5"},{"op":"add","path":"/a/list/-","value":"3"},{"op":"add","path":"/e","value":{"f":true}}]`,
+			Result: map[string]interface{}{"a": map[string]interface{}{"b/c": "x", "list": []interface{}{"1", "1.5", "2", "3"}}, "d": nil, "e": map[string]interface{}{"f": true}},
+		},
+		"move": {
+			Doc:    doc,
+			Patch:  `[{"op":"move","from":"/a/b~1c","path":"/x"},{"op":"remove","path":"/a/list/0"},{"op":"replace","path":"/d","value":1}]`,
+			Result: map[string]interface{}{"a": map[string]interface{}{"list": []interface{}{"2"}}, "d": float64(1), "x": "x"},
+		},
+		"copy": {
+			Doc:    doc,
+			Patch:  `[{"op":"test","path":"/a/list","value":["1","2"]},{"op":"copy","from":"/a/list","path":"/d"}]`,
+			Result: map[string]interface{}{"a": map[string]interface{}{"b/c": "x", "list": []interface{}{"1", "2"}}, "d": []interface{}{"1", "2"}},
+		},
+	}
+	for name, test := range tests {
+		var patch Patch
+		if err := json.Unmarshal([]byte(test.Patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+		res, err := ApplyPatch(test.Doc, patch)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, test.Result) {
+			t.Errorf("%s: %#v != %#v", name, res, test.Result)
+		}
+	}
+
+	for _, invalid := range []string{
+		`[{"op":"test","path":"/a/b~1c","value":"y"}]`,
+		`[{"op":"remove","path":"/nothing"}]`,
+		`[{"op":"replace","path":"/a/list/5","value":1}]`,
+		`[{"op":"move","from":"/a","path":"/a/x"}]`,
+		`[{"op":"unknown","path":"/a"}]`,
+		`[{"op":"add","path":"a","value":1}]`,
+	} {
+		var patch Patch
+		json.Unmarshal([]byte(invalid), &patch)
+		if _, err := ApplyPatch(doc, patch); err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
@@ -0,0 +1,897 @@
+package filehelper
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shoobyban/mxj"
+	"github.com/spf13/cast"
+)
+
+// QueryExpr is a compiled query over parsed structures (maps and slices, as returned by Parser).
+//
+// The syntax is a JSONPath subset, the leading $ is optional:
+//
+//	$.a.b, a.b, a['b'], a["b","c"]   children by name
+//	a.*, a[*]                        all children
+//	a..b, a..*                       recursive descent
+//	a[0], a[-1], a[0,2]              indexes, negative counts from the end
+//	a[1:3], a[::2], a[-2:]           slices
+//	a[?(@.b > 2 && @.c =~ '^x')]     filters with == != < <= > >= =~ && || ! and parentheses
+//	a[b=c], a.[b=c], a[b>1]          filter shorthand, same as a[?(@.b == 'c')]
+//	a.length(), a.keys(), a.values() functions
+//
+// Filters on a map test the map itself, so single XML elements (which mxj returns as a map
+// instead of a one element slice) can be filtered the same way as repeated ones.
+type QueryExpr struct {
+	expr     string
+	segments []querySegment
+}
+
+type querySegment struct {
+	recursive bool
+	sel       querySelector
+}
+
+type querySelector interface {
+	selectFrom(node interface{}, root interface{}) []interface{}
+}
+
+// CompileQuery parses a query expression
+func CompileQuery(expr string) (*QueryExpr, error) {
+	p := &queryParser{s: expr}
+	segments, err := p.parsePath(true)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	return &QueryExpr{expr: expr, segments: segments}, nil
+}
+
+// Query evaluates expr on data and returns all matches
+func Query(data interface{}, expr string) ([]interface{}, error) {
+	q, err := CompileQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	return q.Eval(data), nil
+}
+
+// QueryOne evaluates expr on data and returns the first match, nil if nothing matched
+func QueryOne(data interface{}, expr string) (interface{}, error) {
+	res, err := Query(data, expr)
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+	return res[0], nil
+}
+
+// String returns the original expression
+func (q *QueryExpr) String() string {
+	return q.expr
+}
+
+// Eval evaluates the query on data and returns all matches
+func (q *QueryExpr) Eval(data interface{}) []interface{} {
+	return evalSegments(q.segments, data, data)
+}
+
+func evalSegments(segments []querySegment, node, root interface{}) []interface{} {
+	nodes := []interface{}{node}
+	for _, seg := range segments {
+		next := []interface{}{}
+		for _, n := range nodes {
+			if seg.recursive {
+				for _, d := range descendants(n) {
+					next = append(next, seg.sel.selectFrom(d, root)...)
+				}
+			} else {
+				next = append(next, seg.sel.selectFrom(n, root)...)
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// descendants returns node and all its descendants, depth first
+func descendants(node interface{}) []interface{} {
+	ret := []interface{}{node}
+	if m, ok := mapValue(node); ok {
+		for _, k := range sortedKeys(m) {
+			ret = append(ret, descendants(m[k])...)
+		}
+	} else if s, ok := sliceValue(node); ok {
+		for _, item := range s {
+			ret = append(ret, descendants(item)...)
+		}
+	}
+	return ret
+}
+
+// mapValue returns v as map[string]interface{} if it is a map with string keys
+func mapValue(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case mxj.Map:
+		return map[string]interface{}(m), true
+	case nil:
+		return nil, false
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	m := make(map[string]interface{}, rv.Len())
+	for _, k := range rv.MapKeys() {
+		m[k.String()] = rv.MapIndex(k).Interface()
+	}
+	return m, true
+}
+
+// sliceValue returns v as []interface{} if it is a slice or array (except []byte)
+func sliceValue(v interface{}) ([]interface{}, bool) {
+	switch s := v.(type) {
+	case []interface{}:
+		return s, true
+	case []byte, nil:
+		return nil, false
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	s := make([]interface{}, rv.Len())
+	for i := range s {
+		s[i] = rv.Index(i).Interface()
+	}
+	return s, true
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type nameSelector []string
+
+func (sel nameSelector) selectFrom(node, root interface{}) []interface{} {
+	ret := []interface{}{}
+	if m, ok := mapValue(node); ok {
+		for _, name := range sel {
+			if v, ok := m[name]; ok {
+				ret = append(ret, v)
+			}
+		}
+	} else if s, ok := sliceValue(node); ok {
+		for _, name := range sel {
+			if i, err := strconv.Atoi(name); err == nil {
+				if v, ok := sliceIndex(s, i); ok {
+					ret = append(ret, v)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+type wildcardSelector struct{}
+
+func (wildcardSelector) selectFrom(node, root interface{}) []interface{} {
+	ret := []interface{}{}
+	if m, ok := mapValue(node); ok {
+		for _, k := range sortedKeys(m) {
+			ret = append(ret, m[k])
+		}
+	} else if s, ok := sliceValue(node); ok {
+		ret = append(ret, s...)
+	}
+	return ret
+}
+
+type indexSelector []int
+
+func sliceIndex(s []interface{}, i int) (interface{}, bool) {
+	if i < 0 {
+		i += len(s)
+	}
+	if i < 0 || i >= len(s) {
+		return nil, false
+	}
+	return s[i], true
+}
+
+func (sel indexSelector) selectFrom(node, root interface{}) []interface{} {
+	ret := []interface{}{}
+	if s, ok := sliceValue(node); ok {
+		for _, i := range sel {
+			if v, ok := sliceIndex(s, i); ok {
+				ret = append(ret, v)
+			}
+		}
+	}
+	return ret
+}
+
+type sliceSelector struct {
+	start, end *int
+	step       int
+}
+
+func (sel sliceSelector) selectFrom(node, root interface{}) []interface{} {
+	ret := []interface{}{}
+	s, ok := sliceValue(node)
+	if !ok || sel.step == 0 {
+		return ret
+	}
+	n := len(s)
+	norm := func(i *int, def int) int {
+		if i == nil {
+			return def
+		}
+		v := *i
+		if v < 0 {
+			v += n
+		}
+		if v < -1 {
+			v = -1
+		}
+		if v > n {
+			v = n
+		}
+		return v
+	}
+	if sel.step > 0 {
+		start, end := norm(sel.start, 0), norm(sel.end, n)
+		if start < 0 {
+			start = 0
+		}
+		for i := start; i < end; i += sel.step {
+			ret = append(ret, s[i])
+		}
+	} else {
+		start, end := norm(sel.start, n-1), norm(sel.end, -1)
+		if start >= n {
+			start = n - 1
+		}
+		for i := start; i > end; i += sel.step {
+			ret = append(ret, s[i])
+		}
+	}
+	return ret
+}
+
+type filterSelector struct {
+	expr filterExpr
+}
+
+func (sel filterSelector) selectFrom(node, root interface{}) []interface{} {
+	ret := []interface{}{}
+	if _, ok := mapValue(node); ok {
+		if truthy(sel.expr.eval(node, root)) {
+			ret = append(ret, node)
+		}
+	} else if s, ok := sliceValue(node); ok {
+		for _, item := range s {
+			if truthy(sel.expr.eval(item, root)) {
+				ret = append(ret, item)
+			}
+		}
+	}
+	return ret
+}
+
+type funcSelector string
+
+func (sel funcSelector) selectFrom(node, root interface{}) []interface{} {
+	switch sel {
+	case "length":
+		if m, ok := mapValue(node); ok {
+			return []interface{}{len(m)}
+		}
+		if s, ok := sliceValue(node); ok {
+			return []interface{}{len(s)}
+		}
+		if s, ok := node.(string); ok {
+			return []interface{}{len(s)}
+		}
+	case "keys":
+		if m, ok := mapValue(node); ok {
+			keys := []interface{}{}
+			for _, k := range sortedKeys(m) {
+				keys = append(keys, k)
+			}
+			return []interface{}{keys}
+		}
+		if s, ok := sliceValue(node); ok {
+			keys := []interface{}{}
+			for i := range s {
+				keys = append(keys, i)
+			}
+			return []interface{}{keys}
+		}
+	case "values":
+		if m, ok := mapValue(node); ok {
+			values := []interface{}{}
+			for _, k := range sortedKeys(m) {
+				values = append(values, m[k])
+			}
+			return []interface{}{values}
+		}
+		if s, ok := sliceValue(node); ok {
+			return []interface{}{s}
+		}
+	}
+	return []interface{}{}
+}
+
+var queryFuncs = map[string]bool{"length": true, "keys": true, "values": true}
+
+// filterExpr is a node of a filter expression tree
+type filterExpr interface {
+	eval(current, root interface{}) interface{}
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (e literalExpr) eval(current, root interface{}) interface{} {
+	return e.value
+}
+
+// pathExpr is @.path or $.path inside a filter, evaluating to the first match
+type pathExpr struct {
+	fromRoot bool
+	segments []querySegment
+}
+
+// missing marks a path without match, so it differs from an explicit null
+type missing struct{}
+
+func (e pathExpr) eval(current, root interface{}) interface{} {
+	node := current
+	if e.fromRoot {
+		node = root
+	}
+	res := evalSegments(e.segments, node, root)
+	if len(res) == 0 {
+		return missing{}
+	}
+	return res[0]
+}
+
+type notExpr struct {
+	expr filterExpr
+}
+
+func (e notExpr) eval(current, root interface{}) interface{} {
+	return !truthy(e.expr.eval(current, root))
+}
+
+type binaryExpr struct {
+	op          string
+	left, right filterExpr
+	re          *regexp.Regexp
+}
+
+func (e binaryExpr) eval(current, root interface{}) interface{} {
+	switch e.op {
+	case "&&":
+		return truthy(e.left.eval(current, root)) && truthy(e.right.eval(current, root))
+	case "||":
+		return truthy(e.left.eval(current, root)) || truthy(e.right.eval(current, root))
+	}
+	l, r := e.left.eval(current, root), e.right.eval(current, root)
+	if _, ok := l.(missing); ok {
+		return e.op == "!="
+	}
+	if _, ok := r.(missing); ok {
+		return e.op == "!="
+	}
+	switch e.op {
+	case "=~":
+		re := e.re
+		if re == nil {
+			var err error
+			if re, err = regexp.Compile(fmt.Sprintf("%v", r)); err != nil {
+				return false
+			}
+		}
+		return re.MatchString(fmt.Sprintf("%v", l))
+	case "==":
+		c, ok := compareValues(l, r)
+		return ok && c == 0
+	case "!=":
+		c, ok := compareValues(l, r)
+		return !ok || c != 0
+	}
+	c, ok := compareValues(l, r)
+	if !ok {
+		return false
+	}
+	switch e.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case missing, nil:
+		return false
+	case bool:
+		return t
+	}
+	return true
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return true
+	}
+	return false
+}
+
+// compareValues compares a and b, numerically if either is a number and the other converts,
+// returns false if they are not comparable
+func compareValues(a, b interface{}) (int, bool) {
+	if isNumber(a) || isNumber(b) {
+		fa, erra := cast.ToFloat64E(a)
+		fb, errb := cast.ToFloat64E(b)
+		if erra == nil && errb == nil {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	sa, oka := a.(string)
+	sb, okb := b.(string)
+	if oka && okb {
+		return strings.Compare(sa, sb), true
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0, true
+	}
+	return 0, false
+}
+
+type queryParser struct {
+	s   string
+	pos int
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query %q at %d: %s", p.s, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *queryParser) peek() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *queryParser) skipSpaces() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *queryParser) consume(tok string) bool {
+	if strings.HasPrefix(p.s[p.pos:], tok) {
+		p.pos += len(tok)
+		return true
+	}
+	return false
+}
+
+func isNameChar(c byte) bool {
+	return !strings.ContainsRune(".[]()=!<>&|,'\" \t*", rune(c))
+}
+
+func (p *queryParser) parseName() string {
+	start := p.pos
+	for p.pos < len(p.s) && isNameChar(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// parsePath parses segments; top level paths may start with $ or a bare name,
+// paths inside filters stop at the first character that can't continue a path
+func (p *queryParser) parsePath(top bool) ([]querySegment, error) {
+	segments := []querySegment{}
+	if top {
+		p.consume("$")
+		if c := p.peek(); c != 0 && c != '.' && c != '[' {
+			name := p.parseName()
+			if name == "" {
+				return nil, p.errorf("unexpected %q", c)
+			}
+			segments = append(segments, querySegment{sel: nameSelector{name}})
+		}
+	}
+	for p.pos < len(p.s) {
+		switch {
+		case p.consume(".."):
+			seg, err := p.parseDotSelector()
+			if err != nil {
+				return nil, err
+			}
+			seg.recursive = true
+			segments = append(segments, seg)
+		case p.consume("."):
+			seg, err := p.parseDotSelector()
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, seg)
+		case p.peek() == '[':
+			sel, err := p.parseBracket()
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, querySegment{sel: sel})
+		default:
+			if top {
+				return nil, p.errorf("unexpected %q", p.s[p.pos:])
+			}
+			return segments, nil
+		}
+	}
+	return segments, nil
+}
+
+func (p *queryParser) parseDotSelector() (querySegment, error) {
+	if p.consume("*") {
+		return querySegment{sel: wildcardSelector{}}, nil
+	}
+	if p.peek() == '[' {
+		sel, err := p.parseBracket()
+		return querySegment{sel: sel}, err
+	}
+	name := p.parseName()
+	if name == "" {
+		return querySegment{}, p.errorf("missing name")
+	}
+	if p.consume("()") {
+		if !queryFuncs[name] {
+			return querySegment{}, p.errorf("unknown function %s()", name)
+		}
+		return querySegment{sel: funcSelector(name)}, nil
+	}
+	return querySegment{sel: nameSelector{name}}, nil
+}
+
+func (p *queryParser) parseBracket() (querySelector, error) {
+	p.consume("[")
+	p.skipSpaces()
+	var sel querySelector
+	var err error
+	switch c := p.peek(); {
+	case c == '*':
+		p.pos++
+		sel = wildcardSelector{}
+	case c == '?':
+		p.pos++
+		p.skipSpaces()
+		paren := p.consume("(")
+		var expr filterExpr
+		if expr, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if paren && !p.consume(")") {
+			return nil, p.errorf("missing )")
+		}
+		sel = filterSelector{expr}
+	case c == '\'' || c == '"':
+		names := []string{}
+		for {
+			p.skipSpaces()
+			name, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, name)
+			p.skipSpaces()
+			if !p.consume(",") {
+				break
+			}
+		}
+		sel = nameSelector(names)
+	case c == ':' || (c >= '0' && c <= '9') || (c == '-' && p.pos+1 < len(p.s) && p.s[p.pos+1] >= '0' && p.s[p.pos+1] <= '9'):
+		if sel, err = p.parseIndexOrSlice(); err != nil {
+			return nil, err
+		}
+	default:
+		name := p.parseName()
+		if name == "" {
+			return nil, p.errorf("unexpected %q", c)
+		}
+		p.skipSpaces()
+		op := p.parseOperator()
+		if op == "" {
+			sel = nameSelector{name}
+			break
+		}
+		if op == "=" {
+			op = "=="
+		}
+		p.skipSpaces()
+		value := ""
+		if c := p.peek(); c == '\'' || c == '"' {
+			if value, err = p.parseString(); err != nil {
+				return nil, err
+			}
+		} else {
+			end := strings.IndexByte(p.s[p.pos:], ']')
+			if end < 0 {
+				return nil, p.errorf("missing ]")
+			}
+			value = strings.TrimSpace(p.s[p.pos : p.pos+end])
+			p.pos += end
+		}
+		var lit interface{} = value
+		if f, err := strconv.ParseFloat(value, 64); err == nil && op != "==" && op != "!=" && op != "=~" {
+			lit = f
+		}
+		expr := binaryExpr{op: op, left: pathExpr{segments: []querySegment{{sel: nameSelector{name}}}}, right: literalExpr{lit}}
+		if op == "=~" {
+			if expr.re, err = regexp.Compile(value); err != nil {
+				return nil, p.errorf("%v", err)
+			}
+		}
+		sel = filterSelector{expr}
+	}
+	p.skipSpaces()
+	if !p.consume("]") {
+		return nil, p.errorf("missing ]")
+	}
+	return sel, nil
+}
+
+func (p *queryParser) parseInt() (*int, error) {
+	start := p.pos
+	p.consume("-")
+	for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+		p.pos++
+	}
+	if start == p.pos {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(p.s[start:p.pos])
+	if err != nil {
+		return nil, p.errorf("invalid number %q", p.s[start:p.pos])
+	}
+	return &i, nil
+}
+
+func (p *queryParser) parseIndexOrSlice() (querySelector, error) {
+	first, err := p.parseInt()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.peek() == ':' {
+		sel := sliceSelector{start: first, step: 1}
+		p.pos++
+		if sel.end, err = p.parseInt(); err != nil {
+			return nil, err
+		}
+		if p.consume(":") {
+			step, err := p.parseInt()
+			if err != nil {
+				return nil, err
+			}
+			if step != nil {
+				if *step == 0 {
+					return nil, p.errorf("slice step can't be 0")
+				}
+				sel.step = *step
+			}
+		}
+		return sel, nil
+	}
+	if first == nil {
+		return nil, p.errorf("invalid index")
+	}
+	indexes := indexSelector{*first}
+	for p.consume(",") {
+		p.skipSpaces()
+		i, err := p.parseInt()
+		if err != nil {
+			return nil, err
+		}
+		if i == nil {
+			return nil, p.errorf("invalid index")
+		}
+		indexes = append(indexes, *i)
+		p.skipSpaces()
+	}
+	return indexes, nil
+}
+
+func (p *queryParser) parseString() (string, error) {
+	quote := p.peek()
+	if quote != '\'' && quote != '"' {
+		return "", p.errorf("expected string")
+	}
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '\\' && p.pos < len(p.s):
+			b.WriteByte(p.s[p.pos])
+			p.pos++
+		case c == quote:
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *queryParser) parseOperator() string {
+	for _, op := range []string{"==", "!=", "<=", ">=", "=~", "<", ">", "="} {
+		if p.consume(op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func (p *queryParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpaces()
+		if !p.consume("||") {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: "||", left: left, right: right}
+	}
+}
+
+func (p *queryParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpaces()
+		if !p.consume("&&") {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: "&&", left: left, right: right}
+	}
+}
+
+func (p *queryParser) parseNot() (filterExpr, error) {
+	p.skipSpaces()
+	if p.peek() == '!' && !strings.HasPrefix(p.s[p.pos:], "!=") {
+		p.pos++
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (filterExpr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	op := p.parseOperator()
+	if op == "" {
+		return left, nil
+	}
+	if op == "=" {
+		op = "=="
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	expr := binaryExpr{op: op, left: left, right: right}
+	if lit, ok := right.(literalExpr); ok && op == "=~" {
+		if expr.re, err = regexp.Compile(fmt.Sprintf("%v", lit.value)); err != nil {
+			return nil, p.errorf("%v", err)
+		}
+	}
+	return expr, nil
+}
+
+func (p *queryParser) parseOperand() (filterExpr, error) {
+	p.skipSpaces()
+	switch c := p.peek(); {
+	case c == '(':
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if !p.consume(")") {
+			return nil, p.errorf("missing )")
+		}
+		return expr, nil
+	case c == '@' || c == '$':
+		p.pos++
+		segments, err := p.parsePath(false)
+		if err != nil {
+			return nil, err
+		}
+		return pathExpr{fromRoot: c == '$', segments: segments}, nil
+	case c == '\'' || c == '"':
+		s, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		return literalExpr{s}, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.s) && strings.IndexByte("0123456789.eE+-", p.s[p.pos]) >= 0 {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", p.s[start:p.pos])
+		}
+		return literalExpr{f}, nil
+	}
+	switch {
+	case p.consume("true"):
+		return literalExpr{true}, nil
+	case p.consume("false"):
+		return literalExpr{false}, nil
+	case p.consume("null"):
+		return literalExpr{nil}, nil
+	}
+	if p.pos >= len(p.s) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return nil, p.errorf("unexpected %q", p.s[p.pos:])
+}
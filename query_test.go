@@ -0,0 +1,78 @@
+package filehelper
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/shoobyban/mxj"
+)
+
+type testQueryStruct struct {
+	Query  string
+	Result []interface{}
+}
+
+func TestQuery(t *testing.T) {
+	data := mxj.Map{
+		"order": map[string]interface{}{
+			"id": "42",
+			"lines": []interface{}{
+				map[string]interface{}{"sku": "ABC", "qty": "2", "price": 9.5},
+				map[string]interface{}{"sku": "DEF", "qty": "1", "price": 20},
+				map[string]interface{}{"sku": "XYZ", "qty": "5", "price": 1.25, "-gift": "true"},
+			},
+			"customer": map[string]interface{}{"name": "Jane", "country": "GB"},
+		},
+	}
+	tests := map[string]testQueryStruct{
+		"dot":          {Query: "$.order.id", Result: []interface{}{"42"}},
+		"bare":         {Query: "order.customer.name", Result: []interface{}{"Jane"}},
+		"bracket":      {Query: "$['order']['customer'][\"country\"]", Result: []interface{}{"GB"}},
+		"index":        {Query: "order.lines[1].sku", Result: []interface{}{"DEF"}},
+		"negative":     {Query: "order.lines[-1].sku", Result: []interface{}{"XYZ"}},
+		"dotindex":     {Query: "order.lines.0.sku", Result: []interface{}{"ABC"}},
+		"indexes":      {Query: "order.lines[0,2].sku", Result: []interface{}{"ABC", "XYZ"}},
+		"slice":        {Query: "order.lines[1:].sku", Result: []interface{}{"DEF", "XYZ"}},
+		"step":         {Query: "order.lines[::-2].sku", Result: []interface{}{"XYZ", "ABC"}},
+		"wildcard":     {Query: "order.lines[*].qty", Result: []interface{}{"2", "1", "5"}},
+		"wildcardmap":  {Query: "order.customer.*", Result: []interface{}{"GB", "Jane"}},
+		"recursive":    {Query: "$..sku", Result: []interface{}{"ABC", "DEF", "XYZ"}},
+		"filter":       {Query: "order.lines[?(@.qty > 1 && @.price < 5)].sku", Result: []interface{}{"XYZ"}},
+		"filteror":     {Query: "order.lines[?(@.sku == 'ABC' || @.sku == \"DEF\")].qty", Result: []interface{}{"2", "1"}},
+		"filternot":    {Query: "order.lines[?(!(@.sku =~ '^[A-C]'))].sku", Result: []interface{}{"DEF", "XYZ"}},
+		"filterexists": {Query: "order.lines[?(@.-gift)].sku", Result: []interface{}{"XYZ"}},
+		"filterroot":   {Query: "order.lines[?(@.qty == $.order.lines[1].qty)].sku", Result: []interface{}{"DEF"}},
+		"shorthand":    {Query: "order.lines[sku=ABC].price", Result: []interface{}{9.5}},
+		"shorthanddot": {Query: "order.lines.[qty>=2].sku", Result: []interface{}{"ABC", "XYZ"}},
+		"shorthandnum": {Query: "order.lines[price>9].sku", Result: []interface{}{"ABC", "DEF"}},
+		"filtermap":    {Query: "order.customer[country=GB].name", Result: []interface{}{"Jane"}},
+		"length":       {Query: "order.lines.length()", Result: []interface{}{3}},
+		"keys":         {Query: "order.customer.keys()", Result: []interface{}{[]interface{}{"country", "name"}}},
+		"lengthfilter": {Query: "order[?(@.lines.length() > 2)].id", Result: []interface{}{"42"}},
+		"nomatch":      {Query: "order.nothing.here", Result: []interface{}{}},
+	}
+	for name, test := range tests {
+		res, err := Query(data, test.Query)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, test.Result) {
+			t.Errorf("%s: %#v != %#v", name, res, test.Result)
+		}
+	}
+
+	for _, invalid := range []string{"order[", "order.lines[?(@.a ==)]", "order.size()", "a[1:2:0]", "a[?(@.b =~ '(')]", "a]"} {
+		if _, err := Query(data, invalid); err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+
+	res, err := Template(`{{ queryOne . "order.lines[sku=DEF].price" }}`, data)
+	if err != nil || res != "20" {
+		t.Errorf("template: %#v %v", res, err)
+	}
+	if _, err := Template(`{{ query . "order[" }}`, data); err == nil {
+		t.Errorf("template: expected error")
+	}
+}
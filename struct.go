@@ -5,11 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"os"
 
 	csvmap "github.com/recursionpharma/go-csv-map"
 	"github.com/shoobyban/mxj"
 	"github.com/shoobyban/slog"
+	"github.com/spf13/afero"
 )
 
 // ParserFunc is to parse a []byte into an interface{}
@@ -18,6 +18,7 @@ type ParserFunc func([]byte) (interface{}, error)
 // Parser is the main type
 type Parser struct {
 	parsers map[string]ParserFunc
+	fs      afero.Fs
 }
 
 // NewParser defines a new parser
@@ -49,9 +50,14 @@ func (l *Parser) RegisterParser(format string, parser ParserFunc) {
 	l.parsers[format] = parser
 }
 
+// RegisterFS sets the (afero) filesystem for this parser, overriding the package default
+func (l *Parser) RegisterFS(filesystem afero.Fs) {
+	l.fs = filesystem
+}
+
 // ReadStruct reads from given file, parsing into structure
 func (l *Parser) ReadStruct(filename, format string) (interface{}, error) {
-	f, err := os.Open(filename)
+	f, err := orDefaultFS(l.fs).Open(filename)
 	if err != nil {
 		slog.Infof("Can't open file %s", filename)
 		return nil, err
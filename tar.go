@@ -3,157 +3,351 @@ package filehelper
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
-	"time"
 
 	"github.com/shoobyban/slog"
+	"github.com/spf13/afero"
 )
 
-// WriteTar will append to datafile with filename using buf data
+// ErrNotInArchive is returned (wrapped) when the requested file is not in the archive
+var ErrNotInArchive = errors.New("file not found in archive")
+
+// CorruptArchiveError is returned when an archive can't be read
+type CorruptArchiveError struct {
+	Archive string
+	Err     error
+}
+
+func (e *CorruptArchiveError) Error() string {
+	return fmt.Sprintf("corrupt archive %s: %v", e.Archive, e.Err)
+}
+
+// Unwrap returns the underlying reader error
+func (e *CorruptArchiveError) Unwrap() error {
+	return e.Err
+}
+
+// WriteTar will append to datafile with filename using buf data, errors are only logged, use WriteTarE to handle them
 func WriteTar(datafile, filename string, buf []byte) {
-	f, err := os.OpenFile(datafile, os.O_RDWR, os.ModePerm)
-	if err != nil {
-		f, err = os.OpenFile(datafile, os.O_WRONLY|os.O_CREATE, os.ModePerm)
-	} else {
-		fi, err := os.Stat(datafile)
-		if err != nil {
-			log.Fatalln(err)
-		}
-		if fi.Size() > 1024 {
-			if _, err = f.Seek(-2<<9, os.SEEK_END); err != nil {
-				log.Fatalln(err)
-			}
-		}
+	if err := WriteTarFS(fs, datafile, filename, buf); err != nil {
+		slog.Infof("Error writing %s to %s: %v", filename, datafile, err)
 	}
-	tw := tar.NewWriter(f)
+}
 
-	hdr := &tar.Header{
-		Name:       filename,
-		Typeflag:   tar.TypeReg,
-		ModTime:    time.Now(),
-		AccessTime: time.Now(),
-		ChangeTime: time.Now(),
-		Mode:       0644,
-		Size:       int64(len(buf)),
-		Format:     tar.FormatGNU,
-	}
-	slog.Infof("Writing %s %d", filename, int64(len(buf)))
-	if err := tw.WriteHeader(hdr); err != nil {
-		slog.Infof("Error writing tar header %s", err.Error())
-	}
-	if _, err := tw.Write(buf); err != nil {
-		slog.Infof("Error writing tar data %s", err.Error())
+// WriteTarFS will append to datafile on given (afero) filesystem with filename using buf data,
+// holding the archive locks while writing, see TarWriter
+func WriteTarFS(filesystem afero.Fs, datafile, filename string, buf []byte) error {
+	tw, err := NewTarWriterFS(filesystem, datafile)
+	if err != nil {
+		return err
 	}
-	if err := tw.Close(); err != nil {
-		slog.Infof("Error closing tar %s", err.Error())
+	if err := tw.Write(filename, buf); err != nil {
+		tw.abort()
+		return err
 	}
-	f.Close()
+	return tw.Close()
+}
+
+// WriteTarE will append to datafile with filename using buf data, returns error instead of exiting
+func WriteTarE(datafile, filename string, buf []byte) error {
+	return WriteTarFS(fs, datafile, filename, buf)
 }
 
-// ListTar will return file list from given tar file
+// ListTar will return file list from given tar file, exits on error, see ListTarE
 func ListTar(filename string) []string {
-	var ret []string
-	f, err := os.Open(filename)
+	ret, err := ListTarFS(fs, filename)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	defer f.Close()
+	return ret
+}
 
-	tarReader := tar.NewReader(f)
-	// defer io.Copy(os.Stdout, tarReader)
+// ListTarFS will return file list from given tar file on given (afero) filesystem,
+// uses the sidecar index if it's up to date. Payload entries of deduplicated archives are left out
+func ListTarFS(filesystem afero.Fs, filename string) ([]string, error) {
+	var ret []string
+	filesystem = orDefaultFS(filesystem)
+	f, err := filesystem.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if idx, err := loadTarIndex(filesystem, filename, f); err == nil {
+		for _, e := range idx.entries {
+			if !isTarBlob(e.Name) {
+				ret = append(ret, e.Name)
+			}
+		}
+		return ret, nil
+	}
 
-	for true {
+	tarReader, done, err := openTar(f, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	for {
 		header, err := tarReader.Next()
-
 		if err == io.EOF {
 			break
 		}
-
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			return ret, &CorruptArchiveError{filename, err}
 		}
-
-		name := header.Name
-
-		switch header.Typeflag {
-		case tar.TypeReg: // = regular file
-			ret = append(ret, name)
-		default:
-			ret = append(ret, name)
+		if !isTarBlob(header.Name) {
+			ret = append(ret, header.Name)
 		}
 	}
-	return ret
+	return ret, nil
+}
+
+// ListTarE will return file list from given tar file, returns error instead of exiting
+func ListTarE(filename string) ([]string, error) {
+	return ListTarFS(fs, filename)
 }
 
-// ReadTar reads filename from given tarball and returns content
+// ReadTar reads the latest version of filename from given tarball and returns content,
+// nil if filename is not in the tarball, exits on other errors, see ReadTarE
 func ReadTar(tarfile, filename string) interface{} {
-	f, err := os.Open(tarfile)
+	bs, err := ReadTarFS(fs, tarfile, filename)
+	if errors.Is(err, ErrNotInArchive) {
+		return nil
+	}
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	return bs
+}
+
+// ReadTarE reads the latest version of filename from given tarball and returns content, returns error instead of exiting
+func ReadTarE(tarfile, filename string) ([]byte, error) {
+	return ReadTarFS(fs, tarfile, filename)
+}
+
+// ReadTarFS reads the latest version of filename from given tarball on given (afero) filesystem and returns
+// content, see ReadTarVersionFS for older versions. Hard links (as in deduplicated archives) return the content
+// their target had when the link was written. The error wraps ErrNotInArchive if filename is not in the tarball.
+// Uses the sidecar index if it's up to date
+func ReadTarFS(filesystem afero.Fs, tarfile, filename string) ([]byte, error) {
+	return readTar(orDefaultFS(filesystem), tarfile, filename, -1)
+}
+
+// readTar reads the latest version of filename among the entries before position before (all if negative),
+// a hard link returns the version of its target written before the link
+func readTar(filesystem afero.Fs, tarfile, filename string, before int) ([]byte, error) {
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
+	notFound := fmt.Errorf("%s in %s: %w", filename, tarfile, ErrNotInArchive)
+	if idx, err := loadTarIndex(filesystem, tarfile, f); err == nil {
+		versions := idx.byName[filename]
+		for len(versions) > 0 && before >= 0 && versions[len(versions)-1] >= before {
+			versions = versions[:len(versions)-1]
+		}
+		if len(versions) == 0 {
+			return nil, notFound
+		}
+		pos := versions[len(versions)-1]
+		if idx.entries[pos].Link != "" {
+			return readTar(filesystem, tarfile, idx.entries[pos].Link, pos)
+		}
+		// an index left behind by a rewrite with another tool is found by the checksum, the archive is scanned then
+		if bs, err := readTarIndexEntry(f, tarfile, idx.entries[pos]); !errors.Is(err, ErrNoTarIndex) {
+			return bs, err
+		}
+	}
 
-	tarReader := tar.NewReader(f)
-	for true {
+	tarReader, done, err := openTar(f, tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	var latest []byte
+	var link string
+	pos := -1
+	for n := 0; before < 0 || n < before; n++ {
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		}
-
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
+			return nil, &CorruptArchiveError{tarfile, err}
 		}
-
 		if header.Name == filename {
-
-			bs, _ := ioutil.ReadAll(tarReader)
-			return bs
+			pos, link = n, ""
+			if header.Typeflag == tar.TypeLink {
+				link = header.Linkname
+			}
+			r, err := entryData(tarfile, header, tarReader)
+			if err != nil {
+				return nil, err
+			}
+			if latest, err = ioutil.ReadAll(r); err != nil {
+				return nil, &CorruptArchiveError{tarfile, err}
+			}
 		}
+	}
+	if pos < 0 {
+		return nil, notFound
+	}
+	if link != "" {
+		return readTar(filesystem, tarfile, link, pos)
+	}
+	return latest, nil
+}
 
+// readTarIndexEntry reads the (decrypted) data of an indexed entry, the error wraps ErrNoTarIndex
+// if the data doesn't match the checksum of a regular file entry
+func readTarIndexEntry(f afero.File, tarfile string, e TarIndexEntry) ([]byte, error) {
+	bs := make([]byte, e.Size)
+	if n, err := f.ReadAt(bs, e.Offset); n < len(bs) {
+		return nil, &CorruptArchiveError{tarfile, err}
 	}
-	return nil
+	if sum := sha256.Sum256(bs); e.Type == "" && e.SHA256 != "" && hex.EncodeToString(sum[:]) != e.SHA256 {
+		return nil, fmt.Errorf("%s doesn't match %s at %d: %w", tarfile+TarIndexSuffix, e.Name, e.Offset, ErrNoTarIndex)
+	}
+	if e.Encrypted {
+		return decryptEntry(e.Name, e.Key, bs)
+	}
+	return bs, nil
 }
 
-// FindInTar looks for search string in tarball, returns list of filenames and matches
+// FindInTar looks for search string in tarball, returns list of filenames and matches, exits on error, see FindInTarE
 func FindInTar(tarfile, search string) map[string]string {
-	f, err := os.Open(tarfile)
+	res, err := FindInTarFS(fs, tarfile, search)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	return res
+}
+
+// FindInTarE looks for search string in tarball, returns list of filenames and matches, returns error instead of exiting
+func FindInTarE(tarfile, search string) (map[string]string, error) {
+	return FindInTarFS(fs, tarfile, search)
+}
+
+// FindInTarFS looks for search string in the latest version of each file in tarball on given (afero) filesystem,
+// returns list of filenames and matches (the first one per file), see SearchTarFS for regular expressions
+// and all matching lines
+func FindInTarFS(filesystem afero.Fs, tarfile, search string) (map[string]string, error) {
+	f, err := orDefaultFS(filesystem).Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
+	// only the latest version of a name is reported, as ReadTar returns it, matches in deduplicated payloads
+	// are reported under the names linking to them
 	res := map[string]string{}
-	tarReader := tar.NewReader(f)
-	for true {
+	tarReader, done, err := openTar(f, tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		}
-
 		if err != nil {
-			fmt.Println(err)
-			os.Exit(1)
-		}
-		bs, _ := ioutil.ReadAll(tarReader)
-		if bytes.Contains(bs, []byte(search)) {
-			begining := bytes.Index(bs, []byte(search))
-			end := begining + len(search) + 3
-			if begining > 3 {
-				begining = begining - 3
-			}
-			if end > len(bs) {
-				end = len(bs)
+			return findResults(res), &CorruptArchiveError{tarfile, err}
+		}
+		delete(res, header.Name)
+		if header.Typeflag == tar.TypeLink {
+			// hard links match with the content their target had when they were written
+			if match, ok := res[header.Linkname]; ok {
+				res[header.Name] = match
 			}
-			res[header.Name] = string(bs[begining:end])
+			continue
+		}
+		r, err := entryData(tarfile, header, tarReader)
+		if err != nil {
+			return findResults(res), err
+		}
+		match, ok, err := findSnippetReader(r, search)
+		if err != nil {
+			return findResults(res), &CorruptArchiveError{tarfile, err}
+		}
+		if ok {
+			res[header.Name] = match
+		}
+	}
+	return findResults(res), nil
+}
+
+// findResults drops the matches of payload entries from res
+func findResults(res map[string]string) map[string]string {
+	for name := range res {
+		if isTarBlob(name) {
+			delete(res, name)
 		}
 	}
 	return res
 }
+
+// findSnippet returns search with up to 3 bytes of context around its first occurrence in bs
+func findSnippet(bs []byte, search string) (string, bool) {
+	match, ok, _ := findSnippetReader(bytes.NewReader(bs), search)
+	return match, ok
+}
+
+// findSnippetReader is findSnippet reading r in chunks instead of loading it into memory
+func findSnippetReader(r io.Reader, search string) (string, bool, error) {
+	s := []byte(search)
+	// kept from the previous chunk: a partial match with its context before
+	keep := len(s) + 2
+	chunk := make([]byte, 32*1024)
+	var buf []byte
+	var start int64
+	for {
+		n, err := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if i := bytes.Index(buf, s); i >= 0 {
+			end := i + len(s) + 3
+			for len(buf) < end && err == nil {
+				n, err = r.Read(chunk)
+				buf = append(buf, chunk[:n]...)
+			}
+			if err != nil && err != io.EOF {
+				return "", false, err
+			}
+			if end > len(buf) {
+				end = len(buf)
+			}
+			begining := i
+			if start+int64(i) > 3 {
+				begining = i - 3
+			}
+			return string(buf[begining:end]), true, nil
+		}
+		if err == io.EOF {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if len(buf) > keep {
+			start += int64(len(buf) - keep)
+			buf = append(buf[:0], buf[len(buf)-keep:]...)
+		}
+	}
+}
+
+// openTar returns a tar reader of f, decompressing it if needed, done releases the decompressor
+func openTar(f io.Reader, tarfile string) (tr *tar.Reader, done func(), err error) {
+	r, done, err := decompressReader(f)
+	if err != nil {
+		return nil, nil, &CorruptArchiveError{tarfile, err}
+	}
+	return tar.NewReader(r), done, nil
+}
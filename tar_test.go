@@ -0,0 +1,1429 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestTarFS(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	files := map[string]string{
+		"a.txt": "first file",
+		"b.txt": "second file with needle inside",
+		"c.txt": "third",
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := WriteTarFS(mfs, "data.tar", name, []byte(files[name])); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	list, err := ListTarFS(mfs, "data.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []string{"a.txt", "b.txt", "c.txt"}) {
+		t.Errorf("list: %#v", list)
+	}
+	for name, content := range files {
+		bs, err := ReadTarFS(mfs, "data.tar", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(bs) != content {
+			t.Errorf("%s: %#v != %#v", name, string(bs), content)
+		}
+	}
+	found, err := FindInTarFS(mfs, "data.tar", "needle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, map[string]string{"b.txt": "th needle in"}) {
+		t.Errorf("find: %#v", found)
+	}
+	if _, err := ListTarFS(mfs, "missing.tar"); err == nil {
+		t.Errorf("expected error for missing archive")
+	}
+}
+
+func TestCompressedTar(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	for _, name := range []string{"data.tar.gz", "data.tar.zst", "data.txz"} {
+		for _, entry := range []string{"a.txt", "b.txt"} {
+			if err := WriteTarFS(mfs, name, entry, []byte("content of "+entry)); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		head := make([]byte, 6)
+		f, _ := mfs.Open(name)
+		f.Read(head)
+		f.Close()
+		if c := DetectCompression(head); c != CompressionFromName(name) {
+			t.Errorf("%s: written as %s", name, c)
+		}
+		list, err := ListTarFS(mfs, name)
+		if err != nil || !reflect.DeepEqual(list, []string{"a.txt", "b.txt"}) {
+			t.Errorf("%s list: %#v %v", name, list, err)
+		}
+		if bs, err := ReadTarFS(mfs, name, "b.txt"); err != nil || string(bs) != "content of b.txt" {
+			t.Errorf("%s read: %#v %v", name, string(bs), err)
+		}
+		if found, err := FindInTarFS(mfs, name, "of a"); err != nil || !reflect.DeepEqual(found, map[string]string{"a.txt": "nt of a.tx"}) {
+			t.Errorf("%s find: %#v %v", name, found, err)
+		}
+	}
+	if err := WriteTarFS(mfs, "data.tar.bz2", "a.txt", []byte("a")); err == nil {
+		t.Errorf("expected error writing bzip2")
+	}
+	afero.WriteFile(mfs, "bad.tar.gz", []byte{0x1f, 0x8b, 0, 0}, 0644)
+	var corrupt *CorruptArchiveError
+	if _, err := ListTarFS(mfs, "bad.tar.gz"); !errors.As(err, &corrupt) {
+		t.Errorf("expected CorruptArchiveError, got %v", err)
+	}
+}
+
+func TestTarErrors(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	RegisterFS(mfs)
+	defer RegisterFS(nil)
+
+	if err := WriteTarE("data.tar", "a.txt", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := ReadTarE("data.tar", "a.txt"); err != nil || string(bs) != "content" {
+		t.Errorf("read: %#v %v", string(bs), err)
+	}
+	if _, err := ReadTarE("data.tar", "missing.txt"); !errors.Is(err, ErrNotInArchive) {
+		t.Errorf("expected ErrNotInArchive, got %v", err)
+	}
+	if ReadTar("data.tar", "missing.txt") != nil {
+		t.Errorf("expected nil for missing entry")
+	}
+
+	afero.WriteFile(mfs, "corrupt.tar", []byte("this is not a tar file, just some text that is long enough to be read as a header block"), 0644)
+	var corrupt *CorruptArchiveError
+	if _, err := ListTarE("corrupt.tar"); !errors.As(err, &corrupt) || corrupt.Archive != "corrupt.tar" {
+		t.Errorf("list: expected CorruptArchiveError, got %v", err)
+	}
+	if _, err := ReadTarE("corrupt.tar", "a.txt"); !errors.As(err, &corrupt) {
+		t.Errorf("read: expected CorruptArchiveError, got %v", err)
+	}
+	if _, err := FindInTarE("corrupt.tar", "text"); !errors.As(err, &corrupt) {
+		t.Errorf("find: expected CorruptArchiveError, got %v", err)
+	}
+	if _, err := FindInTarE("missing.tar", "text"); err == nil || errors.As(err, &corrupt) {
+		t.Errorf("find: expected open error, got %v", err)
+	}
+}
+
+func TestRegisterFS(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	afero.WriteFile(mfs, "t.tmpl", []byte(`Hello {{.name}}`), 0644)
+	afero.WriteFile(mfs, "t.csv", []byte("A,B\nC,D\n"), 0644)
+	afero.WriteFile(mfs, "t.json", []byte(`{"a":"b"}`), 0644)
+
+	RegisterFS(mfs)
+	defer RegisterFS(nil)
+
+	if out := MustProcessTemplateFile("t.tmpl", map[string]string{"name": "World"}); out != "Hello World" {
+		t.Errorf("template: %#v", out)
+	}
+	rows, cols, err := ReadCSV("t.csv")
+	if err != nil || !reflect.DeepEqual(cols, []string{"A", "B"}) || rows[0]["A"] != "C" {
+		t.Errorf("csv: %#v %#v %v", rows, cols, err)
+	}
+	p := NewParser()
+	if _, err := p.ReadStruct("t.json", "json"); err != nil {
+		t.Errorf("struct: %v", err)
+	}
+	p.RegisterFS(afero.NewMemMapFs())
+	if _, err := p.ReadStruct("t.json", "json"); err == nil {
+		t.Errorf("expected parser filesystem to override the default")
+	}
+}
+
+func TestTarIndex(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		WriteTarFS(mfs, "data.tar", name, []byte(strings.Repeat(name[:1], 600)))
+	}
+	entries, err := ReadTarIndexFS(mfs, "data.tar")
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("index: %#v %v", entries, err)
+	}
+	// each entry has a PAX checksum record (header and data block) and its header before the data
+	if entries[1].Name != "b.txt" || entries[1].Size != 600 || entries[1].Offset != 2560+1536 || entries[1].End != entries[1].Offset+1024 {
+		t.Errorf("index entry: %#v", entries[1])
+	}
+	sum := sha256.Sum256([]byte(strings.Repeat("b", 600)))
+	if entries[1].SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("checksum: %s", entries[1].SHA256)
+	}
+
+	// reads go through the index: swapped offsets return the other entry
+	swapped := []TarIndexEntry{entries[1], entries[0], entries[2]}
+	swapped[0].Name, swapped[1].Name = "a.txt", "b.txt"
+	var buf bytes.Buffer
+	for _, e := range swapped {
+		json.NewEncoder(&buf).Encode(e)
+	}
+	afero.WriteFile(mfs, "data.tar"+TarIndexSuffix, buf.Bytes(), 0644)
+	if bs, _ := ReadTarFS(mfs, "data.tar", "a.txt"); string(bs[:1]) != "b" {
+		t.Errorf("expected indexed read, got %s", bs[:1])
+	}
+	if list, _ := ListTarFS(mfs, "data.tar"); !reflect.DeepEqual(list, []string{"a.txt", "b.txt", "c.txt"}) {
+		t.Errorf("indexed list: %#v", list)
+	}
+
+	// an archive appended without updating the index falls back to scanning
+	f, _ := mfs.OpenFile("data.tar", os.O_RDWR, 0644)
+	f.Seek(entries[2].End, io.SeekStart)
+	tw := tar.NewWriter(f)
+	tw.WriteHeader(&tar.Header{Name: "d.txt", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+	tw.Write([]byte("d"))
+	tw.Close()
+	f.Close()
+	if _, err := ReadTarIndexFS(mfs, "data.tar"); !errors.Is(err, ErrNoTarIndex) {
+		t.Errorf("expected stale index, got %v", err)
+	}
+	if bs, err := ReadTarFS(mfs, "data.tar", "d.txt"); err != nil || string(bs) != "d" {
+		t.Errorf("scan read: %#v %v", string(bs), err)
+	}
+	if err := RebuildTarIndexFS(mfs, "data.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := ReadTarIndexFS(mfs, "data.tar"); len(entries) != 4 || entries[0].Offset != 1536 {
+		t.Errorf("rebuilt index: %#v", entries)
+	}
+
+	// archives without an index get one on the next write
+	mfs.Remove("data.tar" + TarIndexSuffix)
+	WriteTarFS(mfs, "data.tar", "e.txt", []byte("e"))
+	if entries, err := ReadTarIndexFS(mfs, "data.tar"); err != nil || len(entries) != 5 {
+		t.Errorf("index after write: %d %v", len(entries), err)
+	}
+	if bs, err := ReadTarFS(mfs, "data.tar", "e.txt"); err != nil || string(bs) != "e" {
+		t.Errorf("read: %#v %v", string(bs), err)
+	}
+	if err := RebuildTarIndexFS(mfs, "missing.tar"); err == nil {
+		t.Errorf("expected error for missing archive")
+	}
+
+	// a replaced archive of the same size keeps a matching trailer, the checksums find the stale index
+	for i, name := range []string{"a.txt", "b.txt"} {
+		WriteTarFS(mfs, "old.tar", name, []byte(strings.Repeat(name[:1], 600)))
+		WriteTarFS(mfs, "new.tar", name, []byte(strings.Repeat("n", 100+1000*i)))
+	}
+	raw, _ := afero.ReadFile(mfs, "new.tar")
+	afero.WriteFile(mfs, "old.tar", raw, 0644)
+	if _, err := ReadTarIndexFS(mfs, "old.tar"); err != nil {
+		t.Errorf("expected a matching trailer: %v", err)
+	}
+	if bs, err := ReadTarFS(mfs, "old.tar", "b.txt"); err != nil || string(bs) != strings.Repeat("n", 1100) {
+		t.Errorf("read replaced archive: %q %v", bs, err)
+	}
+	if bs, err := ReadTarVersionFS(mfs, "old.tar", "a.txt", 0); err != nil || string(bs) != strings.Repeat("n", 100) {
+		t.Errorf("read version of replaced archive: %q %v", bs, err)
+	}
+}
+
+func TestTarConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filehelper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, filesystem := range []afero.Fs{afero.NewMemMapFs(), afero.NewBasePathFs(afero.NewOsFs(), dir)} {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					if err := WriteTarFS(filesystem, "data.tar", fmt.Sprintf("%d-%d.txt", i, j), []byte(strings.Repeat("x", 100*i+j))); err != nil {
+						t.Error(err)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+		if list, err := ListTarFS(filesystem, "data.tar"); err != nil || len(list) != 50 {
+			t.Errorf("%s list: %d %v", filesystem.Name(), len(list), err)
+		}
+		if entries, err := ReadTarIndexFS(filesystem, "data.tar"); err != nil || len(entries) != 50 {
+			t.Errorf("%s index: %d %v", filesystem.Name(), len(entries), err)
+		}
+	}
+}
+
+func TestTarConcurrentViews(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no file locks")
+	}
+	dir, err := ioutil.TempDir("", "filehelper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink(dir, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	osfs := afero.NewOsFs()
+	base := afero.NewBasePathFs(osfs, dir)
+	if f, err := base.Create("probe"); err != nil {
+		t.Fatal(err)
+	} else if _, ok := osFile(f); !ok {
+		t.Errorf("base path file not unwrapped")
+	} else {
+		f.Close()
+	}
+	// the symlinked view gets its own process lock, only the file lock keeps it out
+	views := []struct {
+		fs   afero.Fs
+		name string
+	}{
+		{osfs, filepath.Join(dir, "views.tar")},
+		{base, "views.tar"},
+		{osfs, filepath.Join(dir, "link", "views.tar")},
+	}
+	var wg sync.WaitGroup
+	for i, v := range views {
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(i, j int, filesystem afero.Fs, name string) {
+				defer wg.Done()
+				for k := 0; k < 5; k++ {
+					if err := WriteTarFS(filesystem, name, fmt.Sprintf("%d-%d-%d.txt", i, j, k), []byte(strings.Repeat("x", 500*j+k))); err != nil {
+						t.Error(err)
+					}
+				}
+			}(i, j, v.fs, v.name)
+		}
+	}
+	wg.Wait()
+	if list, err := ListTarFS(base, "views.tar"); err != nil || len(list) != 60 {
+		t.Errorf("list: %d %v", len(list), err)
+	}
+	if report, err := VerifyTarFS(base, "views.tar"); err != nil || !report.OK() {
+		t.Errorf("verify: %#v %v", report, err)
+	}
+}
+
+func TestTarWriterReplaced(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no file locks")
+	}
+	dir, err := ioutil.TempDir("", "filehelper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	osfs := afero.NewOsFs()
+	name := filepath.Join(dir, "data.tar")
+	WriteTarFS(osfs, name, "old.txt", []byte("old"))
+	// a rewrite holds the file lock while replacing the archive, a writer waiting for it appends to the new one
+	f, funlock, err := openLocked(osfs, name, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan error)
+	go func() {
+		written <- WriteTarFS(osfs, name, "waiting.txt", []byte("waiting"))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	WriteTarFS(osfs, name+".new", "new.txt", []byte("new"))
+	osfs.Remove(name + TarIndexSuffix)
+	if err := osfs.Rename(name+".new", name); err != nil {
+		t.Fatal(err)
+	}
+	funlock()
+	f.Close()
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if names, err := ListTarFS(osfs, name); err != nil || !reflect.DeepEqual(names, []string{"new.txt", "waiting.txt"}) {
+		t.Errorf("after replace: %#v %v", names, err)
+	}
+}
+
+func TestTarWriter(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	for _, name := range []string{"batch.tar", "batch.tar.gz"} {
+		WriteTarFS(mfs, name, "first.txt", []byte("first"))
+		w, err := NewTarWriterFS(mfs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := w.Write(fmt.Sprintf("%d.txt", i), []byte(fmt.Sprintf("content %d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write("late.txt", nil); err == nil {
+			t.Errorf("%s: expected error writing to closed writer", name)
+		}
+		list, err := ListTarFS(mfs, name)
+		if err != nil || len(list) != 101 || list[0] != "first.txt" || list[100] != "99.txt" {
+			t.Errorf("%s list: %d %v", name, len(list), err)
+		}
+		if bs, err := ReadTarFS(mfs, name, "42.txt"); err != nil || string(bs) != "content 42" {
+			t.Errorf("%s read: %#v %v", name, string(bs), err)
+		}
+	}
+	if entries, err := ReadTarIndexFS(mfs, "batch.tar"); err != nil || len(entries) != 101 {
+		t.Errorf("index: %d %v", len(entries), err)
+	}
+}
+
+func TestRepairTar(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	write := func(name string) {
+		for _, entry := range []string{"a.txt", "b.txt", "c.txt"} {
+			WriteTarFS(mfs, name, entry, []byte(strings.Repeat(entry[:1], 700)))
+		}
+	}
+	write("data.tar")
+	entries, _ := ReadTarIndexFS(mfs, "data.tar")
+	if report, err := RepairTarFS(mfs, "data.tar"); err != nil || report.Repaired || report.Entries != 3 {
+		t.Errorf("clean archive: %#v %v", report, err)
+	}
+
+	// crash in the middle of the last entry's data
+	f, _ := mfs.OpenFile("data.tar", os.O_RDWR, 0644)
+	f.Truncate(entries[2].Offset + 100)
+	f.Close()
+	report, err := RepairTarFS(mfs, "data.tar")
+	expected := &TarRepairReport{Entries: 2, Lost: []string{"c.txt"}, Truncated: entries[2].Offset + 100 - entries[1].End, Repaired: true}
+	if err != nil || !reflect.DeepEqual(report, expected) {
+		t.Errorf("repair: %#v != %#v (%v)", report, expected, err)
+	}
+	if list, err := ListTarFS(mfs, "data.tar"); err != nil || !reflect.DeepEqual(list, []string{"a.txt", "b.txt"}) {
+		t.Errorf("list after repair: %#v %v", list, err)
+	}
+	if entries, err := ReadTarIndexFS(mfs, "data.tar"); err != nil || len(entries) != 2 {
+		t.Errorf("index after repair: %d %v", len(entries), err)
+	}
+
+	// crash before the end of archive blocks were written keeps all entries
+	mfs.Remove("data.tar")
+	write("data.tar")
+	f, _ = mfs.OpenFile("data.tar", os.O_RDWR, 0644)
+	f.Truncate(entries[2].End)
+	f.Close()
+	report, err = RepairTarFS(mfs, "data.tar")
+	if err != nil || report.Entries != 3 || report.Lost != nil || !report.Repaired {
+		t.Errorf("missing trailer: %#v %v", report, err)
+	}
+
+	// the next append after a crash goes after the last complete entry
+	f, _ = mfs.OpenFile("data.tar", os.O_RDWR, 0644)
+	f.Truncate(entries[2].Offset + 100)
+	f.Close()
+	if err := WriteTarFS(mfs, "data.tar", "d.txt", []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := ListTarFS(mfs, "data.tar"); err != nil || !reflect.DeepEqual(list, []string{"a.txt", "b.txt", "d.txt"}) {
+		t.Errorf("append after crash: %#v %v", list, err)
+	}
+	if bs, err := ReadTarFS(mfs, "data.tar", "d.txt"); err != nil || string(bs) != "d" {
+		t.Errorf("read after crash: %#v %v", string(bs), err)
+	}
+
+	// compressed archives are rewritten with the complete entries
+	var sizes []int64
+	for _, entry := range []string{"a.txt", "b.txt", "c.txt"} {
+		WriteTarFS(mfs, "data.tar.gz", entry, []byte(strings.Repeat(entry[:1], 700)))
+		fi, _ := mfs.Stat("data.tar.gz")
+		sizes = append(sizes, fi.Size())
+	}
+	f, _ = mfs.OpenFile("data.tar.gz", os.O_RDWR, 0644)
+	f.Truncate(sizes[1] + 20)
+	f.Close()
+	// the header of c.txt can't be decompressed either, so its name is unknown
+	report, err = RepairTarFS(mfs, "data.tar.gz")
+	if err != nil || report.Entries != 2 || report.Lost != nil || !report.Repaired {
+		t.Errorf("compressed repair: %#v %v", report, err)
+	}
+	if list, err := ListTarFS(mfs, "data.tar.gz"); err != nil || !reflect.DeepEqual(list, []string{"a.txt", "b.txt"}) {
+		t.Errorf("compressed list after repair: %#v %v", list, err)
+	}
+	// a complete compressed stream of a cut tar: the dropped bytes are counted in the tar stream
+	for _, entry := range []string{"a.txt", "b.txt", "c.txt"} {
+		WriteTarFS(mfs, "plain.tar", entry, []byte(strings.Repeat(entry[:1], 700)))
+	}
+	entries, _ = ReadTarIndexFS(mfs, "plain.tar")
+	raw, _ := afero.ReadFile(mfs, "plain.tar")
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	zw.Write(raw[:entries[2].Offset+100])
+	zw.Close()
+	afero.WriteFile(mfs, "cut.tar.gz", zbuf.Bytes(), 0644)
+	report, err = RepairTarFS(mfs, "cut.tar.gz")
+	expected = &TarRepairReport{Entries: 2, Lost: []string{"c.txt"}, Truncated: entries[2].Offset + 100 - entries[1].End, Repaired: true}
+	if err != nil || !reflect.DeepEqual(report, expected) {
+		t.Errorf("compressed repair of a cut tar: %#v %v", report, err)
+	}
+	if bs, err := ReadTarFS(mfs, "cut.tar.gz", "b.txt"); err != nil || len(bs) != 700 {
+		t.Errorf("read after compressed repair: %d %v", len(bs), err)
+	}
+}
+
+func TestTarEntries(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	mtime := time.Date(2019, 2, 1, 10, 30, 0, 0, time.UTC)
+	for _, name := range []string{"meta.tar", "meta.tar.gz"} {
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "docs/", Type: tar.TypeDir, ModTime: mtime}, nil)
+		err := WriteTarEntryFS(mfs, name, TarEntry{
+			Name:       "docs/order.json",
+			Mode:       0600,
+			ModTime:    mtime,
+			Uid:        1000,
+			Uname:      "shop",
+			PAXRecords: map[string]string{"SCHILY.xattr.user.origin": "erp"},
+			Metadata:   map[string]string{"order": "1001", "customer": "ACME"},
+		}, []byte(`{"id":1001}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "latest.json", Type: tar.TypeSymlink, Linkname: "docs/order.json", ModTime: mtime}, nil)
+
+		entries, err := ListTarEntriesFS(mfs, name)
+		if err != nil || len(entries) != 3 {
+			t.Fatalf("%s entries: %#v %v", name, entries, err)
+		}
+		expected := TarEntry{
+			Name: "docs/order.json", Type: tar.TypeReg, Size: 11, Mode: 0600, ModTime: mtime, Uid: 1000, Uname: "shop",
+			PAXRecords: map[string]string{"SCHILY.xattr.user.origin": "erp"},
+			Metadata:   map[string]string{"order": "1001", "customer": "ACME"},
+			SHA256:     "58a9556eda3dff6837b570a77b05d9334042d9fbf5f67c4a96bdc920560aa886",
+		}
+		entries[1].ModTime = entries[1].ModTime.UTC()
+		if !reflect.DeepEqual(entries[1], expected) {
+			t.Errorf("%s entry:\n%#v !=\n%#v", name, entries[1], expected)
+		}
+		if entries[0].Type != tar.TypeDir || entries[0].Mode != 0755 || entries[2].Type != tar.TypeSymlink || entries[2].Linkname != "docs/order.json" {
+			t.Errorf("%s dir and link: %#v %#v", name, entries[0], entries[2])
+		}
+		if bs, err := ReadTarFS(mfs, name, "docs/order.json"); err != nil || string(bs) != `{"id":1001}` {
+			t.Errorf("%s read: %#v %v", name, string(bs), err)
+		}
+	}
+	if idx, err := ReadTarIndexFS(mfs, "meta.tar"); err != nil || idx[0].Type != string(tar.TypeDir) || !idx[0].FileInfo().IsDir() {
+		t.Errorf("index types: %#v %v", idx, err)
+	}
+
+	dir, err := ioutil.TempDir("", "filehelper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "src", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "src", "sub", "file.txt"), []byte("file"), 0640)
+	os.Symlink(filepath.Join("sub", "file.txt"), filepath.Join(dir, "src", "link"))
+	osfs := afero.NewOsFs()
+	if err := AddTarDirFS(osfs, filepath.Join(dir, "out.tar"), filepath.Join(dir, "src"), "backup"); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ListTarEntriesFS(osfs, filepath.Join(dir, "out.tar"))
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("dir entries: %#v %v", entries, err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, fmt.Sprintf("%s %c %s %o", e.Name, e.Type, e.Linkname, e.Mode&0777))
+	}
+	expected := []string{"backup/link 2 sub/file.txt 777", "backup/sub/ 5  755", "backup/sub/file.txt 0  640"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("dir entries: %#v != %#v", names, expected)
+	}
+	if bs, err := ReadTarFS(osfs, filepath.Join(dir, "out.tar"), "backup/sub/file.txt"); err != nil || string(bs) != "file" {
+		t.Errorf("dir read: %#v %v", string(bs), err)
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	mtime := time.Date(2019, 2, 1, 10, 30, 0, 0, time.UTC)
+	for _, name := range []string{"x.tar", "x.tar.gz"} {
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "docs/", Type: tar.TypeDir, Mode: 0700, ModTime: mtime}, nil)
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "docs/a.json", Mode: 0600, ModTime: mtime}, []byte(`{"a":1}`))
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "docs/b.xml", ModTime: mtime}, []byte(`<b/>`))
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "readme.txt", ModTime: mtime}, []byte(`hello`))
+
+		names, err := ExtractTarFS(mfs, name, mfs, "out/"+name, ExtractOptions{})
+		if err != nil || len(names) != 4 {
+			t.Fatalf("%s extract: %#v %v", name, names, err)
+		}
+		fi, err := mfs.Stat("out/" + name + "/docs/a.json")
+		if err != nil || fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s file info: %#v %v", name, fi, err)
+		}
+		if fi, err := mfs.Stat("out/" + name + "/docs"); err != nil || fi.Mode().Perm() != 0700 || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s dir info: %#v %v", name, fi, err)
+		}
+		if bs, _ := afero.ReadFile(mfs, "out/"+name+"/readme.txt"); string(bs) != "hello" {
+			t.Errorf("%s content: %s", name, bs)
+		}
+
+		names, err = ExtractTarFS(mfs, name, mfs, "glob", ExtractOptions{Patterns: []string{"*.json", "readme.*"}})
+		if err != nil || !reflect.DeepEqual(names, []string{"readme.txt"}) {
+			t.Errorf("%s glob: %#v %v", name, names, err)
+		}
+		names, err = ExtractTarFS(mfs, name, mfs, "glob", ExtractOptions{Patterns: []string{"docs"}})
+		if err != nil || len(names) != 3 {
+			t.Errorf("%s glob dir: %#v %v", name, names, err)
+		}
+
+		if _, err := ExtractTarFS(mfs, name, mfs, "limit", ExtractOptions{MaxEntries: 2}); !errors.Is(err, ErrExtractLimit) {
+			t.Errorf("%s max entries: %v", name, err)
+		}
+		if _, err := ExtractTarFS(mfs, name, mfs, "limit", ExtractOptions{MaxFileSize: 6}); !errors.Is(err, ErrExtractLimit) {
+			t.Errorf("%s max file size: %v", name, err)
+		}
+		if _, err := ExtractTarFS(mfs, name, mfs, "limit", ExtractOptions{MaxTotalSize: 15}); !errors.Is(err, ErrExtractLimit) {
+			t.Errorf("%s max total size: %v", name, err)
+		}
+	}
+
+	for _, e := range []TarEntry{
+		{Name: "../evil.txt"},
+		{Name: "docs/../../evil.txt"},
+		{Name: "/etc/evil.txt"},
+		{Name: "link", Type: tar.TypeSymlink, Linkname: "../outside"},
+		{Name: "link", Type: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		{Name: "hard", Type: tar.TypeLink, Linkname: "../outside"},
+	} {
+		mfs.Remove("evil.tar")
+		WriteTarEntryFS(mfs, "evil.tar", e, []byte("x"))
+		if _, err := ExtractTarFS(mfs, "evil.tar", mfs, "evil", ExtractOptions{}); !errors.Is(err, ErrUnsafeEntry) {
+			t.Errorf("unsafe %s -> %s: %v", e.Name, e.Linkname, err)
+		}
+	}
+	if ok, _ := afero.Exists(mfs, "evil.txt"); ok {
+		t.Errorf("evil.txt written outside")
+	}
+
+	dir, err := ioutil.TempDir("", "filehelper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	osfs := afero.NewOsFs()
+	archive := filepath.Join(dir, "links.tar")
+	WriteTarEntryFS(osfs, archive, TarEntry{Name: "sub/file.txt"}, []byte("file"))
+	WriteTarEntryFS(osfs, archive, TarEntry{Name: "link", Type: tar.TypeSymlink, Linkname: "sub/file.txt"}, nil)
+	WriteTarEntryFS(osfs, archive, TarEntry{Name: "copy", Type: tar.TypeLink, Linkname: "sub/file.txt"}, nil)
+	names, err := ExtractTarFS(osfs, archive, osfs, filepath.Join(dir, "out"), ExtractOptions{})
+	if err != nil || len(names) != 3 {
+		t.Fatalf("links extract: %#v %v", names, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "out", "link")); err != nil || target != "sub/file.txt" {
+		t.Errorf("symlink: %s %v", target, err)
+	}
+	if bs, err := ioutil.ReadFile(filepath.Join(dir, "out", "copy")); err != nil || string(bs) != "file" {
+		t.Errorf("hard link: %s %v", bs, err)
+	}
+
+	// an existing symlink to outside isn't written through
+	os.Mkdir(filepath.Join(dir, "outside"), 0755)
+	os.Symlink(filepath.Join(dir, "outside"), filepath.Join(dir, "out", "escape"))
+	escape := filepath.Join(dir, "escape.tar")
+	WriteTarEntryFS(osfs, escape, TarEntry{Name: "escape/pwned.txt"}, []byte("x"))
+	if _, err := ExtractTarFS(osfs, escape, osfs, filepath.Join(dir, "out"), ExtractOptions{}); !errors.Is(err, ErrUnsafeEntry) {
+		t.Errorf("write through symlink: %v", err)
+	}
+	if ok, _ := afero.Exists(osfs, filepath.Join(dir, "outside", "pwned.txt")); ok {
+		t.Errorf("pwned.txt written through symlink")
+	}
+
+	// symlink chains and hard links to symlinks can't reach files outside
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600)
+	for i, entries := range [][]TarEntry{
+		{
+			{Name: "d/", Type: tar.TypeDir},
+			{Name: "d/e", Type: tar.TypeSymlink, Linkname: ".."},
+			{Name: "f", Type: tar.TypeSymlink, Linkname: "d/e/../../secret"},
+			{Name: "leak", Type: tar.TypeLink, Linkname: "f"},
+		},
+		{
+			{Name: "g", Type: tar.TypeSymlink, Linkname: "sub/file.txt"},
+			{Name: "leak", Type: tar.TypeLink, Linkname: "g"},
+		},
+	} {
+		chain := filepath.Join(dir, fmt.Sprintf("chain%d.tar", i))
+		for _, e := range entries {
+			WriteTarEntryFS(osfs, chain, e, nil)
+		}
+		out := filepath.Join(dir, fmt.Sprintf("chain%d", i))
+		if _, err := ExtractTarFS(osfs, chain, osfs, out, ExtractOptions{}); !errors.Is(err, ErrUnsafeEntry) {
+			t.Errorf("chain %d: %v", i, err)
+		}
+		if ok, _ := afero.Exists(osfs, filepath.Join(out, "leak")); ok {
+			t.Errorf("chain %d leaked", i)
+		}
+	}
+
+	// hard links count against the limits with the size of their source
+	WriteTarFS(mfs, "links.tar", "big.bin", bytes.Repeat([]byte("x"), 1000))
+	for i := 0; i < 30; i++ {
+		WriteTarEntryFS(mfs, "links.tar", TarEntry{Name: fmt.Sprintf("copy%d", i), Type: tar.TypeLink, Linkname: "big.bin"}, nil)
+	}
+	if _, err := ExtractTarFS(mfs, "links.tar", mfs, "links", ExtractOptions{MaxTotalSize: 2000}); !errors.Is(err, ErrExtractLimit) {
+		t.Errorf("hard links total size: %v", err)
+	}
+	if _, err := ExtractTarFS(mfs, "links.tar", mfs, "links", ExtractOptions{Patterns: []string{"copy1"}, MaxFileSize: 999}); !errors.Is(err, ErrExtractLimit) {
+		t.Errorf("hard link file size: %v", err)
+	}
+}
+
+func TestTarVersions(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	day := time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"v.tar", "v.tar.gz", "noindex.tar"} {
+		for i, content := range []string{"v0", "v1", "v2"} {
+			WriteTarEntryFS(mfs, name, TarEntry{Name: "export.json", ModTime: day.AddDate(0, 0, i)}, []byte(content))
+			WriteTarEntryFS(mfs, name, TarEntry{Name: "other.json", ModTime: day.AddDate(0, 0, i)}, []byte("other"))
+		}
+		mfs.Remove("noindex.tar" + TarIndexSuffix)
+
+		if bs, err := ReadTarFS(mfs, name, "export.json"); err != nil || string(bs) != "v2" {
+			t.Errorf("%s latest: %s %v", name, bs, err)
+		}
+		for version, expected := range map[int]string{0: "v0", 1: "v1", 2: "v2", -1: "v2", -3: "v0"} {
+			if bs, err := ReadTarVersionFS(mfs, name, "export.json", version); err != nil || string(bs) != expected {
+				t.Errorf("%s version %d: %s %v", name, version, bs, err)
+			}
+		}
+		for _, version := range []int{3, -4} {
+			if _, err := ReadTarVersionFS(mfs, name, "export.json", version); !errors.Is(err, ErrNotInArchive) {
+				t.Errorf("%s version %d: %v", name, version, err)
+			}
+		}
+		if bs, err := ReadTarAtFS(mfs, name, "export.json", day.Add(36*time.Hour)); err != nil || string(bs) != "v1" {
+			t.Errorf("%s at: %s %v", name, bs, err)
+		}
+		if _, err := ReadTarAtFS(mfs, name, "export.json", day.Add(-time.Hour)); !errors.Is(err, ErrNotInArchive) {
+			t.Errorf("%s before first: %v", name, err)
+		}
+		history, err := TarHistoryFS(mfs, name, "export.json")
+		if err != nil || len(history) != 3 {
+			t.Fatalf("%s history: %#v %v", name, history, err)
+		}
+		for i, v := range history {
+			if v.Version != i || !v.ModTime.Equal(day.AddDate(0, 0, i)) || v.Size != 2 {
+				t.Errorf("%s history %d: %#v", name, i, v)
+			}
+		}
+		if _, err := TarHistoryFS(mfs, name, "missing.json"); !errors.Is(err, ErrNotInArchive) {
+			t.Errorf("%s missing history: %v", name, err)
+		}
+
+		a, err := OpenArchiveFS(mfs, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bs, err := a.Read("export.json"); err != nil || string(bs) != "v2" {
+			t.Errorf("%s archive latest: %s %v", name, bs, err)
+		}
+		if names, err := afero.ReadDir(NewArchiveFs(a), "/"); err != nil || len(names) != 2 || names[0].ModTime().Day() != 3 {
+			t.Errorf("%s archive fs latest: %#v %v", name, names, err)
+		}
+		a.Close()
+
+		// hard links read the version of their target written before them, as tar extracts them
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "pinned.json", Type: tar.TypeLink, Linkname: "export.json"}, nil)
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "export.json", ModTime: day.AddDate(0, 0, 3)}, []byte("v3"))
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "pinned2.json", Type: tar.TypeLink, Linkname: "pinned.json"}, nil)
+		mfs.Remove("noindex.tar" + TarIndexSuffix)
+		a, _ = OpenArchiveFS(mfs, name)
+		for _, link := range []string{"pinned.json", "pinned2.json"} {
+			if bs, err := ReadTarFS(mfs, name, link); err != nil || string(bs) != "v2" {
+				t.Errorf("%s read %s: %s %v", name, link, bs, err)
+			}
+			if bs, err := ReadTarVersionFS(mfs, name, link, 0); err != nil || string(bs) != "v2" {
+				t.Errorf("%s read version of %s: %s %v", name, link, bs, err)
+			}
+			if bs, err := a.Read(link); err != nil || string(bs) != "v2" {
+				t.Errorf("%s archive read %s: %s %v", name, link, bs, err)
+			}
+		}
+		a.Close()
+	}
+}
+
+func TestCompactTar(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	now := time.Now().Truncate(time.Second)
+	for _, name := range []string{"c.tar", "c.tar.gz", "c.tar.zst"} {
+		for i := 0; i < 3; i++ {
+			WriteTarEntryFS(mfs, name, TarEntry{Name: "export.json", ModTime: now.AddDate(0, 0, i-10)}, []byte(fmt.Sprintf("v%d", i)))
+			WriteTarEntryFS(mfs, name, TarEntry{Name: "logs/day.log", ModTime: now.AddDate(0, 0, i-2)}, []byte(fmt.Sprintf("log%d", i)))
+		}
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "readme.txt", ModTime: now}, []byte("readme"))
+		WriteTarManifestFS(mfs, name)
+
+		report, err := CompactTarFS(mfs, name, CompactOptions{KeepVersions: 2})
+		if err != nil || report.Kept != 5 || !reflect.DeepEqual(report.Removed, []string{"export.json", "logs/day.log"}) || report.Reclaimed <= 0 {
+			t.Errorf("%s keep versions: %#v %v", name, report, err)
+		}
+		// the manifest is written again for the compacted archive
+		if report, err := VerifyTarFS(mfs, name); err != nil || !report.OK() || !report.Manifest || report.Verified != 5 {
+			t.Errorf("%s verify after compaction: %#v %v", name, report, err)
+		}
+		if bs, err := ReadTarVersionFS(mfs, name, "export.json", 0); err != nil || string(bs) != "v1" {
+			t.Errorf("%s oldest kept: %s %v", name, bs, err)
+		}
+		report, err = CompactTarFS(mfs, name, CompactOptions{MaxAge: 5 * 24 * time.Hour})
+		if err != nil || report.Kept != 3 || len(report.Removed) != 2 {
+			t.Errorf("%s max age: %#v %v", name, report, err)
+		}
+		if _, err := ReadTarFS(mfs, name, "export.json"); !errors.Is(err, ErrNotInArchive) {
+			t.Errorf("%s expired: %v", name, err)
+		}
+		report, err = CompactTarFS(mfs, name, CompactOptions{KeepVersions: 2})
+		if err != nil || report.Kept != 3 || report.Removed != nil {
+			t.Errorf("%s nothing to compact: %#v %v", name, report, err)
+		}
+
+		report, err = DeleteFromTarFS(mfs, name, "logs/*")
+		if err != nil || report.Kept != 1 || len(report.Removed) != 2 {
+			t.Errorf("%s delete: %#v %v", name, report, err)
+		}
+		if names, err := ListTarFS(mfs, name); err != nil || !reflect.DeepEqual(names, []string{"readme.txt"}) {
+			t.Errorf("%s after delete: %#v %v", name, names, err)
+		}
+		// appending after a rewrite
+		if err := WriteTarFS(mfs, name, "new.txt", []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		if bs, err := ReadTarFS(mfs, name, "new.txt"); err != nil || string(bs) != "new" {
+			t.Errorf("%s append after rewrite: %s %v", name, bs, err)
+		}
+	}
+	if _, err := ReadTarIndexFS(mfs, "c.tar"); err != nil {
+		t.Errorf("index after rewrite: %v", err)
+	}
+	if _, err := DeleteFromTarFS(mfs, "c.tar", "[bad"); err == nil {
+		t.Errorf("bad pattern accepted")
+	}
+	// the archives, their manifests and the index of c.tar
+	if infos, _ := afero.ReadDir(mfs, "."); len(infos) != 7 {
+		t.Errorf("temporary files left: %d files", len(infos))
+	}
+	// the rewritten archive keeps the mode of the original
+	mfs.Chmod("c.tar", 0600)
+	if _, err := DeleteFromTarFS(mfs, "c.tar", "new.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := mfs.Stat("c.tar"); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("mode after rewrite: %v %v", fi.Mode(), err)
+	}
+}
+
+func TestRotateTar(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	if rotated, err := RotateTarFS(mfs, "r.tar.gz", RotateOptions{MaxSize: 1}); err != nil || rotated != "" {
+		t.Errorf("missing archive: %s %v", rotated, err)
+	}
+	first := time.Date(2019, 2, 1, 10, 30, 0, 0, time.UTC)
+	WriteTarEntryFS(mfs, "r.tar.gz", TarEntry{Name: "a.txt", ModTime: first}, []byte("a"))
+	if rotated, err := RotateTarFS(mfs, "r.tar.gz", RotateOptions{MaxSize: 1 << 20}); err != nil || rotated != "" {
+		t.Errorf("small archive: %s %v", rotated, err)
+	}
+	rotated, err := RotateTarFS(mfs, "r.tar.gz", RotateOptions{Period: 24 * time.Hour})
+	if err != nil || rotated != "r-20190201-103000.tar.gz" {
+		t.Fatalf("daily: %s %v", rotated, err)
+	}
+	if bs, err := ReadTarFS(mfs, rotated, "a.txt"); err != nil || string(bs) != "a" {
+		t.Errorf("rotated read: %s %v", bs, err)
+	}
+
+	WriteTarEntryFS(mfs, "r.tar", TarEntry{Name: "a.txt", ModTime: first}, []byte("a"))
+	WriteTarEntryFS(mfs, "r-20190201-103000.tar", TarEntry{Name: "old.txt", ModTime: first}, []byte("old"))
+	rotated, err = RotateTarFS(mfs, "r.tar", RotateOptions{MaxSize: 1024})
+	if err != nil || rotated != "r-20190201-103000-1.tar" {
+		t.Fatalf("by size: %s %v", rotated, err)
+	}
+	if _, err := ReadTarIndexFS(mfs, rotated); err != nil {
+		t.Errorf("rotated index: %v", err)
+	}
+	WriteTarFS(mfs, "r.tar", "b.txt", []byte("b"))
+	if names, err := ListTarFS(mfs, "r.tar"); err != nil || !reflect.DeepEqual(names, []string{"b.txt"}) {
+		t.Errorf("new archive: %#v %v", names, err)
+	}
+}
+
+func TestSearchTar(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	for _, name := range []string{"s.tar", "s.tar.xz"} {
+		WriteTarFS(mfs, name, "orders/1.csv", []byte("sku,qty\nABC-1,2\nXYZ,1\nabc-2,5\n"))
+		WriteTarFS(mfs, name, "notes.txt", []byte("ABC-9 in notes"))
+		WriteTarFS(mfs, name, "big.log", []byte(strings.Repeat("filler line\n", 10000)+"ABC-7 at the end\r\n"))
+
+		matches, err := SearchTarFS(mfs, name, SearchOptions{Pattern: `^abc-\d`, IgnoreCase: true, Context: 1, Names: []string{"orders/*", "*.log"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []SearchMatch{
+			{Name: "orders/1.csv", Line: 2, Text: "ABC-1,2", Before: []string{"sku,qty"}, After: []string{"XYZ,1"}},
+			{Name: "orders/1.csv", Line: 4, Text: "abc-2,5", Before: []string{"XYZ,1"}},
+			{Name: "big.log", Line: 10001, Text: "ABC-7 at the end", Before: []string{"filler line"}},
+		}
+		if !reflect.DeepEqual(matches, expected) {
+			t.Errorf("%s search:\n%#v !=\n%#v", name, matches, expected)
+		}
+		matches, err = SearchTarFS(mfs, name, SearchOptions{Pattern: "ABC-"})
+		if err != nil || len(matches) != 3 || matches[1].Name != "notes.txt" || matches[0].Before != nil {
+			t.Errorf("%s case sensitive: %#v %v", name, matches, err)
+		}
+		if matches, err := SearchTarFS(mfs, name, SearchOptions{Pattern: "1.csv", Literal: true}); err != nil || matches != nil {
+			t.Errorf("%s literal: %#v %v", name, matches, err)
+		}
+
+		// replaced versions are not searched, as ReadTar doesn't return them
+		WriteTarFS(mfs, name, "notes.txt", []byte("rewritten"))
+		if found, err := FindInTarFS(mfs, name, "ABC-9"); err != nil || len(found) != 0 {
+			t.Errorf("%s find replaced: %#v %v", name, found, err)
+		}
+		if matches, err := SearchTarFS(mfs, name, SearchOptions{Pattern: "ABC-"}); err != nil || len(matches) != 2 || matches[1].Name != "big.log" {
+			t.Errorf("%s search replaced: %#v %v", name, matches, err)
+		}
+		WriteTarFS(mfs, name, "orders/1.csv", []byte("sku,qty\nABC-1,3\n"))
+		if matches, err := SearchTarFS(mfs, name, SearchOptions{Pattern: "ABC-"}); err != nil || len(matches) != 2 ||
+			matches[0].Name != "big.log" || matches[1].Text != "ABC-1,3" {
+			t.Errorf("%s search latest order: %#v %v", name, matches, err)
+		}
+		if found, err := FindInTarFS(mfs, name, "ABC-1"); err != nil || found["orders/1.csv"] != "ty\nABC-1,3\n" {
+			t.Errorf("%s find latest: %#v %v", name, found, err)
+		}
+	}
+	if _, err := SearchTarFS(mfs, "s.tar", SearchOptions{Pattern: "("}); err == nil {
+		t.Errorf("bad pattern accepted")
+	}
+
+	// streaming FindInTar finds the same snippets as searching the whole content
+	content := strings.Repeat("x", 32*1024-2) + "needle" + "abcdef"
+	for _, search := range []string{"needle", "xne", "def", "ab", "x", "missing", ""} {
+		for _, bs := range []string{content, "ne" + content, "needle"} {
+			expected, expectedOk := snippetReference([]byte(bs), search)
+			match, ok, err := findSnippetReader(&chunkReader{strings.NewReader(bs)}, search)
+			if err != nil || ok != expectedOk || match != expected {
+				t.Errorf("snippet %q in %d bytes: %q %v != %q %v", search, len(bs), match, ok, expected, expectedOk)
+			}
+		}
+	}
+
+	// a single line document larger than the line buffer is matched in parts and cut in the result
+	long := strings.Repeat(`{"id":1},`, 100000) + `{"id":"needle"}` + strings.Repeat(`{"id":2},`, 100000)
+	WriteTarFS(mfs, "long.tar", "export.json", []byte(long+"\nnext line\n"))
+	matches, err := SearchTarFS(mfs, "long.tar", SearchOptions{Pattern: "needle", Context: 1})
+	if err != nil || len(matches) != 1 || matches[0].Line != 1 || !reflect.DeepEqual(matches[0].After, []string{"next line"}) {
+		t.Fatalf("long line: %d matches %v", len(matches), err)
+	}
+	if text := matches[0].Text; len(text) != searchLineSize || !strings.Contains(text, `{"id":"needle"}`) {
+		t.Errorf("long line text: %d bytes", len(text))
+	}
+	if matches, _ := SearchTarFS(mfs, "long.tar", SearchOptions{Pattern: `"id":3`}); len(matches) != 0 {
+		t.Errorf("long line false match: %d", len(matches))
+	}
+}
+
+// snippetReference is the original in-memory FindInTar snippet
+func snippetReference(bs []byte, search string) (string, bool) {
+	if !bytes.Contains(bs, []byte(search)) {
+		return "", false
+	}
+	begining := bytes.Index(bs, []byte(search))
+	end := begining + len(search) + 3
+	if begining > 3 {
+		begining = begining - 3
+	}
+	if end > len(bs) {
+		end = len(bs)
+	}
+	return string(bs[begining:end]), true
+}
+
+// chunkReader returns at most 7 bytes per Read, to test matches across reads
+type chunkReader struct {
+	r io.Reader
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > 7 {
+		p = p[:7]
+	}
+	return c.r.Read(p)
+}
+
+func TestQueryTar(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	WriteTarFS(mfs, "q.tar.gz", "orders/1.json", []byte(`{"order":{"id":"1","lines":[{"sku":"ABC","qty":2},{"sku":"XYZ","qty":1}]}}`))
+	WriteTarFS(mfs, "q.tar.gz", "orders/2.json", []byte(`{"order":{"id":"2","note":"not ABC","lines":[{"sku":"XYZ","qty":3}]}}`))
+	WriteTarFS(mfs, "q.tar.gz", "orders/3.XML", []byte(`<order><id>3</id><lines><sku>ABC</sku><qty>5</qty></lines></order>`))
+	WriteTarFS(mfs, "q.tar.gz", "orders/broken.json", []byte(`{"order":`))
+	WriteTarFS(mfs, "q.tar.gz", "notes.txt", []byte(`order.lines ABC`))
+	WriteTarFS(mfs, "q.tar.gz", "stock.csv", []byte("sku,qty\nABC,10\nXYZ,0\n"))
+
+	p := NewParser()
+	p.RegisterFS(mfs)
+	res, err := p.QueryTar("q.tar.gz", "order.lines[sku=ABC]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res[0].Name != "orders/1.json" || res[1].Name != "orders/3.XML" {
+		t.Fatalf("query: %#v", res)
+	}
+	if len(res[0].Matches) != 1 || fmt.Sprint(res[0].Matches[0]) != "map[qty:2 sku:ABC]" {
+		t.Errorf("json match: %#v", res[0].Matches)
+	}
+	if len(res[1].Matches) != 1 || fmt.Sprint(res[1].Matches[0]) != "map[qty:5 sku:ABC]" {
+		t.Errorf("xml match: %#v", res[1].Matches)
+	}
+	res, err = p.QueryTar("q.tar.gz", "$[?(@.sku == 'ABC')].qty", "*.csv")
+	if err != nil || len(res) != 1 || res[0].Name != "stock.csv" || !reflect.DeepEqual(res[0].Matches, []interface{}{"10"}) {
+		t.Errorf("csv query: %#v %v", res, err)
+	}
+	if _, err := p.QueryTar("q.tar.gz", "order.lines[sku="); err == nil {
+		t.Errorf("bad expression accepted")
+	}
+}
+
+func TestScanTars(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	var archives, expected []string
+	for a := 0; a < 6; a++ {
+		name := fmt.Sprintf("day%d.tar", a)
+		if a%2 == 1 {
+			name += ".gz"
+		}
+		archives = append(archives, name)
+		for e := 0; e < 20; e++ {
+			content := fmt.Sprintf("entry %d", e)
+			if e%3 == 0 {
+				content += " ABC"
+				expected = append(expected, fmt.Sprintf("%s %d.txt", name, e))
+			}
+			WriteTarFS(mfs, name, fmt.Sprintf("%d.txt", e), []byte(content))
+		}
+		WriteTarFS(mfs, name, "skip.json", []byte("ABC"))
+	}
+	var calls int64
+	var mu sync.Mutex
+	res, err := ScanTarsFS(mfs, archives, ScanOptions{Workers: 4, Archives: 3, Names: []string{"*.txt"}}, func(archive, name string, data []byte) (interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		if !bytes.Contains(data, []byte("ABC")) {
+			return nil, nil
+		}
+		return len(data), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range res {
+		got = append(got, fmt.Sprintf("%s %s", r.Archive, r.Name))
+	}
+	if !reflect.DeepEqual(got, expected) || calls != 120 {
+		t.Errorf("scan results (%d calls):\n%#v !=\n%#v", calls, got, expected)
+	}
+	if res[0].Value != 11 {
+		t.Errorf("scan value: %#v", res[0])
+	}
+
+	failing := errors.New("failing")
+	_, err = ScanTarsFS(mfs, archives, ScanOptions{Workers: 2}, func(archive, name string, data []byte) (interface{}, error) {
+		if name == "7.txt" {
+			return nil, failing
+		}
+		return name, nil
+	})
+	if !errors.Is(err, failing) {
+		t.Errorf("scan error: %v", err)
+	}
+	if _, err := ScanTarsFS(mfs, append(archives, "missing.tar"), ScanOptions{}, func(archive, name string, data []byte) (interface{}, error) {
+		return nil, nil
+	}); !os.IsNotExist(errors.Unwrap(err)) && !os.IsNotExist(err) {
+		t.Errorf("missing archive: %v", err)
+	}
+}
+
+func TestVerifyTar(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	for _, e := range []TarEntry{
+		{Name: "forged.json", Metadata: map[string]string{"sha256": "0000"}},
+		{Name: "forged.json", PAXRecords: map[string]string{TarChecksumRecord: "0000"}},
+	} {
+		if err := WriteTarEntryFS(mfs, "forged.tar", e, []byte("{}")); err == nil {
+			t.Errorf("reserved record accepted: %#v", e)
+		}
+	}
+	for _, name := range []string{"v.tar", "v.tar.gz"} {
+		WriteTarFS(mfs, name, "a.json", []byte(`{"a":1}`))
+		WriteTarFS(mfs, name, "b.json", []byte(`{"b":2}`))
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "dir/", Type: tar.TypeDir}, nil)
+		WriteTarFS(mfs, name, "a.json", []byte(`{"a":3}`))
+
+		entries, _ := ListTarEntriesFS(mfs, name)
+		sum := sha256.Sum256([]byte(`{"a":1}`))
+		if entries[0].SHA256 != hex.EncodeToString(sum[:]) || entries[2].SHA256 != "" {
+			t.Errorf("%s recorded checksums: %#v", name, entries)
+		}
+		report, err := VerifyTarFS(mfs, name)
+		if err != nil || !report.OK() || report.Entries != 4 || report.Verified != 3 || report.Manifest {
+			t.Errorf("%s verify: %#v %v", name, report, err)
+		}
+
+		manifest, err := WriteTarManifestFS(mfs, name)
+		if err != nil || len(manifest.Entries) != 3 || manifest.Archive != name {
+			t.Fatalf("%s manifest: %#v %v", name, manifest, err)
+		}
+		if fi, _ := mfs.Stat(name); manifest.Size != fi.Size() {
+			t.Errorf("%s manifest size %d != %d", name, manifest.Size, fi.Size())
+		}
+		report, err = VerifyTarFS(mfs, name)
+		if err != nil || !report.OK() || report.Verified != 3 || !report.Manifest {
+			t.Errorf("%s verify with manifest: %#v %v", name, report, err)
+		}
+
+		WriteTarFS(mfs, name, "c.json", []byte(`{}`))
+		report, err = VerifyTarFS(mfs, name)
+		if err != nil || report.OK() || !report.ArchiveMismatch || !reflect.DeepEqual(report.Unexpected, []string{"c.json"}) {
+			t.Errorf("%s appended after manifest: %#v %v", name, report, err)
+		}
+		// rewrites write the manifest again, appends leave it to the caller
+		DeleteFromTarFS(mfs, name, "b.json")
+		report, err = VerifyTarFS(mfs, name)
+		if err != nil || !report.OK() || !report.Manifest || report.Verified != 3 {
+			t.Errorf("%s deleted after manifest: %#v %v", name, report, err)
+		}
+		if manifest, err := ReadTarManifestFS(mfs, name); err != nil || len(manifest.Entries) != 3 || manifest.Entries[1].Name != "a.json" {
+			t.Errorf("%s manifest after delete: %#v %v", name, manifest, err)
+		}
+		mfs.Remove(name + TarManifestSuffix)
+	}
+
+	// altered data in an uncompressed archive
+	bs, _ := afero.ReadFile(mfs, "v.tar")
+	i := bytes.Index(bs, []byte(`{"a":3}`))
+	bs[i+5] = '4'
+	afero.WriteFile(mfs, "v.tar", bs, 0644)
+	report, err := VerifyTarFS(mfs, "v.tar")
+	if err != nil || report.OK() || !reflect.DeepEqual(report.Mismatched, []string{"a.json"}) || report.Verified != 2 {
+		t.Errorf("altered: %#v %v", report, err)
+	}
+	// truncated data
+	afero.WriteFile(mfs, "v.tar", bs[:i+3], 0644)
+	report, err = VerifyTarFS(mfs, "v.tar")
+	if err != nil || report.OK() || !report.Truncated || !reflect.DeepEqual(report.Mismatched, []string{"a.json"}) {
+		t.Errorf("truncated: %#v %v", report, err)
+	}
+	// cut at an entry boundary, tar reads it as a complete archive
+	WriteTarFS(mfs, "cut.tar", "a.json", []byte(`{"a":1}`))
+	WriteTarFS(mfs, "cut.tar", "b.json", []byte(`{"b":2}`))
+	raw, _ := afero.ReadFile(mfs, "cut.tar")
+	end := bytes.Index(raw, []byte(`{"b":2}`)) + 512
+	afero.WriteFile(mfs, "cut1.tar", raw[:end+512], 0644)
+	afero.WriteFile(mfs, "cut.tar", raw[:end], 0644)
+	for _, name := range []string{"cut.tar", "cut1.tar"} {
+		report, err := VerifyTarFS(mfs, name)
+		if err != nil || report.OK() || !report.Truncated || report.Entries != 2 || report.Verified != 2 {
+			t.Errorf("%s cut at an entry boundary: %#v %v", name, report, err)
+		}
+	}
+	// entries without checksums
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "plain.txt", Mode: 0644, Size: 5, Typeflag: tar.TypeReg})
+	tw.Write([]byte("plain"))
+	tw.Close()
+	afero.WriteFile(mfs, "plain.tar", buf.Bytes(), 0644)
+	report, err = VerifyTarFS(mfs, "plain.tar")
+	if err != nil || !report.OK() || !reflect.DeepEqual(report.Unchecked, []string{"plain.txt"}) {
+		t.Errorf("unchecked: %#v %v", report, err)
+	}
+}
+
+func TestEncryptedTar(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	keys := map[string][]byte{"2019": bytes.Repeat([]byte{1}, 32), "2020": bytes.Repeat([]byte{2}, 16)}
+	if err := WriteTarEncryptedFS(mfs, "e.tar", "a.json", "2019", []byte("x")); !errors.Is(err, ErrNoKey) {
+		t.Errorf("write without provider: %v", err)
+	}
+	RegisterKeyProvider(KeyProviderFunc(func(id string) ([]byte, error) {
+		if key, ok := keys[id]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown key")
+	}))
+	defer RegisterKeyProvider(nil)
+
+	for _, key := range []string{"encryption", "key"} {
+		if err := WriteTarEntryFS(mfs, "forged.tar", TarEntry{Name: "plain.json", Metadata: map[string]string{key: "AES-GCM"}}, []byte("{}")); err == nil {
+			t.Errorf("reserved metadata key %s accepted", key)
+		}
+	}
+
+	secret := []byte(`{"name":"Jane Doe","email":"jane@example.com"}`)
+	for _, name := range []string{"e.tar", "e.tar.gz", "noindex.tar"} {
+		WriteTarFS(mfs, name, "plain.txt", []byte("public"))
+		if err := WriteTarEncryptedFS(mfs, name, "customers/1.json", "2019", secret); err != nil {
+			t.Fatal(err)
+		}
+		WriteTarEncryptedFS(mfs, name, "customers/2.json", "2020", []byte(`{"name":"John Roe"}`))
+		mfs.Remove("noindex.tar" + TarIndexSuffix)
+
+		raw, _ := afero.ReadFile(mfs, name)
+		if bytes.Contains(raw, []byte("Jane")) {
+			t.Errorf("%s stores plain text", name)
+		}
+		if names, err := ListTarFS(mfs, name); err != nil || len(names) != 3 || names[1] != "customers/1.json" {
+			t.Errorf("%s list: %#v %v", name, names, err)
+		}
+		if entries, _ := ListTarEntriesFS(mfs, name); !entries[1].Encrypt || entries[1].KeyID != "2019" || entries[1].Metadata != nil {
+			t.Errorf("%s entry: %#v", name, entries[1])
+		}
+		if bs, err := ReadTarFS(mfs, name, "customers/1.json"); err != nil || !bytes.Equal(bs, secret) {
+			t.Errorf("%s read: %s %v", name, bs, err)
+		}
+		if bs, err := ReadTarVersionFS(mfs, name, "customers/2.json", 0); err != nil || string(bs) != `{"name":"John Roe"}` {
+			t.Errorf("%s read version: %s %v", name, bs, err)
+		}
+		if res, err := FindInTarFS(mfs, name, "Jane"); err != nil || len(res) != 1 || res["customers/1.json"] == "" {
+			t.Errorf("%s find: %#v %v", name, res, err)
+		}
+		if matches, err := SearchTarFS(mfs, name, SearchOptions{Pattern: "Roe"}); err != nil || len(matches) != 1 {
+			t.Errorf("%s search: %#v %v", name, matches, err)
+		}
+		res, err := ScanTarsFS(mfs, []string{name}, ScanOptions{Names: []string{"customers/*"}}, func(archive, entry string, data []byte) (interface{}, error) {
+			return string(data[:9]), nil
+		})
+		if err != nil || len(res) != 2 || res[0].Value != `{"name":"` {
+			t.Errorf("%s scan: %#v %v", name, res, err)
+		}
+		a, _ := OpenArchiveFS(mfs, name)
+		if bs, err := a.Read("customers/1.json"); err != nil || !bytes.Equal(bs, secret) {
+			t.Errorf("%s archive read: %s %v", name, bs, err)
+		}
+		if res, err := a.Find("John"); err != nil || len(res) != 1 {
+			t.Errorf("%s archive find: %#v %v", name, res, err)
+		}
+		a.Close()
+		if report, err := VerifyTarFS(mfs, name); err != nil || !report.OK() || report.Verified != 3 {
+			t.Errorf("%s verify without decrypting: %#v %v", name, report, err)
+		}
+	}
+
+	keys["2019"] = bytes.Repeat([]byte{3}, 32)
+	if _, err := ReadTarFS(mfs, "e.tar", "customers/1.json"); err == nil {
+		t.Errorf("read with wrong key")
+	}
+	RegisterKeyProvider(nil)
+	if _, err := ReadTarFS(mfs, "e.tar.gz", "customers/2.json"); !errors.Is(err, ErrNoKey) {
+		t.Errorf("read without provider: %v", err)
+	}
+	if bs, err := ReadTarFS(mfs, "e.tar", "plain.txt"); err != nil || string(bs) != "public" {
+		t.Errorf("plain read without provider: %s %v", bs, err)
+	}
+}
+
+func TestTarDedup(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	payload := []byte(`{"sku":"ABC-1","name":"Blue shirt","stock":12}`)
+	for _, name := range []string{"d.tar", "d.tar.gz", "noindex.tar"} {
+		WriteTarDedupFS(mfs, name, "a.json", payload)
+		WriteTarDedupFS(mfs, name, "b.json", payload)
+		WriteTarDedupFS(mfs, name, "c.txt", []byte("other"))
+		if err := WriteTarDedupFS(mfs, name, "a.json", payload); err != nil {
+			t.Fatal(err)
+		}
+		mfs.Remove("noindex.tar" + TarIndexSuffix)
+
+		if raw, _ := afero.ReadFile(mfs, name); name != "d.tar.gz" && bytes.Count(raw, payload) != 1 {
+			t.Errorf("%s stores the payload %d times", name, bytes.Count(raw, payload))
+		}
+		if names, err := ListTarFS(mfs, name); err != nil || !reflect.DeepEqual(names, []string{"a.json", "b.json", "c.txt", "a.json"}) {
+			t.Errorf("%s list: %#v %v", name, names, err)
+		}
+		if bs, err := ReadTarFS(mfs, name, "b.json"); err != nil || !bytes.Equal(bs, payload) {
+			t.Errorf("%s read: %s %v", name, bs, err)
+		}
+		if bs, err := ReadTarVersionFS(mfs, name, "a.json", 0); err != nil || !bytes.Equal(bs, payload) {
+			t.Errorf("%s read version: %s %v", name, bs, err)
+		}
+		if history, err := TarHistoryFS(mfs, name, "a.json"); err != nil || len(history) != 2 ||
+			history[1].Size != int64(len(payload)) || history[1].SHA256 != history[0].SHA256 || history[0].SHA256 == "" {
+			t.Errorf("%s history: %#v %v", name, history, err)
+		}
+		if entries, err := ListTarEntriesFS(mfs, name); err != nil || len(entries) != 4 || entries[1].Name != "b.json" {
+			t.Errorf("%s list entries: %#v %v", name, entries, err)
+		}
+		if res, err := FindInTarFS(mfs, name, "Blue"); err != nil || len(res) != 2 || res["b.json"] == "" {
+			t.Errorf("%s find: %#v %v", name, res, err)
+		}
+		if matches, err := SearchTarFS(mfs, name, SearchOptions{Pattern: "shirt", Names: []string{"b.*"}}); err != nil || len(matches) != 1 || matches[0].Name != "b.json" {
+			t.Errorf("%s search: %#v %v", name, matches, err)
+		}
+		res, err := ScanTarsFS(mfs, []string{name}, ScanOptions{}, func(archive, entry string, data []byte) (interface{}, error) {
+			return len(data), nil
+		})
+		if err != nil || len(res) != 4 || res[1].Name != "b.json" || res[1].Value != len(payload) {
+			t.Errorf("%s scan: %#v %v", name, res, err)
+		}
+		a, _ := OpenArchiveFS(mfs, name)
+		if bs, err := a.Read("b.json"); err != nil || !bytes.Equal(bs, payload) {
+			t.Errorf("%s archive read: %s %v", name, bs, err)
+		}
+		if info, err := a.Stat("b.json"); err != nil || info.Size() != int64(len(payload)) {
+			t.Errorf("%s archive stat: %v", name, err)
+		}
+		if names, err := a.List(); err != nil || len(names) != 4 {
+			t.Errorf("%s archive list: %#v %v", name, names, err)
+		}
+		if res, err := a.Find("Blue"); err != nil || len(res) != 2 {
+			t.Errorf("%s archive find: %#v %v", name, res, err)
+		}
+		a.Close()
+		if report, err := VerifyTarFS(mfs, name); err != nil || !report.OK() {
+			t.Errorf("%s verify: %#v %v", name, report, err)
+		}
+
+		// a .blobs directory already in the target is left alone
+		afero.WriteFile(mfs, "out/"+name+"/.blobs/keep.txt", []byte("keep"), 0644)
+		names, err := ExtractTarFS(mfs, name, mfs, "out/"+name, ExtractOptions{Patterns: []string{"b.json"}})
+		if err != nil || !reflect.DeepEqual(names, []string{"b.json"}) {
+			t.Errorf("%s extract: %#v %v", name, names, err)
+		}
+		if bs, _ := afero.ReadFile(mfs, "out/"+name+"/b.json"); !bytes.Equal(bs, payload) {
+			t.Errorf("%s extracted: %s", name, bs)
+		}
+		if infos, _ := afero.ReadDir(mfs, "out/"+name); len(infos) != 2 {
+			t.Errorf("%s extracted the payloads: %d files", name, len(infos))
+		}
+		if infos, _ := afero.ReadDir(mfs, "out/"+name+"/.blobs"); len(infos) != 1 {
+			t.Errorf("%s .blobs changed: %d files", name, len(infos))
+		}
+		if _, err := ExtractTarFS(mfs, name, mfs, "limit/"+name, ExtractOptions{Patterns: []string{"c.txt"}, MaxTotalSize: 10}); err != nil {
+			t.Errorf("%s payloads of other entries staged: %v", name, err)
+		}
+
+		// the payload stays while a link to it is kept
+		if _, err := DeleteFromTarFS(mfs, name, "a.json"); err != nil {
+			t.Fatal(err)
+		}
+		if bs, err := ReadTarFS(mfs, name, "b.json"); err != nil || !bytes.Equal(bs, payload) {
+			t.Errorf("%s read after delete: %s %v", name, bs, err)
+		}
+		report, err := DeleteFromTarFS(mfs, name, "b.json")
+		if err != nil || report.Kept != 2 || len(report.Removed) != 2 {
+			t.Errorf("%s delete last link: %#v %v", name, report, err)
+		}
+		if raw, _ := afero.ReadFile(mfs, name); bytes.Contains(raw, payload) {
+			t.Errorf("%s keeps the unused payload", name)
+		}
+		if bs, err := ReadTarFS(mfs, name, "c.txt"); err != nil || string(bs) != "other" {
+			t.Errorf("%s read after compaction: %s %v", name, bs, err)
+		}
+	}
+
+	// stored payloads are looked up in an up to date index: one without them stores the payload again
+	WriteTarDedupFS(mfs, "idx.tar", "a.json", payload)
+	entries, _ := ReadTarIndexFS(mfs, "idx.tar")
+	var buf bytes.Buffer
+	for _, e := range entries {
+		if !isTarBlob(e.Name) {
+			json.NewEncoder(&buf).Encode(e)
+		}
+	}
+	afero.WriteFile(mfs, "idx.tar"+TarIndexSuffix, buf.Bytes(), 0644)
+	WriteTarDedupFS(mfs, "idx.tar", "b.json", payload)
+	if raw, _ := afero.ReadFile(mfs, "idx.tar"); bytes.Count(raw, payload) != 2 {
+		t.Errorf("payloads not looked up in the index: %d", bytes.Count(raw, payload))
+	}
+}
+
+func TestDiffTar(t *testing.T) {
+	mfs := afero.NewMemMapFs()
+	var config []string
+	for i := 1; i <= 12; i++ {
+		config = append(config, fmt.Sprintf("key%d=%d\n", i, i))
+	}
+	oldConfig := strings.Join(config, "")
+	config[1], config[10] = "key2=two\n", "key11=eleven\n"
+	newConfig := strings.Join(config, "") + "key13=13"
+
+	WriteTarFS(mfs, "old.tar", "config.ini", []byte(oldConfig))
+	WriteTarFS(mfs, "old.tar", "readme.txt", []byte("readme\n"))
+	WriteTarFS(mfs, "old.tar", "logo.png", []byte{0x89, 'P', 'N', 'G', 0, 1})
+	WriteTarFS(mfs, "old.tar", "legacy.txt", []byte("gone\n"))
+	WriteTarFS(mfs, "old.tar", "readme.txt", []byte("readme v2\n"))
+
+	WriteTarDedupFS(mfs, "new.tar.gz", "readme.txt", []byte("readme v2\n"))
+	WriteTarDedupFS(mfs, "new.tar.gz", "config.ini", []byte(newConfig))
+	WriteTarDedupFS(mfs, "new.tar.gz", "logo.png", []byte{0x89, 'P', 'N', 'G', 0, 2})
+	WriteTarDedupFS(mfs, "new.tar.gz", "added.txt", []byte("new\n"))
+
+	diff, err := DiffTarFS(mfs, "old.tar", "new.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Changed() || diff.Unchanged != 1 || !reflect.DeepEqual(diff.Added, []string{"added.txt"}) || !reflect.DeepEqual(diff.Removed, []string{"legacy.txt"}) || len(diff.Modified) != 2 {
+		t.Fatalf("diff: %#v", diff)
+	}
+	config0 := diff.Modified[0]
+	if config0.Name != "config.ini" || config0.Binary || config0.OldSize != int64(len(oldConfig)) || config0.NewSize != int64(len(newConfig)) || config0.OldSHA256 == config0.NewSHA256 {
+		t.Errorf("modified: %#v", config0)
+	}
+	expected := "--- a/config.ini\n+++ b/config.ini\n" +
+		"@@ -1,5 +1,5 @@\n key1=1\n-key2=2\n+key2=two\n key3=3\n key4=4\n key5=5\n" +
+		"@@ -8,5 +8,6 @@\n key8=8\n key9=9\n key10=10\n-key11=11\n+key11=eleven\n key12=12\n+key13=13\n\\ No newline at end of file\n"
+	if config0.Diff != expected {
+		t.Errorf("unified diff:\n%s", config0.Diff)
+	}
+	if logo := diff.Modified[1]; logo.Name != "logo.png" || !logo.Binary || logo.Diff != "" {
+		t.Errorf("binary: %#v", logo)
+	}
+	if diff, err := DiffTarFS(mfs, "new.tar.gz", "new.tar.gz"); err != nil || diff.Changed() || diff.Unchanged != 4 {
+		t.Errorf("same archive: %#v %v", diff, err)
+	}
+	if _, err := DiffTarFS(mfs, "old.tar", "missing.tar"); err == nil {
+		t.Errorf("diff with missing archive")
+	}
+
+	// a hard link compares and diffs with its target as it was when linked
+	for _, name := range []string{"linked.tar", "linked.tar.gz"} {
+		WriteTarFS(mfs, name, "target.txt", []byte("one\n"))
+		WriteTarEntryFS(mfs, name, TarEntry{Name: "link.txt", Type: tar.TypeLink, Linkname: "target.txt"}, nil)
+		WriteTarFS(mfs, name, "target.txt", []byte("two\n"))
+		WriteTarFS(mfs, name+".new", "link.txt", []byte("one\nmore\n"))
+		diff, err := DiffTarFS(mfs, name, name+".new")
+		if err != nil || len(diff.Modified) != 1 || diff.Modified[0].OldSize != 4 {
+			t.Fatalf("%s link: %#v %v", name, diff, err)
+		}
+		if expected := "--- a/link.txt\n+++ b/link.txt\n@@ -1 +1,2 @@\n one\n+more\n"; diff.Modified[0].Diff != expected {
+			t.Errorf("%s link diff:\n%s", name, diff.Modified[0].Diff)
+		}
+	}
+}
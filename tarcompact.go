@@ -0,0 +1,360 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// TarRewriteReport describes what CompactTar or DeleteFromTar removed from an archive
+type TarRewriteReport struct {
+	// Kept is the number of entries left in the archive
+	Kept int
+	// Removed are the names of the removed entries, once per removed version
+	Removed []string
+	// Reclaimed is the number of bytes the archive shrank
+	Reclaimed int64
+}
+
+// CompactOptions selects the entries CompactTar keeps, an entry has to pass both limits that are set
+type CompactOptions struct {
+	// KeepVersions is the number of latest versions kept per name, all if zero
+	KeepVersions int
+	// MaxAge drops entries with a modification time older than this, none if zero
+	MaxAge time.Duration
+}
+
+// CompactTar rewrites tarfile dropping superseded or old entries, see CompactTarFS
+func CompactTar(tarfile string, opts CompactOptions) (*TarRewriteReport, error) {
+	return CompactTarFS(fs, tarfile, opts)
+}
+
+// CompactTarFS rewrites tarfile on given (afero) filesystem keeping the latest KeepVersions versions per name
+// that are not older than MaxAge. The archive is replaced atomically (temporary file and rename), its index
+// and manifest (if there is one) are written again
+func CompactTarFS(filesystem afero.Fs, tarfile string, opts CompactOptions) (*TarRewriteReport, error) {
+	cutoff := time.Now().Add(-opts.MaxAge)
+	return rewriteTarFS(filesystem, tarfile, func(hdrs []*tar.Header) []bool {
+		keep := make([]bool, len(hdrs))
+		newer := map[string]int{}
+		for i := len(hdrs) - 1; i >= 0; i-- {
+			name := hdrs[i].Name
+			keep[i] = opts.KeepVersions <= 0 || newer[name] < opts.KeepVersions
+			if opts.MaxAge > 0 && hdrs[i].ModTime.Before(cutoff) {
+				keep[i] = false
+			}
+			newer[name]++
+		}
+		return keep
+	})
+}
+
+// DeleteFromTar rewrites tarfile without the entries matching any of patterns, see DeleteFromTarFS
+func DeleteFromTar(tarfile string, patterns ...string) (*TarRewriteReport, error) {
+	return DeleteFromTarFS(fs, tarfile, patterns...)
+}
+
+// DeleteFromTarFS rewrites tarfile on given (afero) filesystem without all versions of the entries
+// matching any of patterns (names or path.Match globs). The archive is replaced atomically, as in CompactTarFS
+func DeleteFromTarFS(filesystem afero.Fs, tarfile string, patterns ...string) (*TarRewriteReport, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+	}
+	return rewriteTarFS(filesystem, tarfile, func(hdrs []*tar.Header) []bool {
+		keep := make([]bool, len(hdrs))
+		for i, hdr := range hdrs {
+			keep[i] = true
+			for _, pattern := range patterns {
+				if ok, _ := path.Match(pattern, hdr.Name); ok {
+					keep[i] = false
+					break
+				}
+			}
+		}
+		return keep
+	})
+}
+
+// rewriteTarFS replaces tarfile with a copy of the entries selected by keep, holding the archive locks.
+// Nothing is written if all entries are kept
+func rewriteTarFS(filesystem afero.Fs, tarfile string, keep func(hdrs []*tar.Header) []bool) (*TarRewriteReport, error) {
+	filesystem = orDefaultFS(filesystem)
+	defer lockPath(filesystem, tarfile)()
+	f, funlock, err := openLocked(filesystem, tarfile, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	// the file lock is held until the copy replaced the archive, writers waiting for it then reopen
+	// the new file (see openLocked) instead of appending to the replaced one
+	release := func() {
+		funlock()
+		f.Close()
+	}
+	report, tmpfile, c, err := copyTarEntries(filesystem, tarfile, f, keep)
+	if err != nil || tmpfile == "" {
+		release()
+		return report, err
+	}
+	// without an index readers scan the archive, so a crash between the renames is harmless. The manifest
+	// would report the dropped entries, it is written again for the new archive
+	forgetTarIndex(filesystem, tarfile)
+	manifest, _ := afero.Exists(filesystem, tarfile+TarManifestSuffix)
+	for _, suffix := range []string{TarIndexSuffix, TarManifestSuffix} {
+		if err := filesystem.Remove(tarfile + suffix); err != nil && !os.IsNotExist(err) {
+			filesystem.Remove(tmpfile)
+			release()
+			return nil, err
+		}
+	}
+	err = filesystem.Rename(tmpfile, tarfile)
+	release()
+	if err != nil {
+		filesystem.Remove(tmpfile)
+		return nil, err
+	}
+	if c == CompressNone || manifest {
+		nf, err := filesystem.Open(tarfile)
+		if err != nil {
+			return report, err
+		}
+		defer nf.Close()
+		nfunlock, err := flockFile(nf)
+		if err != nil {
+			return report, err
+		}
+		defer nfunlock()
+		if c == CompressNone {
+			if err := rebuildTarIndex(filesystem, tarfile, nf); err != nil {
+				return report, err
+			}
+		}
+		if manifest {
+			if _, err := writeTarManifest(filesystem, tarfile, nf); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// copyTarEntries writes the entries of the opened tarfile selected by keep into a temporary file with its mode,
+// returns its name ("" if all entries are kept) and the compression of the archive
+func copyTarEntries(filesystem afero.Fs, tarfile string, f afero.File, keep func(hdrs []*tar.Header) []bool) (*TarRewriteReport, string, Compression, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, "", CompressNone, err
+	}
+	size := fi.Size()
+	head := make([]byte, 6)
+	n, _ := io.ReadFull(f, head)
+	c := DetectCompression(head[:n])
+
+	var hdrs []*tar.Header
+	err = eachTarEntry(f, tarfile, func(hdr *tar.Header, r io.Reader) error {
+		hdrs = append(hdrs, hdr)
+		return nil
+	})
+	if err != nil {
+		return nil, "", c, err
+	}
+	kept := keep(hdrs)
+	keepTarBlobs(hdrs, kept)
+	report := &TarRewriteReport{}
+	for i, hdr := range hdrs {
+		if kept[i] {
+			report.Kept++
+		} else {
+			report.Removed = append(report.Removed, hdr.Name)
+		}
+	}
+	if report.Removed == nil {
+		return report, "", c, nil
+	}
+
+	tmp, err := createTemp(filesystem, tarfile, fi.Mode().Perm())
+	if err != nil {
+		return nil, "", c, err
+	}
+	tmpfile := tmp.Name()
+	var w io.Writer = tmp
+	var zw io.WriteCloser
+	if c != CompressNone {
+		if zw, err = compressWriter(tmp, c); err != nil {
+			tmp.Close()
+			filesystem.Remove(tmpfile)
+			return nil, "", c, err
+		}
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	i := 0
+	err = eachTarEntry(f, tarfile, func(hdr *tar.Header, r io.Reader) error {
+		defer func() { i++ }()
+		if !kept[i] {
+			return nil
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	})
+	// compressed archives end without the end of archive blocks, like TarWriter appends
+	if err == nil && zw != nil {
+		if err = tw.Flush(); err == nil {
+			err = zw.Close()
+		}
+	} else if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = filesystem.Stat(tmpfile); err == nil {
+			report.Reclaimed = size - fi.Size()
+		}
+	}
+	if err != nil {
+		filesystem.Remove(tmpfile)
+		return nil, "", c, fmt.Errorf("Error rewriting %s: %w", tarfile, err)
+	}
+	return report, tmpfile, c, nil
+}
+
+// eachTarEntry calls fn with the header and data of each entry of the opened tarfile from the start
+func eachTarEntry(f afero.File, tarfile string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tr, done, err := openTar(f, tarfile)
+	if err != nil {
+		return err
+	}
+	defer done()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &CorruptArchiveError{tarfile, err}
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// RotateOptions sets when RotateTar starts a new archive, only the limits that are set apply
+type RotateOptions struct {
+	// MaxSize rotates archives of at least this many bytes
+	MaxSize int64
+	// Period rotates archives whose first entry is from an earlier period (time.Truncate, e.g. 24h is daily in UTC)
+	Period time.Duration
+}
+
+// RotateTar moves tarfile aside when it is due, see RotateTarFS
+func RotateTar(tarfile string, opts RotateOptions) (string, error) {
+	return RotateTarFS(fs, tarfile, opts)
+}
+
+// RotateTarFS renames tarfile on given (afero) filesystem with the time of its first entry added before
+// the extension (e.g. data-20190201-103000.tar.gz) together with its index and manifest when it is due,
+// so the next write starts a new archive. Returns the new name, or "" if the archive doesn't exist or isn't due
+func RotateTarFS(filesystem afero.Fs, tarfile string, opts RotateOptions) (string, error) {
+	filesystem = orDefaultFS(filesystem)
+	defer lockPath(filesystem, tarfile)()
+	// the file lock is held over the rename, so writers waiting for it reopen and start the new archive
+	f, funlock, err := openLocked(filesystem, tarfile, os.O_RDONLY)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	defer funlock()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	first, err := firstTarModTime(filesystem, tarfile)
+	if err != nil || first.IsZero() {
+		return "", err
+	}
+	due := opts.MaxSize > 0 && fi.Size() >= opts.MaxSize
+	if opts.Period > 0 && first.Truncate(opts.Period).Before(time.Now().Truncate(opts.Period)) {
+		due = true
+	}
+	if !due {
+		return "", nil
+	}
+	base, ext := splitArchiveExt(tarfile)
+	rotated := base + "-" + first.UTC().Format("20060102-150405") + ext
+	for i := 1; ; i++ {
+		if _, err := filesystem.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s-%s-%d%s", base, first.UTC().Format("20060102-150405"), i, ext)
+	}
+	forgetTarIndex(filesystem, tarfile)
+	if err := filesystem.Rename(tarfile, rotated); err != nil {
+		return "", err
+	}
+	for _, suffix := range []string{TarIndexSuffix, TarManifestSuffix} {
+		if err := filesystem.Rename(tarfile+suffix, rotated+suffix); err != nil && !os.IsNotExist(err) {
+			filesystem.Remove(tarfile + suffix)
+		}
+	}
+	return rotated, nil
+}
+
+// firstTarModTime returns the modification time of the first entry, zero if the archive is empty
+func firstTarModTime(filesystem afero.Fs, tarfile string) (time.Time, error) {
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	tr, done, err := openTar(f, tarfile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer done()
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, &CorruptArchiveError{tarfile, err}
+	}
+	return hdr.ModTime, nil
+}
+
+// splitArchiveExt splits name into base and archive extension (.tar.gz, .tgz, .tar, ...)
+func splitArchiveExt(name string) (string, string) {
+	lower := strings.ToLower(name)
+	for _, e := range compressionExt {
+		for _, ext := range e.ext {
+			if strings.HasSuffix(lower, ext) {
+				return name[:len(name)-len(ext)], name[len(name)-len(ext):]
+			}
+		}
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext), ext
+}
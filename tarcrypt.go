@@ -0,0 +1,131 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/spf13/afero"
+)
+
+// TarEncryptionRecord is the PAX record key marking an encrypted entry, the value is the cipher (AES-GCM)
+const TarEncryptionRecord = "FILEHELPER.encryption"
+
+// TarKeyRecord is the PAX record key of the key id of an encrypted entry
+const TarKeyRecord = "FILEHELPER.key"
+
+const tarCipherAESGCM = "AES-GCM"
+
+// ErrNoKey is returned (wrapped) when an entry is encrypted or written encrypted without a registered KeyProvider
+var ErrNoKey = errors.New("no key for encrypted archive entry")
+
+// KeyProvider returns the AES key (16, 24 or 32 bytes) of a key id for encrypting and decrypting archive entries
+type KeyProvider interface {
+	Key(id string) ([]byte, error)
+}
+
+// KeyProviderFunc is a function used as KeyProvider
+type KeyProviderFunc func(id string) ([]byte, error)
+
+// Key calls f
+func (f KeyProviderFunc) Key(id string) ([]byte, error) {
+	return f(id)
+}
+
+// keyProvider is the package KeyProvider, nil if encryption is not used
+var keyProvider KeyProvider
+
+// RegisterKeyProvider sets the provider of keys used to write encrypted entries (TarEntry.Encrypt)
+// and to decrypt them transparently when reading. Passing nil removes it
+func RegisterKeyProvider(p KeyProvider) {
+	keyProvider = p
+}
+
+// entryCipher returns the AES-GCM cipher of key id
+func entryCipher(id string) (cipher.AEAD, error) {
+	if keyProvider == nil {
+		return nil, fmt.Errorf("key %q: %w", id, ErrNoKey)
+	}
+	key, err := keyProvider.Key(id)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", id, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", id, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptEntry returns the nonce followed by the sealed data, the entry name is authenticated
+// so encrypted data can't be moved to another name
+func encryptEntry(name, keyID string, data []byte) ([]byte, error) {
+	aead, err := entryCipher(keyID)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, []byte(name)), nil
+}
+
+// decryptEntry opens data written by encryptEntry
+func decryptEntry(name, keyID string, data []byte) ([]byte, error) {
+	aead, err := entryCipher(keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("decrypting %s: too short", name)
+	}
+	n := aead.NonceSize()
+	plain, err := aead.Open(nil, data[:n], data[n:], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %w", name, err)
+	}
+	return plain, nil
+}
+
+// tarEncryption returns the key id of an encrypted entry
+func tarEncryption(hdr *tar.Header) (string, bool) {
+	if hdr.PAXRecords[TarEncryptionRecord] == "" {
+		return "", false
+	}
+	return hdr.PAXRecords[TarKeyRecord], true
+}
+
+// entryData returns a reader of the data of the current entry of tarfile, decrypted if needed
+func entryData(tarfile string, hdr *tar.Header, r io.Reader) (io.Reader, error) {
+	keyID, ok := tarEncryption(hdr)
+	if !ok {
+		return r, nil
+	}
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &CorruptArchiveError{tarfile, err}
+	}
+	plain, err := decryptEntry(hdr.Name, keyID, bs)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(plain), nil
+}
+
+// WriteTarEncrypted appends filename with buf data encrypted with key id to datafile, see RegisterKeyProvider
+func WriteTarEncrypted(datafile, filename, keyID string, buf []byte) error {
+	return WriteTarEncryptedFS(fs, datafile, filename, keyID, buf)
+}
+
+// WriteTarEncryptedFS appends filename with buf data encrypted with key id to datafile on given (afero) filesystem.
+// The name and header stay readable, ReadTar and FindInTar decrypt with the registered KeyProvider
+func WriteTarEncryptedFS(filesystem afero.Fs, datafile, filename, keyID string, buf []byte) error {
+	return WriteTarEntryFS(filesystem, datafile, TarEntry{Name: filename, Encrypt: true, KeyID: keyID}, buf)
+}
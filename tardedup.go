@@ -0,0 +1,137 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// TarBlobPrefix is the name prefix of the payload entries of deduplicated archives: with TarWriter.Dedup
+// each distinct content is stored once as TarBlobPrefix + its hex SHA-256, and the named entries are hard links
+// to it. ReadTar follows the links and ListTar hides the payload entries, tar -x restores them as hard links
+const TarBlobPrefix = ".blobs/"
+
+// isTarBlob reports if name is a payload entry of a deduplicated archive
+func isTarBlob(name string) bool {
+	return strings.HasPrefix(name, TarBlobPrefix)
+}
+
+// writeDedup appends the payload of e if the archive doesn't have it yet, and e as a hard link to it
+func (w *TarWriter) writeDedup(e TarEntry, buf []byte) error {
+	if err := w.loadBlobs(); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf)
+	blob := TarBlobPrefix + hex.EncodeToString(sum[:])
+	if !w.blobs[blob] {
+		hdr := TarEntry{Name: blob, Mode: 0644, ModTime: time.Now()}.header()
+		hdr.Size = int64(len(buf))
+		if err := w.writeHeader(hdr, bytes.NewReader(buf)); err != nil {
+			return err
+		}
+		w.blobs[blob] = true
+	}
+	e.Type, e.Linkname = tar.TypeLink, blob
+	hdr := e.header()
+	// the link carries the payload checksum, so listings can compare entries without reading them
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = map[string]string{}
+	}
+	hdr.PAXRecords[TarChecksumRecord] = hex.EncodeToString(sum[:])
+	hdr.Format = tar.FormatPAX
+	return w.writeHeader(hdr, strings.NewReader(""))
+}
+
+// loadBlobs reads the payload names already in the archive from its index, the archive is only scanned
+// if it has no up to date index (always for compressed archives)
+func (w *TarWriter) loadBlobs() error {
+	if w.blobs != nil {
+		return nil
+	}
+	w.blobs = map[string]bool{}
+	if w.headerPos == 0 && w.compression == CompressNone {
+		return nil
+	}
+	if w.compression == CompressNone {
+		if idx, err := loadTarIndex(w.fs, w.name, w.f); err == nil && len(idx.entries) > 0 && idx.entries[len(idx.entries)-1].End == w.headerPos {
+			for _, e := range idx.entries {
+				if isTarBlob(e.Name) {
+					w.blobs[e.Name] = true
+				}
+			}
+			return nil
+		}
+	}
+	// a damaged tail is dropped by this writer, the entries listed before it are kept
+	entries, _ := listTarEntries(w.fs, w.name, true)
+	for _, e := range entries {
+		if isTarBlob(e.Name) {
+			w.blobs[e.Name] = true
+		}
+	}
+	return nil
+}
+
+// tarBlobs are the deduplicated payloads read so far, for reading the links to them in the same pass
+type tarBlobs map[string][]byte
+
+// read stores the payload of the current entry
+func (b tarBlobs) read(tarfile string, hdr *tar.Header, r io.Reader) error {
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return &CorruptArchiveError{tarfile, err}
+	}
+	b[hdr.Name] = bs
+	return nil
+}
+
+// linked returns the payload hdr links to
+func (b tarBlobs) linked(hdr *tar.Header) ([]byte, bool) {
+	if hdr.Typeflag != tar.TypeLink {
+		return nil, false
+	}
+	bs, ok := b[hdr.Linkname]
+	return bs, ok
+}
+
+// keepTarBlobs keeps exactly the payload entries referenced by a kept hard link
+func keepTarBlobs(hdrs []*tar.Header, kept []bool) {
+	used := map[string]bool{}
+	for i, hdr := range hdrs {
+		if kept[i] && hdr.Typeflag == tar.TypeLink {
+			used[hdr.Linkname] = true
+		}
+	}
+	for i, hdr := range hdrs {
+		if isTarBlob(hdr.Name) {
+			kept[i] = used[hdr.Name]
+		}
+	}
+}
+
+// WriteTarDedup appends filename with buf data to datafile storing the content only once, see TarBlobPrefix
+func WriteTarDedup(datafile, filename string, buf []byte) error {
+	return WriteTarDedupFS(fs, datafile, filename, buf)
+}
+
+// WriteTarDedupFS appends filename with buf data to datafile on given (afero) filesystem storing the content
+// only once, see TarBlobPrefix
+func WriteTarDedupFS(filesystem afero.Fs, datafile, filename string, buf []byte) error {
+	tw, err := NewTarWriterFS(filesystem, datafile)
+	if err != nil {
+		return err
+	}
+	tw.Dedup = true
+	if err := tw.Write(filename, buf); err != nil {
+		tw.abort()
+		return err
+	}
+	return tw.Close()
+}
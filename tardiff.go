@@ -0,0 +1,422 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/afero"
+)
+
+// diffContext is the number of unchanged lines around the changes in TarEntryDiff.Diff
+const diffContext = 3
+
+// maxDiffCells bounds the line comparison table of a unified diff, larger texts get no Diff
+const maxDiffCells = 1 << 22
+
+// maxDiffSize is the largest entry DiffTar reads for a unified diff
+const maxDiffSize = 4 << 20
+
+// TarDiff is the difference between two archives, see DiffTar
+type TarDiff struct {
+	// Added are the names only in the new archive, Removed the ones only in the old one
+	Added   []string
+	Removed []string
+	// Modified are the names in both with different size or checksum
+	Modified []TarEntryDiff
+	// Unchanged is the number of names with the same content in both
+	Unchanged int
+}
+
+// TarEntryDiff is an entry with different content in the two archives
+type TarEntryDiff struct {
+	Name      string
+	OldSize   int64
+	NewSize   int64
+	OldSHA256 string
+	NewSHA256 string
+	// Binary is set when either version is not UTF-8 text, these get no Diff
+	Binary bool
+	// Diff is the unified diff of text entries, empty if they are too large to compare line by line
+	// (over 4 MiB, or too many changed lines)
+	Diff string
+}
+
+// Changed reports if the archives differ
+func (d *TarDiff) Changed() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0 || len(d.Modified) > 0
+}
+
+// tarDigest is the size and checksum of the (decrypted) content of an entry, and where it's stored
+type tarDigest struct {
+	size    int64
+	sum     string
+	regular bool
+	src     tarSource
+}
+
+// tarSource is the stored data of an entry: the entry number, and the data offset in uncompressed archives (-1 otherwise)
+type tarSource struct {
+	index  int
+	offset int64
+	hdr    *tar.Header
+}
+
+// DiffTar compares the entries of archives a (old) and b (new), see DiffTarFS
+func DiffTar(a, b string) (*TarDiff, error) {
+	return DiffTarFS(fs, a, b)
+}
+
+// DiffTarFS compares the latest version of each entry of archives a (old) and b (new) on given (afero) filesystem
+// by name, size and SHA-256 of the decrypted content, with a unified diff of modified text entries.
+// Hard links (as in deduplicated archives) compare by their target, symlinks by the path they point to.
+// Names are in the order of the archive they are from, b for Added and Modified. Each archive is read once,
+// compressed ones a second time if they have modified text entries
+func DiffTarFS(filesystem afero.Fs, a, b string) (*TarDiff, error) {
+	filesystem = orDefaultFS(filesystem)
+	oldNames, oldDigests, err := tarDigests(filesystem, a)
+	if err != nil {
+		return nil, err
+	}
+	newNames, newDigests, err := tarDigests(filesystem, b)
+	if err != nil {
+		return nil, err
+	}
+	diff := &TarDiff{}
+	for _, name := range oldNames {
+		if _, ok := newDigests[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	// the contents of modified regular entries are read afterwards, all at once per archive
+	var oldSources, newSources []tarSource
+	var pairs [][2]int
+	for _, name := range newNames {
+		o, ok := oldDigests[name]
+		n := newDigests[name]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, name)
+		case o.size == n.size && o.sum == n.sum:
+			diff.Unchanged++
+		default:
+			e := TarEntryDiff{Name: name, OldSize: o.size, NewSize: n.size, OldSHA256: o.sum, NewSHA256: n.sum}
+			if !o.regular || !n.regular {
+				e.Binary = true
+			} else if o.size <= maxDiffSize && n.size <= maxDiffSize {
+				oldSources, newSources = append(oldSources, o.src), append(newSources, n.src)
+				pairs = append(pairs, [2]int{len(diff.Modified), len(oldSources) - 1})
+			}
+			diff.Modified = append(diff.Modified, e)
+		}
+	}
+	if len(pairs) == 0 {
+		return diff, nil
+	}
+	oldData, err := readTarSources(filesystem, a, oldSources)
+	if err != nil {
+		return nil, err
+	}
+	newData, err := readTarSources(filesystem, b, newSources)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pairs {
+		e := &diff.Modified[p[0]]
+		old, cur := oldData[oldSources[p[1]].index], newData[newSources[p[1]].index]
+		if !isText(old) || !isText(cur) {
+			e.Binary = true
+			continue
+		}
+		e.Diff = unifiedDiff("a/"+e.Name, "b/"+e.Name, splitLines(string(old)), splitLines(string(cur)))
+	}
+	return diff, nil
+}
+
+// tarDigests returns the names of tarfile in archive order without payload entries, and the digest
+// of the latest version of each. Hard links get the digest of their target at the time they were written
+func tarDigests(filesystem afero.Fs, tarfile string) ([]string, map[string]tarDigest, error) {
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 6)
+	n, _ := io.ReadFull(f, head)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	// data offsets are tracked in uncompressed archives, so the contents can be read again directly
+	var cr *countingReader
+	var tr *tar.Reader
+	if DetectCompression(head[:n]) == CompressNone {
+		cr = &countingReader{r: f}
+		tr = tar.NewReader(cr)
+	} else {
+		var done func()
+		if tr, done, err = openTar(f, tarfile); err != nil {
+			return nil, nil, err
+		}
+		defer done()
+	}
+	var names []string
+	digests := map[string]tarDigest{}
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, digests, nil
+		}
+		if err != nil {
+			return nil, nil, &CorruptArchiveError{tarfile, err}
+		}
+		var d tarDigest
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			target, ok := digests[hdr.Linkname]
+			if !ok {
+				return nil, nil, fmt.Errorf("hard link %s to %s in %s: %w", hdr.Name, hdr.Linkname, tarfile, ErrNotInArchive)
+			}
+			d = target
+		case tar.TypeSymlink:
+			d, _ = digest(strings.NewReader(hdr.Linkname))
+		default:
+			d.src = tarSource{index: index, offset: -1, hdr: hdr}
+			if cr != nil {
+				d.src.offset = cr.pos
+			}
+			r, err := entryData(tarfile, hdr, tr)
+			if err != nil {
+				return nil, nil, err
+			}
+			src := d.src
+			if d, err = digest(r); err != nil {
+				return nil, nil, &CorruptArchiveError{tarfile, err}
+			}
+			d.src, d.regular = src, hdr.Typeflag == tar.TypeReg
+		}
+		if _, ok := digests[hdr.Name]; !ok && !isTarBlob(hdr.Name) {
+			names = append(names, hdr.Name)
+		}
+		digests[hdr.Name] = d
+	}
+}
+
+// readTarSources returns the (decrypted) data of sources by entry number, read directly in uncompressed
+// archives and in one pass otherwise
+func readTarSources(filesystem afero.Fs, tarfile string, sources []tarSource) (map[int][]byte, error) {
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ret := map[int][]byte{}
+	want := map[int]bool{}
+	for _, src := range sources {
+		if src.offset < 0 {
+			want[src.index] = true
+			continue
+		}
+		e := TarIndexEntry{Name: src.hdr.Name, Offset: src.offset, Size: src.hdr.Size}
+		e.Key, e.Encrypted = tarEncryption(src.hdr)
+		if ret[src.index], err = readTarIndexEntry(f, tarfile, e); err != nil {
+			return nil, err
+		}
+	}
+	if len(want) == 0 {
+		return ret, nil
+	}
+	tr, done, err := openTar(f, tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	for index := 0; len(want) > 0; index++ {
+		hdr, err := tr.Next()
+		if err != nil {
+			return nil, &CorruptArchiveError{tarfile, err}
+		}
+		if !want[index] {
+			continue
+		}
+		r, err := entryData(tarfile, hdr, tr)
+		if err != nil {
+			return nil, err
+		}
+		if ret[index], err = ioutil.ReadAll(r); err != nil {
+			return nil, &CorruptArchiveError{tarfile, err}
+		}
+		delete(want, index)
+	}
+	return ret, nil
+}
+
+// digest returns the size and checksum of r
+func digest(r io.Reader) (tarDigest, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return tarDigest{}, err
+	}
+	return tarDigest{size: n, sum: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// isText reports if bs is UTF-8 without NUL bytes
+func isText(bs []byte) bool {
+	return utf8.Valid(bs) && bytes.IndexByte(bs, 0) < 0
+}
+
+// splitLines returns the lines of s with their line endings
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffOp is a line of an edit script: ' ' kept, '-' deleted from a, '+' inserted from b.
+// a and b are the positions in the two texts before the line
+type diffOp struct {
+	kind byte
+	a, b int
+	line string
+}
+
+// diffLines returns the edit script from a to b with the longest common subsequence of lines kept,
+// false if they are too large to compare
+func diffLines(a, b []string) ([]diffOp, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	n, m := len(a)-prefix-suffix, len(b)-prefix-suffix
+	if (n+1)*(m+1) > maxDiffCells {
+		return nil, false
+	}
+	// lcs[i*(m+1)+j] is the length of the common subsequence of the middle parts from a[i] and b[j]
+	lcs := make([]int32, (n+1)*(m+1))
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			switch {
+			case a[prefix+i] == b[prefix+j]:
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+			case lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]:
+				lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j]
+			default:
+				lcs[i*(m+1)+j] = lcs[i*(m+1)+j+1]
+			}
+		}
+	}
+	ops := make([]diffOp, 0, len(a)+m)
+	for k := 0; k < prefix; k++ {
+		ops = append(ops, diffOp{' ', k, k, a[k]})
+	}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && a[prefix+i] == b[prefix+j]:
+			ops = append(ops, diffOp{' ', prefix + i, prefix + j, a[prefix+i]})
+			i++
+			j++
+		case j == m || (i < n && lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]):
+			ops = append(ops, diffOp{'-', prefix + i, prefix + j, a[prefix+i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', prefix + i, prefix + j, b[prefix+j]})
+			j++
+		}
+	}
+	for k := 0; k < suffix; k++ {
+		ops = append(ops, diffOp{' ', prefix + n + k, prefix + m + k, a[prefix+n+k]})
+	}
+	return ops, true
+}
+
+// unifiedDiff returns the unified diff of lines a and b with diffContext lines of context,
+// empty if they are equal or too large to compare
+func unifiedDiff(aName, bName string, a, b []string) string {
+	ops, ok := diffLines(a, b)
+	if !ok {
+		return ""
+	}
+	var sb strings.Builder
+	for start := 0; start < len(ops); {
+		// the next hunk starts diffContext lines before the next change
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+		}
+		from := first - diffContext
+		if from < start {
+			from = start
+		}
+		// and ends diffContext lines after a change not followed by another one within 2*diffContext lines
+		to, kept := first, 0
+		for ; to < len(ops) && kept <= 2*diffContext; to++ {
+			if ops[to].kind == ' ' {
+				kept++
+			} else {
+				kept = 0
+			}
+		}
+		if kept > diffContext {
+			to -= kept - diffContext
+		}
+		writeHunk(&sb, ops[from:to])
+		start = to
+	}
+	return sb.String()
+}
+
+// writeHunk writes the header and lines of a hunk
+func writeHunk(sb *strings.Builder, ops []diffOp) {
+	aCount, bCount := 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			aCount++
+		}
+		if op.kind != '-' {
+			bCount++
+		}
+	}
+	// empty ranges start at the line before them
+	aStart, bStart := ops[0].a+1, ops[0].b+1
+	if aCount == 0 {
+		aStart--
+	}
+	if bCount == 0 {
+		bStart--
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+	for _, op := range ops {
+		sb.WriteByte(op.kind)
+		sb.WriteString(op.line)
+		if !strings.HasSuffix(op.line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// hunkRange formats a hunk range, the count is left out if it's 1
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
@@ -0,0 +1,290 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// TarMetadataPrefix is the PAX record key prefix of TarEntry.Metadata
+const TarMetadataPrefix = "FILEHELPER."
+
+// TarChecksumRecord is the PAX record key of the SHA-256 of the entry data, written for every regular file
+const TarChecksumRecord = "FILEHELPER.sha256"
+
+// reservedRecords are the PAX records written by the package, they can't be set in PAXRecords or Metadata
+var reservedRecords = []string{TarChecksumRecord, TarEncryptionRecord, TarKeyRecord}
+
+// TarEntry is the header of a tar entry, see WriteTarEntry and ListTarEntries
+type TarEntry struct {
+	Name string
+	// Type is the tar type flag (tar.TypeReg, tar.TypeDir, tar.TypeSymlink, ...), regular file if zero
+	Type     byte
+	Linkname string
+	// Size is set from the data when writing
+	Size int64
+	// Mode defaults to 0644, or 0755 for directories
+	Mode int64
+	// ModTime defaults to now, stored in seconds, access and change times are not stored
+	ModTime time.Time
+	Uid     int
+	Gid     int
+	Uname   string
+	Gname   string
+	// PAXRecords are extra PAX records, keys of user defined records should look like VENDOR.keyword
+	PAXRecords map[string]string
+	// Metadata is stored in PAX records with TarMetadataPrefix added to the keys, the keys of records
+	// the package writes (sha256, encryption, key) are rejected
+	Metadata map[string]string
+	// SHA256 is the hex checksum of the stored data recorded when writing (read only), see VerifyTar
+	SHA256 string
+	// Encrypt stores the data encrypted with the key KeyID of the registered KeyProvider (AES-GCM),
+	// Size is the size of the encrypted data then
+	Encrypt bool
+	KeyID   string
+}
+
+// checkRecords rejects PAXRecords and Metadata keys of reservedRecords
+func (e TarEntry) checkRecords() error {
+	for _, key := range reservedRecords {
+		if _, ok := e.PAXRecords[key]; ok {
+			return fmt.Errorf("%s: PAX record %s is reserved", e.Name, key)
+		}
+		if _, ok := e.Metadata[strings.TrimPrefix(key, TarMetadataPrefix)]; ok {
+			return fmt.Errorf("%s: metadata key %q is reserved", e.Name, strings.TrimPrefix(key, TarMetadataPrefix))
+		}
+	}
+	return nil
+}
+
+// header returns the tar header of e with defaults applied
+func (e TarEntry) header() *tar.Header {
+	hdr := &tar.Header{
+		Name:     e.Name,
+		Typeflag: e.Type,
+		Linkname: e.Linkname,
+		Size:     e.Size,
+		Mode:     e.Mode,
+		ModTime:  e.ModTime,
+		Uid:      e.Uid,
+		Gid:      e.Gid,
+		Uname:    e.Uname,
+		Gname:    e.Gname,
+		Format:   tar.FormatGNU,
+	}
+	if hdr.Typeflag == 0 {
+		hdr.Typeflag = tar.TypeReg
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		hdr.Size = 0
+	}
+	if hdr.Mode == 0 {
+		hdr.Mode = 0644
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+	}
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = time.Now()
+	}
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	if len(e.PAXRecords) > 0 || len(e.Metadata) > 0 || e.Encrypt {
+		hdr.Format = tar.FormatPAX
+		hdr.PAXRecords = map[string]string{}
+		for k, v := range e.PAXRecords {
+			hdr.PAXRecords[k] = v
+		}
+		for k, v := range e.Metadata {
+			hdr.PAXRecords[TarMetadataPrefix+k] = v
+		}
+		if e.Encrypt {
+			hdr.PAXRecords[TarEncryptionRecord] = tarCipherAESGCM
+			hdr.PAXRecords[TarKeyRecord] = e.KeyID
+		}
+	}
+	return hdr
+}
+
+// tarEntry returns the TarEntry of a read header, metadata records are moved from PAXRecords to Metadata
+func tarEntry(hdr *tar.Header) TarEntry {
+	e := TarEntry{
+		Name:     hdr.Name,
+		Type:     hdr.Typeflag,
+		Linkname: hdr.Linkname,
+		Size:     hdr.Size,
+		Mode:     hdr.Mode,
+		ModTime:  hdr.ModTime,
+		Uid:      hdr.Uid,
+		Gid:      hdr.Gid,
+		Uname:    hdr.Uname,
+		Gname:    hdr.Gname,
+	}
+	for k, v := range hdr.PAXRecords {
+		switch k {
+		case TarChecksumRecord:
+			e.SHA256 = v
+			continue
+		case TarEncryptionRecord:
+			e.Encrypt = true
+			continue
+		case TarKeyRecord:
+			e.KeyID = v
+			continue
+		}
+		if strings.HasPrefix(k, TarMetadataPrefix) {
+			if e.Metadata == nil {
+				e.Metadata = map[string]string{}
+			}
+			e.Metadata[strings.TrimPrefix(k, TarMetadataPrefix)] = v
+			continue
+		}
+		if e.PAXRecords == nil {
+			e.PAXRecords = map[string]string{}
+		}
+		e.PAXRecords[k] = v
+	}
+	return e
+}
+
+// WriteTarEntry appends an entry with the header fields of e and buf data to datafile
+func WriteTarEntry(datafile string, e TarEntry, buf []byte) error {
+	return WriteTarEntryFS(fs, datafile, e, buf)
+}
+
+// WriteTarEntryFS appends an entry with the header fields of e and buf data to datafile on given (afero) filesystem
+func WriteTarEntryFS(filesystem afero.Fs, datafile string, e TarEntry, buf []byte) error {
+	tw, err := NewTarWriterFS(filesystem, datafile)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteEntry(e, buf); err != nil {
+		tw.abort()
+		return err
+	}
+	return tw.Close()
+}
+
+// AddDir appends the directories, files and symlinks under dir on src (afero) filesystem recursively,
+// named prefix and their slash separated path relative to dir, keeping mode, modification time and owner.
+// Symlinks are stored as links if src supports them (afero.OsFs, afero.BasePathFs)
+func (w *TarWriter) AddDir(src afero.Fs, dir, prefix string) error {
+	src = orDefaultFS(src)
+	return afero.Walk(src, dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			lr, ok := src.(afero.LinkReader)
+			if !ok {
+				return nil
+			}
+			if link, err = lr.ReadlinkIfPossible(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+		hdr.Format = tar.FormatGNU
+		if hdr.Typeflag != tar.TypeReg {
+			return w.writeHeader(hdr, strings.NewReader(""))
+		}
+		f, err := src.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return w.writeHeader(hdr, f)
+	})
+}
+
+// AddTarDir appends the directories, files and symlinks under dir recursively to datafile, see TarWriter.AddDir
+func AddTarDir(datafile, dir, prefix string) error {
+	return AddTarDirFS(fs, datafile, dir, prefix)
+}
+
+// AddTarDirFS appends the directories, files and symlinks under dir on given (afero) filesystem
+// recursively to datafile on the same filesystem, see TarWriter.AddDir
+func AddTarDirFS(filesystem afero.Fs, datafile, dir, prefix string) error {
+	tw, err := NewTarWriterFS(filesystem, datafile)
+	if err != nil {
+		return err
+	}
+	if err := tw.AddDir(filesystem, dir, prefix); err != nil {
+		tw.abort()
+		return err
+	}
+	return tw.Close()
+}
+
+// ListTarEntries returns the headers of all entries in tarfile
+func ListTarEntries(tarfile string) ([]TarEntry, error) {
+	return ListTarEntriesFS(fs, tarfile)
+}
+
+// ListTarEntriesFS returns the headers of all entries in tarfile on given (afero) filesystem, deduplicated
+// entries have the size of the payload they link to and the payload entries are left out, as in ListTarFS
+func ListTarEntriesFS(filesystem afero.Fs, tarfile string) ([]TarEntry, error) {
+	return listTarEntries(filesystem, tarfile, false)
+}
+
+// listTarEntries returns the headers of the entries in tarfile, with the payload entries if blobs is set
+func listTarEntries(filesystem afero.Fs, tarfile string, blobs bool) ([]TarEntry, error) {
+	f, err := orDefaultFS(filesystem).Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 6)
+	n, _ := io.ReadFull(f, head)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// uncompressed archives are read directly, so tar can seek over the entry data
+	tr, done := tar.NewReader(f), func() {}
+	if DetectCompression(head[:n]) != CompressNone {
+		if tr, done, err = openTar(f, tarfile); err != nil {
+			return nil, err
+		}
+	}
+	defer done()
+	var ret []TarEntry
+	blobSizes := map[string]int64{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return ret, &CorruptArchiveError{tarfile, err}
+		}
+		e := tarEntry(hdr)
+		if isTarBlob(e.Name) {
+			blobSizes[e.Name] = e.Size
+			if !blobs {
+				continue
+			}
+		} else if size, ok := blobSizes[e.Linkname]; ok && e.Type == tar.TypeLink {
+			e.Size = size
+		}
+		ret = append(ret, e)
+	}
+}
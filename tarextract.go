@@ -0,0 +1,448 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// ErrUnsafeEntry is returned (wrapped) by ExtractTar for entries that would be written outside the target directory
+var ErrUnsafeEntry = errors.New("unsafe archive entry")
+
+// ErrExtractLimit is returned (wrapped) by ExtractTar when an ExtractOptions limit is exceeded
+var ErrExtractLimit = errors.New("archive extraction limit exceeded")
+
+// ExtractOptions filters and limits ExtractTar
+type ExtractOptions struct {
+	// Patterns are path.Match globs of entry names (or their parent directories) to extract, all if empty
+	Patterns []string
+	// MaxEntries is the maximum number of extracted entries, unlimited if zero
+	MaxEntries int
+	// MaxFileSize is the maximum size of an extracted file, unlimited if zero
+	MaxFileSize int64
+	// MaxTotalSize is the maximum size of all extracted files, unlimited if zero
+	MaxTotalSize int64
+}
+
+func (o ExtractOptions) match(name string) (bool, error) {
+	if len(o.Patterns) == 0 {
+		return true, nil
+	}
+	for p := name; p != "." && p != "/"; p = path.Dir(p) {
+		for _, pattern := range o.Patterns {
+			ok, err := path.Match(pattern, p)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// ExtractTar restores the entries of tarfile into dir, see ExtractTarFS
+func ExtractTar(tarfile, dir string, opts ExtractOptions) ([]string, error) {
+	return ExtractTarFS(fs, tarfile, fs, dir, opts)
+}
+
+// ExtractTarFS restores the entries of tarfile on filesystem into dir on target (afero) filesystem
+// with their modes and modification times, returns the extracted entry names.
+// Entries with absolute paths or .. and symlinks pointing outside dir are rejected, as is writing through
+// an existing symlink. Symlinks are only created if target supports them (afero.OsFs), hard links are copied
+// from regular files only and count against the size limits with the size of their source.
+// Deduplicated archives (see TarBlobPrefix) are restored without their payload entries
+func ExtractTarFS(filesystem afero.Fs, tarfile string, target afero.Fs, dir string, opts ExtractOptions) ([]string, error) {
+	filesystem, target = orDefaultFS(filesystem), orDefaultFS(target)
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr, done, err := openTar(f, tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	if err := target.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	x := &extractor{target: target, dir: dir, opts: opts}
+	defer x.removeBlobs()
+	var extracted []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return extracted, &CorruptArchiveError{tarfile, err}
+		}
+		name, err := safeEntryName(hdr.Name)
+		if err != nil {
+			return extracted, err
+		}
+		blob := isTarBlob(name)
+		if blob {
+			// payloads are only staged for the links that are extracted
+			if x.needed == nil {
+				if x.needed, err = neededBlobs(filesystem, tarfile, opts); err != nil {
+					return extracted, err
+				}
+			}
+			if !x.needed[name] {
+				continue
+			}
+		} else if ok, err := opts.match(name); err != nil || !ok {
+			if err != nil {
+				return extracted, err
+			}
+			continue
+		}
+		if !blob && opts.MaxEntries > 0 && len(extracted) >= opts.MaxEntries {
+			return extracted, fmt.Errorf("more than %d entries: %w", opts.MaxEntries, ErrExtractLimit)
+		}
+		r, err := entryData(tarfile, hdr, tr)
+		if err != nil {
+			return extracted, err
+		}
+		ok, err := x.extract(hdr, name, r)
+		if err != nil {
+			return extracted, err
+		}
+		if ok && !blob {
+			extracted = append(extracted, hdr.Name)
+		}
+	}
+	return extracted, x.finish()
+}
+
+// neededBlobs returns the payload entries of tarfile linked from entries matching opts
+func neededBlobs(filesystem afero.Fs, tarfile string, opts ExtractOptions) (map[string]bool, error) {
+	entries, err := ListTarEntriesFS(filesystem, tarfile)
+	if err != nil {
+		return nil, err
+	}
+	needed := map[string]bool{}
+	for _, e := range entries {
+		if e.Type != tar.TypeLink || !isTarBlob(e.Linkname) {
+			continue
+		}
+		// unsafe names are rejected when they are reached
+		if name, err := safeEntryName(e.Name); err == nil {
+			if ok, _ := opts.match(name); ok {
+				needed[path.Clean(e.Linkname)] = true
+			}
+		}
+	}
+	return needed, nil
+}
+
+// safeEntryName returns the cleaned slash separated name, rejecting absolute names and names leaving the root
+func safeEntryName(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "\\\x00") || path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("%q: %w", name, ErrUnsafeEntry)
+	}
+	clean := path.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%q: %w", name, ErrUnsafeEntry)
+	}
+	return clean, nil
+}
+
+type extractor struct {
+	target afero.Fs
+	dir    string
+	opts   ExtractOptions
+	total  int64
+	dirs   []*tar.Header
+	// needed are the payloads of deduplicated archives to stage, loaded at the first one
+	needed map[string]bool
+	// blobDir is the staging directory of the payloads, staged their paths in it by entry name
+	blobDir string
+	staged  map[string]string
+}
+
+func (x *extractor) path(name string) string {
+	return filepath.Join(x.dir, filepath.FromSlash(name))
+}
+
+// reserve checks the size limits before writing size bytes of name
+func (x *extractor) reserve(name string, size int64) error {
+	if x.opts.MaxFileSize > 0 && size > x.opts.MaxFileSize {
+		return fmt.Errorf("%s is larger than %d bytes: %w", name, x.opts.MaxFileSize, ErrExtractLimit)
+	}
+	if x.total += size; x.opts.MaxTotalSize > 0 && x.total > x.opts.MaxTotalSize {
+		return fmt.Errorf("more than %d bytes: %w", x.opts.MaxTotalSize, ErrExtractLimit)
+	}
+	return nil
+}
+
+// lstat returns the file info of name in the target directory without following a final symlink
+func (x *extractor) lstat(name string) (os.FileInfo, error) {
+	if l, ok := x.target.(afero.Lstater); ok {
+		info, _, err := l.LstatIfPossible(x.path(name))
+		return info, err
+	}
+	return x.target.Stat(x.path(name))
+}
+
+// checkParents rejects name if a directory on its way inside the target directory is a symlink
+func (x *extractor) checkParents(name string) error {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		info, err := x.lstat(strings.Join(parts[:i], "/"))
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%q is written through a symlink: %w", name, ErrUnsafeEntry)
+		}
+	}
+	return nil
+}
+
+// checkSymlink rejects a symlink at name to linkname unless it stays inside the target directory whatever
+// is extracted later: it can't pass through a symlink, and .. only leaves existing directories
+func (x *extractor) checkSymlink(name, linkname string) error {
+	if path.IsAbs(linkname) || filepath.IsAbs(linkname) {
+		return fmt.Errorf("%q links to absolute %q: %w", name, linkname, ErrUnsafeEntry)
+	}
+	parts := append(strings.Split(path.Dir(name), "/"), strings.Split(linkname, "/")...)
+	var cur []string
+	for i, part := range parts {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(cur) == 0 {
+				return fmt.Errorf("%q links outside to %q: %w", name, linkname, ErrUnsafeEntry)
+			}
+			if info, err := x.lstat(strings.Join(cur, "/")); err != nil || !info.IsDir() {
+				return fmt.Errorf("%q links to %q through a missing directory: %w", name, linkname, ErrUnsafeEntry)
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		}
+		cur = append(cur, part)
+		if i == len(parts)-1 {
+			break
+		}
+		if info, err := x.lstat(strings.Join(cur, "/")); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%q links to %q through a symlink: %w", name, linkname, ErrUnsafeEntry)
+		}
+	}
+	return nil
+}
+
+// resolve returns name inside the target directory with the symlinks on its way followed,
+// rejecting it if they lead outside
+func (x *extractor) resolve(name string) (string, error) {
+	r, ok := x.target.(afero.LinkReader)
+	if !ok {
+		return name, nil
+	}
+	todo := strings.Split(name, "/")
+	var cur []string
+	for hops := 0; len(todo) > 0; {
+		part := todo[0]
+		todo = todo[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(cur) == 0 {
+				return "", fmt.Errorf("%q resolves outside: %w", name, ErrUnsafeEntry)
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		}
+		cur = append(cur, part)
+		info, err := x.lstat(strings.Join(cur, "/"))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if hops++; hops > 255 {
+			return "", fmt.Errorf("%q: too many symlinks: %w", name, ErrUnsafeEntry)
+		}
+		linkname, err := r.ReadlinkIfPossible(x.path(strings.Join(cur, "/")))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(linkname) || filepath.IsAbs(linkname) {
+			return "", fmt.Errorf("%q resolves outside: %w", name, ErrUnsafeEntry)
+		}
+		cur = cur[:len(cur)-1]
+		todo = append(strings.Split(filepath.ToSlash(linkname), "/"), todo...)
+	}
+	return strings.Join(cur, "/"), nil
+}
+
+// linkSource opens the regular file a hard link to linkname copies
+func (x *extractor) linkSource(name, linkname string) (afero.File, error) {
+	linkname, err := safeEntryName(linkname)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := x.staged[linkname]; ok {
+		return x.target.Open(p)
+	}
+	if err := x.checkParents(linkname); err != nil {
+		return nil, err
+	}
+	info, err := x.lstat(linkname)
+	if err != nil {
+		return nil, fmt.Errorf("hard link %s: %w", name, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("hard link %q to %q is not a regular file: %w", name, linkname, ErrUnsafeEntry)
+	}
+	resolved, err := x.resolve(linkname)
+	if err != nil {
+		return nil, err
+	}
+	return x.target.Open(x.path(resolved))
+}
+
+// stageBlob returns the path a payload of a deduplicated archive is written to, outside the extracted names
+func (x *extractor) stageBlob(name string) (string, error) {
+	if x.blobDir == "" {
+		dir, err := afero.TempDir(x.target, x.dir, ".blobs")
+		if err != nil {
+			return "", err
+		}
+		x.blobDir, x.staged = dir, map[string]string{}
+	}
+	p := filepath.Join(x.blobDir, path.Base(name))
+	x.staged[name] = p
+	return p, nil
+}
+
+// removeBlobs removes the staged payloads
+func (x *extractor) removeBlobs() error {
+	if x.blobDir == "" {
+		return nil
+	}
+	err := x.target.RemoveAll(x.blobDir)
+	x.blobDir, x.staged = "", nil
+	return err
+}
+
+// removeLink removes an existing symlink at p, so it isn't written through
+func (x *extractor) removeLink(p string) error {
+	if l, ok := x.target.(afero.Lstater); ok {
+		if info, _, err := l.LstatIfPossible(p); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return x.target.Remove(p)
+		}
+	}
+	return nil
+}
+
+// extract writes one entry, returns false for skipped entry types
+func (x *extractor) extract(hdr *tar.Header, name string, r io.Reader) (bool, error) {
+	if err := x.checkParents(name); err != nil && !isTarBlob(name) {
+		return false, err
+	}
+	p := x.path(name)
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if name == "." {
+			return false, nil
+		}
+		if err := x.target.MkdirAll(p, 0755); err != nil {
+			return false, err
+		}
+		// modes and times of directories are set at the end, writing their content changes them
+		x.dirs = append(x.dirs, hdr)
+		return true, nil
+	case tar.TypeReg, tar.TypeLink:
+		size := hdr.Size
+		if hdr.Typeflag == tar.TypeLink {
+			src, err := x.linkSource(hdr.Name, hdr.Linkname)
+			if err != nil {
+				return false, err
+			}
+			defer src.Close()
+			info, err := src.Stat()
+			if err != nil {
+				return false, err
+			}
+			r, size = src, info.Size()
+		}
+		if err := x.reserve(hdr.Name, size); err != nil {
+			return false, err
+		}
+		if isTarBlob(name) {
+			var err error
+			if p, err = x.stageBlob(name); err != nil {
+				return false, err
+			}
+		} else {
+			if err := x.target.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return false, err
+			}
+			if err := x.removeLink(p); err != nil {
+				return false, err
+			}
+		}
+		f, err := x.target.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return false, err
+		}
+		// the copy is bounded by the reserved size, a source growing meanwhile is cut
+		_, err = io.Copy(f, io.LimitReader(r, size))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return false, err
+		}
+		x.target.Chmod(p, mode)
+		x.target.Chtimes(p, hdr.ModTime, hdr.ModTime)
+		return true, nil
+	case tar.TypeSymlink:
+		linker, ok := x.target.(afero.Linker)
+		if !ok {
+			if path.IsAbs(hdr.Linkname) || filepath.IsAbs(hdr.Linkname) {
+				return false, fmt.Errorf("%q links to absolute %q: %w", hdr.Name, hdr.Linkname, ErrUnsafeEntry)
+			}
+			if _, err := safeEntryName(path.Join(path.Dir(name), hdr.Linkname)); err != nil {
+				return false, fmt.Errorf("%q links outside to %q: %w", hdr.Name, hdr.Linkname, ErrUnsafeEntry)
+			}
+			return false, nil
+		}
+		if err := x.target.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return false, err
+		}
+		if err := x.checkSymlink(name, hdr.Linkname); err != nil {
+			return false, err
+		}
+		if err := x.removeLink(p); err != nil {
+			return false, err
+		}
+		return true, linker.SymlinkIfPossible(hdr.Linkname, p)
+	}
+	return false, nil
+}
+
+// finish removes the staged payloads and sets the modes and times of directories, deepest first
+func (x *extractor) finish() error {
+	if err := x.removeBlobs(); err != nil {
+		return err
+	}
+	for i := len(x.dirs) - 1; i >= 0; i-- {
+		hdr := x.dirs[i]
+		name, _ := safeEntryName(hdr.Name)
+		p := x.path(name)
+		if err := x.target.Chmod(p, os.FileMode(hdr.Mode).Perm()); err != nil {
+			return err
+		}
+		if err := x.target.Chtimes(p, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
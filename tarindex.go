@@ -0,0 +1,293 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/shoobyban/slog"
+	"github.com/spf13/afero"
+)
+
+// TarIndexSuffix is added to the archive name for its sidecar index file
+const TarIndexSuffix = ".idx"
+
+// ErrNoTarIndex is returned (wrapped) when an archive has no index or the index doesn't match the archive
+var ErrNoTarIndex = errors.New("no valid tar index")
+
+// TarIndexEntry is a line of the sidecar index (JSON lines) of an uncompressed tar archive,
+// maintained by WriteTar and used by ReadTar and ListTar instead of scanning the archive
+type TarIndexEntry struct {
+	Name    string    `json:"name"`
+	Offset  int64     `json:"offset"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modtime"`
+	Mode    int64     `json:"mode"`
+	// Type is the tar type flag, empty for regular files
+	Type   string `json:"type,omitempty"`
+	SHA256 string `json:"sha256"`
+	// End is the offset after the padded data, where the next header or the end of archive blocks start
+	End int64 `json:"end"`
+	// Link is the target of a hard link (Type "1")
+	Link string `json:"link,omitempty"`
+	// Encrypted entries are decrypted with Key of the registered KeyProvider
+	Encrypted bool   `json:"encrypted,omitempty"`
+	Key       string `json:"key,omitempty"`
+}
+
+// FileInfo returns file info of the entry
+func (e TarIndexEntry) FileInfo() os.FileInfo {
+	hdr := &tar.Header{Name: e.Name, Size: e.Size, Mode: e.Mode, ModTime: e.ModTime, Typeflag: tar.TypeReg}
+	if e.Type != "" {
+		hdr.Typeflag = e.Type[0]
+	}
+	return hdr.FileInfo()
+}
+
+type tarIndex struct {
+	entries []TarIndexEntry
+	// byName has the positions of the versions of each name, oldest first
+	byName  map[string][]int
+	size    int64
+	modTime time.Time
+}
+
+type tarIndexKey struct {
+	fs   afero.Fs
+	name string
+}
+
+// tarIndexCache keeps parsed index files until they change
+var tarIndexCache = struct {
+	sync.Mutex
+	m map[tarIndexKey]*tarIndex
+}{m: map[tarIndexKey]*tarIndex{}}
+
+func blockPadded(size int64) int64 {
+	return (size + 511) &^ 511
+}
+
+// RebuildTarIndex scans tarfile and writes its sidecar index
+func RebuildTarIndex(tarfile string) error {
+	return RebuildTarIndexFS(fs, tarfile)
+}
+
+// RebuildTarIndexFS scans tarfile on given (afero) filesystem and writes its sidecar index
+func RebuildTarIndexFS(filesystem afero.Fs, tarfile string) error {
+	filesystem = orDefaultFS(filesystem)
+	defer lockPath(filesystem, tarfile)()
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	funlock, err := flockFile(f)
+	if err != nil {
+		return err
+	}
+	defer funlock()
+	return rebuildTarIndex(filesystem, tarfile, f)
+}
+
+// rebuildTarIndex writes the index of the opened tarfile, the caller holds the archive locks
+func rebuildTarIndex(filesystem afero.Fs, tarfile string, f afero.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	head := make([]byte, 6)
+	n, _ := io.ReadFull(f, head)
+	if c := DetectCompression(head[:n]); c != CompressNone {
+		return fmt.Errorf("can't index %s compressed archive %s", c, tarfile)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return &CorruptArchiveError{tarfile, err}
+		}
+		offset := cr.pos
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			return &CorruptArchiveError{tarfile, err}
+		}
+		e := TarIndexEntry{
+			Name:    hdr.Name,
+			Offset:  offset,
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			Mode:    hdr.Mode,
+			SHA256:  hex.EncodeToString(h.Sum(nil)),
+			End:     offset + blockPadded(hdr.Size),
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			e.Type = string(hdr.Typeflag)
+		}
+		if sum := hdr.PAXRecords[TarChecksumRecord]; sum != "" && hdr.Typeflag == tar.TypeLink {
+			e.SHA256 = sum
+		}
+		e.Key, e.Encrypted = tarEncryption(hdr)
+		if hdr.Typeflag == tar.TypeLink {
+			e.Link = hdr.Linkname
+		}
+		enc.Encode(e)
+	}
+	forgetTarIndex(filesystem, tarfile)
+	return afero.WriteFile(filesystem, tarfile+TarIndexSuffix, buf.Bytes(), 0644)
+}
+
+// ReadTarIndex returns the entries of the sidecar index of tarfile, the error wraps ErrNoTarIndex
+// if there is no index or it doesn't match the archive
+func ReadTarIndex(tarfile string) ([]TarIndexEntry, error) {
+	return ReadTarIndexFS(fs, tarfile)
+}
+
+// ReadTarIndexFS returns the entries of the sidecar index of tarfile on given (afero) filesystem
+func ReadTarIndexFS(filesystem afero.Fs, tarfile string) ([]TarIndexEntry, error) {
+	filesystem = orDefaultFS(filesystem)
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	idx, err := loadTarIndex(filesystem, tarfile, f)
+	if err != nil {
+		return nil, err
+	}
+	return idx.entries, nil
+}
+
+// loadTarIndex returns the (cached) index of the opened tarfile if it matches the archive:
+// the end of archive blocks follow the last indexed entry
+func loadTarIndex(filesystem afero.Fs, tarfile string, f afero.File) (*tarIndex, error) {
+	fi, err := filesystem.Stat(tarfile + TarIndexSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", tarfile, ErrNoTarIndex)
+	}
+	key := tarIndexKey{filesystem, tarfile}
+	tarIndexCache.Lock()
+	idx := tarIndexCache.m[key]
+	tarIndexCache.Unlock()
+	if idx == nil || idx.size != fi.Size() || !idx.modTime.Equal(fi.ModTime()) {
+		if idx, err = parseTarIndex(filesystem, tarfile+TarIndexSuffix); err != nil {
+			return nil, err
+		}
+		idx.size, idx.modTime = fi.Size(), fi.ModTime()
+		tarIndexCache.Lock()
+		tarIndexCache.m[key] = idx
+		tarIndexCache.Unlock()
+	}
+	var end int64
+	if len(idx.entries) > 0 {
+		end = idx.entries[len(idx.entries)-1].End
+	}
+	trailer := make([]byte, 2<<9)
+	if _, err := f.ReadAt(trailer, end); err != nil || !bytes.Equal(trailer, make([]byte, 2<<9)) {
+		return nil, fmt.Errorf("%s is out of date: %w", tarfile+TarIndexSuffix, ErrNoTarIndex)
+	}
+	return idx, nil
+}
+
+func parseTarIndex(filesystem afero.Fs, indexfile string) (*tarIndex, error) {
+	f, err := filesystem.Open(indexfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	idx := &tarIndex{byName: map[string][]int{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e TarIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v: %w", indexfile, len(idx.entries)+1, err, ErrNoTarIndex)
+		}
+		idx.byName[e.Name] = append(idx.byName[e.Name], len(idx.entries))
+		idx.entries = append(idx.entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func forgetTarIndex(filesystem afero.Fs, tarfile string) {
+	tarIndexCache.Lock()
+	delete(tarIndexCache.m, tarIndexKey{filesystem, tarfile})
+	tarIndexCache.Unlock()
+}
+
+// lastTarIndexEnd returns the End of the last line of the index file, -1 if it can't be read
+func lastTarIndexEnd(filesystem afero.Fs, indexfile string) int64 {
+	f, err := filesystem.Open(indexfile)
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return -1
+	}
+	start := fi.Size() - 4096
+	if start < 0 {
+		start = 0
+	}
+	tail := make([]byte, fi.Size()-start)
+	if _, err := f.ReadAt(tail, start); err != nil && err != io.EOF {
+		return -1
+	}
+	lines := bytes.Split(bytes.TrimRight(tail, "\n"), []byte("\n"))
+	var e TarIndexEntry
+	if err := json.Unmarshal(lines[len(lines)-1], &e); err != nil {
+		return -1
+	}
+	return e.End
+}
+
+// updateTarIndex records entries written from headerPos of the opened datafile in its index: a new archive
+// gets a new index, an up to date index gets entries appended, otherwise the index is rebuilt.
+// Errors are only logged, readers fall back to scanning the archive when the index doesn't match
+func updateTarIndex(filesystem afero.Fs, datafile string, f afero.File, headerPos int64, entries ...TarIndexEntry) {
+	indexfile := datafile + TarIndexSuffix
+	forgetTarIndex(filesystem, datafile)
+	if headerPos > 0 && lastTarIndexEnd(filesystem, indexfile) != headerPos {
+		if err := rebuildTarIndex(filesystem, datafile, f); err != nil {
+			slog.Infof("Error rebuilding tar index %s", err.Error())
+		}
+		return
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if headerPos == 0 {
+		flag |= os.O_TRUNC
+	}
+	idx, err := filesystem.OpenFile(indexfile, flag, 0644)
+	if err != nil {
+		slog.Infof("Error writing tar index %s", err.Error())
+		return
+	}
+	defer idx.Close()
+	enc := json.NewEncoder(idx)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			slog.Infof("Error writing tar index %s", err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package filehelper
+
+import (
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/shoobyban/slog"
+)
+
+// QueryMatch is an archive entry with the sub-documents matching a query, see Parser.QueryTar
+type QueryMatch struct {
+	Name    string
+	Matches []interface{}
+}
+
+// QueryTar parses the entries of tarfile (on the parser's filesystem) with the parser registered for their
+// extension (.json, .xml, .csv, ...) and evaluates expr (see QueryExpr) on them, returns the entries with
+// matches in archive order. Entries are limited to names matching any of the path.Match globs if given,
+// entries without a parser are skipped, as are the ones failing to parse (logged). Deduplicated payloads
+// are kept in memory while reading
+func (l *Parser) QueryTar(tarfile, expr string, names ...string) ([]QueryMatch, error) {
+	q, err := CompileQuery(expr)
+	if err != nil {
+		return nil, err
+	}
+	filter := SearchOptions{Names: names}
+	f, err := orDefaultFS(l.fs).Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr, done, err := openTar(f, tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	var ret []QueryMatch
+	blobs := tarBlobs{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return ret, &CorruptArchiveError{tarfile, err}
+		}
+		if isTarBlob(hdr.Name) {
+			if err := blobs.read(tarfile, hdr, tr); err != nil {
+				return ret, err
+			}
+			continue
+		}
+		format := strings.ToLower(strings.TrimPrefix(path.Ext(hdr.Name), "."))
+		if _, ok := l.parsers[format]; !ok || !filter.matchName(hdr.Name) {
+			continue
+		}
+		bs, ok := blobs.linked(hdr)
+		if !ok {
+			r, err := entryData(tarfile, hdr, tr)
+			if err != nil {
+				return ret, err
+			}
+			if bs, err = ioutil.ReadAll(r); err != nil {
+				return ret, &CorruptArchiveError{tarfile, err}
+			}
+		}
+		data, err := l.ParseStruct(bs, format)
+		if err != nil {
+			slog.Infof("Skipping %s in %s: %v", hdr.Name, tarfile, err)
+			continue
+		}
+		if matches := q.Eval(data); len(matches) > 0 {
+			ret = append(ret, QueryMatch{Name: hdr.Name, Matches: matches})
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// TarRepairReport describes what RepairTar did to an archive
+type TarRepairReport struct {
+	// Entries is the number of complete entries kept
+	Entries int
+	// Lost are the names of incomplete entries that were removed (a damaged header has no name)
+	Lost []string
+	// Truncated is the number of bytes removed from the archive, of the decompressed tar stream
+	// for compressed archives
+	Truncated int64
+	// Repaired is true if the archive was changed
+	Repaired bool
+}
+
+// RepairTar truncates a damaged tarfile (e.g. after a crash during WriteTar) back to the last complete entry
+func RepairTar(tarfile string) (*TarRepairReport, error) {
+	return RepairTarFS(fs, tarfile)
+}
+
+// RepairTarFS truncates a damaged tarfile on given (afero) filesystem back to the last complete entry,
+// compressed archives are rewritten with the complete entries
+func RepairTarFS(filesystem afero.Fs, tarfile string) (*TarRepairReport, error) {
+	filesystem = orDefaultFS(filesystem)
+	defer lockPath(filesystem, tarfile)()
+	f, funlock, err := openLocked(filesystem, tarfile, os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	defer funlock()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+	head := make([]byte, 6)
+	n, _ := io.ReadFull(f, head)
+	if c := DetectCompression(head[:n]); c != CompressNone {
+		report, tmpfile, err := rewriteCompressedTar(filesystem, tarfile, f, fi.Mode().Perm(), c)
+		if err != nil || tmpfile == "" {
+			return report, err
+		}
+		// renamed while holding the file lock, writers waiting for it reopen the repaired archive
+		if err := filesystem.Rename(tmpfile, tarfile); err != nil {
+			filesystem.Remove(tmpfile)
+			return nil, err
+		}
+		report.Repaired = true
+		return report, nil
+	}
+
+	end, entries, lost := scanTarEnd(f, size)
+	report := &TarRepairReport{Entries: entries, Lost: lost}
+	if tarTailClean(f, end, size) {
+		return report, nil
+	}
+	if err := f.Truncate(end); err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteAt(make([]byte, 2<<9), end); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	report.Truncated, report.Repaired = size-end, true
+	forgetTarIndex(filesystem, tarfile)
+	if err := rebuildTarIndex(filesystem, tarfile, f); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// scanTarEnd returns the end of the last complete entry of the uncompressed archive in f,
+// the number of complete entries and the name of an incomplete last entry
+func scanTarEnd(f afero.File, size int64) (end int64, entries int, lost []string) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, nil
+	}
+	cr := &countingReader{r: f}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return end, entries, lost
+		}
+		next := cr.pos + blockPadded(hdr.Size)
+		if next > size {
+			return end, entries, []string{hdr.Name}
+		}
+		end = next
+		entries++
+	}
+}
+
+// tarTailClean checks that f has (at least) the end of archive blocks and only zeros from end
+func tarTailClean(f afero.File, end, size int64) bool {
+	if size-end < 2<<9 {
+		return false
+	}
+	buf := make([]byte, 32*1024)
+	zero := make([]byte, len(buf))
+	for pos := end; pos < size; pos += int64(len(buf)) {
+		n, err := f.ReadAt(buf, pos)
+		if n == 0 && err != nil {
+			return false
+		}
+		if !bytes.Equal(buf[:n], zero[:n]) {
+			return false
+		}
+	}
+	return true
+}
+
+// tarAppendPos returns where the next entry of the uncompressed archive in f goes: after the last entry
+// of an up to date index, or after the last complete entry found by scanning. clean is false
+// if there is a partial entry or garbage after that position
+func tarAppendPos(filesystem afero.Fs, tarfile string, f afero.File, size int64) (pos int64, clean bool) {
+	if idx, err := loadTarIndex(filesystem, tarfile, f); err == nil && len(idx.entries) > 0 {
+		if end := idx.entries[len(idx.entries)-1].End; tarTailClean(f, end, size) {
+			return end, true
+		}
+	}
+	end, _, _ := scanTarEnd(f, size)
+	return end, tarTailClean(f, end, size)
+}
+
+// rewriteCompressedTar writes the complete entries of a compressed archive into a temporary file with mode
+// if reading fails, returns its name ("" if the archive is fine). The archive is read once to find the
+// complete entries and again to copy them, entry data is streamed
+func rewriteCompressedTar(filesystem afero.Fs, tarfile string, f afero.File, mode os.FileMode, c Compression) (*TarRepairReport, string, error) {
+	report, damaged, err := scanCompressedTar(f, tarfile)
+	if err != nil || !damaged {
+		return report, "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	tr, done, err := openTar(f, tarfile)
+	if err != nil {
+		return nil, "", err
+	}
+	defer done()
+
+	tmp, err := createTemp(filesystem, tarfile, mode)
+	if err != nil {
+		return nil, "", err
+	}
+	tmpfile := tmp.Name()
+	zw, err := compressWriter(tmp, c)
+	if err == nil {
+		tw := tar.NewWriter(zw)
+		for i := 0; i < report.Entries && err == nil; i++ {
+			var hdr *tar.Header
+			if hdr, err = tr.Next(); err != nil {
+				break
+			}
+			if err = tw.WriteHeader(hdr); err == nil {
+				_, err = io.Copy(tw, tr)
+			}
+		}
+		if err == nil {
+			err = tw.Flush()
+		}
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		filesystem.Remove(tmpfile)
+		return nil, "", fmt.Errorf("Error rewriting %s: %w", tarfile, err)
+	}
+	return report, tmpfile, nil
+}
+
+// scanCompressedTar reads the compressed archive in f, returns the number of complete entries, the name of
+// an incomplete one and the bytes of the decompressed stream after the last complete entry, damaged is false
+// if the archive reads to its end
+func scanCompressedTar(f afero.File, tarfile string) (report *TarRepairReport, damaged bool, err error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	report = &TarRepairReport{}
+	dr, done, err := decompressReader(f)
+	if err != nil {
+		// nothing can be decompressed, the archive is rewritten empty
+		return report, true, nil
+	}
+	defer done()
+	tarPos := &countingWriter{w: ioutil.Discard}
+	dr = io.TeeReader(dr, tarPos)
+	tr := tar.NewReader(dr)
+	var end int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return report, false, nil
+		}
+		if err != nil {
+			break
+		}
+		start := tarPos.pos
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			report.Lost = []string{hdr.Name}
+			break
+		}
+		end = start + blockPadded(hdr.Size)
+		report.Entries++
+	}
+	// the rest of the stream that can still be decompressed is dropped too
+	io.Copy(ioutil.Discard, dr)
+	if tarPos.pos > end {
+		report.Truncated = tarPos.pos - end
+	}
+	return report, true, nil
+}
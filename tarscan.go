@@ -0,0 +1,206 @@
+package filehelper
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// ScanFunc processes the data of an archive entry for ScanTars, a nil value leaves the entry out of the results.
+// It is called from several goroutines at once
+type ScanFunc func(archive, name string, data []byte) (interface{}, error)
+
+// ScanOptions sets the concurrency of ScanTars
+type ScanOptions struct {
+	// Workers is the number of goroutines calling the ScanFunc, GOMAXPROCS if zero
+	Workers int
+	// Archives is the number of archives read (and decompressed) at once, Workers if zero
+	Archives int
+	// Names are path.Match globs of entry names to scan, all if empty
+	Names []string
+}
+
+// ScanResult is a value returned by the ScanFunc
+type ScanResult struct {
+	Archive string
+	Name    string
+	Value   interface{}
+}
+
+type scanJob struct {
+	archive, entry int
+	name           string
+	data           []byte
+	// encrypted entries are decrypted by the workers
+	keyID     string
+	encrypted bool
+}
+
+type scanOrder struct {
+	archive, entry int
+	result         ScanResult
+}
+
+// ScanTars calls fn with each entry of the archives in parallel, see ScanTarsFS
+func ScanTars(archives []string, opts ScanOptions, fn ScanFunc) ([]ScanResult, error) {
+	return ScanTarsFS(fs, archives, opts, fn)
+}
+
+// ScanTarsFS reads the entries of the archives on given (afero) filesystem, each archive sequentially but
+// several archives at once, and calls fn with them (decrypted) on a bounded pool of workers. Results are in the order
+// of archives and entries, regardless of which worker finished first. Stops at the first error.
+// Deduplicated payloads are kept in memory while reading their archive
+func ScanTarsFS(filesystem afero.Fs, archives []string, opts ScanOptions, fn ScanFunc) ([]ScanResult, error) {
+	filesystem = orDefaultFS(filesystem)
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	readers := opts.Archives
+	if readers <= 0 {
+		readers = workers
+	}
+	if readers > len(archives) {
+		readers = len(archives)
+	}
+	filter := SearchOptions{Names: opts.Names}
+
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		stopOnce.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+
+	// entries read ahead are bounded by the job queue, so memory use doesn't grow with the archives
+	jobs := make(chan scanJob, workers)
+	var mu sync.Mutex
+	var results []scanOrder
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				archive := archives[job.archive]
+				data := job.data
+				if job.encrypted {
+					var err error
+					if data, err = decryptEntry(job.name, job.keyID, data); err != nil {
+						fail(fmt.Errorf("%s: %w", archive, err))
+						continue
+					}
+				}
+				v, err := fn(archive, job.name, data)
+				if err != nil {
+					fail(fmt.Errorf("%s in %s: %w", job.name, archive, err))
+					continue
+				}
+				if v != nil {
+					mu.Lock()
+					results = append(results, scanOrder{job.archive, job.entry, ScanResult{archive, job.name, v}})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	next := make(chan int)
+	var rwg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		rwg.Add(1)
+		go func() {
+			defer rwg.Done()
+			for a := range next {
+				if err := scanTar(filesystem, archives[a], a, filter, jobs, stop); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+feed:
+	for a := range archives {
+		select {
+		case next <- a:
+		case <-stop:
+			break feed
+		}
+	}
+	close(next)
+	rwg.Wait()
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].archive != results[j].archive {
+			return results[i].archive < results[j].archive
+		}
+		return results[i].entry < results[j].entry
+	})
+	ret := make([]ScanResult, len(results))
+	for i, r := range results {
+		ret[i] = r.result
+	}
+	return ret, nil
+}
+
+// scanTar sends the entries of tarfile to jobs until stopped
+func scanTar(filesystem afero.Fs, tarfile string, archive int, filter SearchOptions, jobs chan<- scanJob, stop <-chan struct{}) error {
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr, done, err := openTar(f, tarfile)
+	if err != nil {
+		return err
+	}
+	defer done()
+	blobs := tarBlobs{}
+	for entry := 0; ; entry++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &CorruptArchiveError{tarfile, err}
+		}
+		if isTarBlob(hdr.Name) {
+			if err := blobs.read(tarfile, hdr, tr); err != nil {
+				return err
+			}
+			continue
+		}
+		if !filter.matchName(hdr.Name) {
+			continue
+		}
+		data, ok := blobs.linked(hdr)
+		if !ok {
+			if data, err = ioutil.ReadAll(tr); err != nil {
+				return &CorruptArchiveError{tarfile, err}
+			}
+		}
+		job := scanJob{archive: archive, entry: entry, name: hdr.Name, data: data}
+		job.keyID, job.encrypted = tarEncryption(hdr)
+		select {
+		case jobs <- job:
+		case <-stop:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/spf13/afero"
+)
+
+// SearchOptions sets what SearchTar looks for
+type SearchOptions struct {
+	// Pattern is a regular expression (RE2 syntax) matched against each line
+	Pattern string
+	// Literal matches Pattern as plain text
+	Literal bool
+	// IgnoreCase matches case-insensitively
+	IgnoreCase bool
+	// Context is the number of lines returned before and after each matching line
+	Context int
+	// Names are path.Match globs of entry names to search, all if empty
+	Names []string
+}
+
+// searchLineSize is the most bytes of a line SearchTar holds, longer lines are matched in parts
+// and cut in the results
+const searchLineSize = 64 * 1024
+
+// SearchMatch is a matching line of an archive entry, lines longer than 64 KiB are cut (around the match)
+type SearchMatch struct {
+	Name string
+	// Line is the line number, starting from 1
+	Line int
+	Text string
+	// Before and After are up to Context lines around the match
+	Before []string
+	After  []string
+}
+
+// regexp returns the compiled pattern of o
+func (o SearchOptions) regexp() (*regexp.Regexp, error) {
+	pattern := o.Pattern
+	if o.Literal {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if o.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("search pattern: %w", err)
+	}
+	return re, nil
+}
+
+// matchName reports if name should be searched
+func (o SearchOptions) matchName(name string) bool {
+	if len(o.Names) == 0 {
+		return true
+	}
+	for _, pattern := range o.Names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchTar returns all lines matching opts in the entries of tarfile, see SearchTarFS
+func SearchTar(tarfile string, opts SearchOptions) ([]SearchMatch, error) {
+	return SearchTarFS(fs, tarfile, opts)
+}
+
+// SearchTarFS returns all lines matching opts in the latest version of the entries of tarfile on given (afero)
+// filesystem, in archive and line order. Entries are read line by line, not loaded into memory
+func SearchTarFS(filesystem afero.Fs, tarfile string, opts SearchOptions) ([]SearchMatch, error) {
+	re, err := opts.regexp()
+	if err != nil {
+		return nil, err
+	}
+	f, err := orDefaultFS(filesystem).Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr, done, err := openTar(f, tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	// matches of the latest entry of each name, replaced versions are dropped as ReadTar doesn't return them,
+	// deduplicated payloads are kept under their own name for the entries linking to them
+	matches := map[string][]SearchMatch{}
+	latest := map[string]int{}
+	for n := 0; ; n++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return searchResults(matches, latest), &CorruptArchiveError{tarfile, err}
+		}
+		blob := isTarBlob(hdr.Name)
+		if !blob && !opts.matchName(hdr.Name) {
+			continue
+		}
+		latest[hdr.Name] = n
+		if hdr.Typeflag == tar.TypeLink {
+			// hard links match with the content their target had when they were written
+			linked := make([]SearchMatch, 0, len(matches[hdr.Linkname]))
+			for _, m := range matches[hdr.Linkname] {
+				m.Name = hdr.Name
+				linked = append(linked, m)
+			}
+			matches[hdr.Name] = linked
+			continue
+		}
+		r, err := entryData(tarfile, hdr, tr)
+		if err != nil {
+			return searchResults(matches, latest), err
+		}
+		if matches[hdr.Name], err = searchLines(hdr.Name, r, re, opts.Context); err != nil {
+			return searchResults(matches, latest), &CorruptArchiveError{tarfile, err}
+		}
+	}
+	return searchResults(matches, latest), nil
+}
+
+// searchResults returns the matches of the names in the order of their latest entry, without payload entries
+func searchResults(matches map[string][]SearchMatch, latest map[string]int) []SearchMatch {
+	var names []string
+	for name := range matches {
+		if !isTarBlob(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return latest[names[i]] < latest[names[j]]
+	})
+	var ret []SearchMatch
+	for _, name := range names {
+		ret = append(ret, matches[name]...)
+	}
+	return ret
+}
+
+// searchLines returns the lines of r matching re with context lines around them
+func searchLines(name string, r io.Reader, re *regexp.Regexp, context int) ([]SearchMatch, error) {
+	br := bufio.NewReaderSize(r, searchLineSize)
+	var ret []SearchMatch
+	var before []string
+	// pending are the matches still collecting After lines
+	var pending []int
+	for line := 1; ; line++ {
+		text, matched, err := readLine(br, re)
+		if err == io.EOF {
+			return ret, nil
+		}
+		if err != nil {
+			return ret, err
+		}
+		open := pending[:0]
+		for _, i := range pending {
+			ret[i].After = append(ret[i].After, text)
+			if len(ret[i].After) < context {
+				open = append(open, i)
+			}
+		}
+		pending = open
+		if matched {
+			m := SearchMatch{Name: name, Line: line, Text: text}
+			if len(before) > 0 {
+				m.Before = append([]string{}, before...)
+			}
+			ret = append(ret, m)
+			if context > 0 {
+				pending = append(pending, len(ret)-1)
+			}
+		}
+		if context > 0 {
+			if before = append(before, text); len(before) > context {
+				before = before[1:]
+			}
+		}
+	}
+}
+
+// readLine reads the next line of br and matches it with re, long lines in windows of two buffers.
+// Returns the line cut to searchLineSize bytes, around the match if there is one, io.EOF after the last line
+func readLine(br *bufio.Reader, re *regexp.Regexp) (string, bool, error) {
+	var head, prev []byte
+	text, matched := "", false
+	for {
+		frag, isPrefix, err := br.ReadLine()
+		if err != nil {
+			if err == io.EOF && head != nil {
+				break
+			}
+			return "", false, err
+		}
+		if head == nil {
+			head = append([]byte{}, frag...)
+		}
+		if !matched {
+			window := append(prev, frag...)
+			if loc := re.FindIndex(window); loc != nil {
+				text, matched = clipLine(window, loc), true
+			}
+			prev = append(prev[:0], frag...)
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if !matched {
+		text = string(head)
+	}
+	return text, matched, nil
+}
+
+// clipLine returns up to searchLineSize bytes of line around the match at loc
+func clipLine(line []byte, loc []int) string {
+	if len(line) <= searchLineSize {
+		return string(line)
+	}
+	start := loc[0] - (searchLineSize-(loc[1]-loc[0]))/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + searchLineSize
+	if end > len(line) {
+		end, start = len(line), len(line)-searchLineSize
+	}
+	return string(line[start:end])
+}
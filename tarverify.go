@@ -0,0 +1,272 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// TarManifestSuffix is added to the archive name for its detached manifest, see WriteTarManifest
+const TarManifestSuffix = ".manifest.json"
+
+// TarManifest is the detached manifest of an archive: checksums of the whole file and of each regular file entry
+type TarManifest struct {
+	Archive string             `json:"archive"`
+	Size    int64              `json:"size"`
+	SHA256  string             `json:"sha256"`
+	Created time.Time          `json:"created"`
+	Entries []TarManifestEntry `json:"entries"`
+}
+
+// TarManifestEntry is the checksum of an entry in TarManifest
+type TarManifestEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// TarVerifyReport describes the result of VerifyTar
+type TarVerifyReport struct {
+	// Entries is the number of entries read
+	Entries int
+	// Verified is the number of regular files matching all their recorded checksums
+	Verified int
+	// Unchecked are regular files without a checksum record or manifest entry (e.g. written by other tools)
+	Unchecked []string
+	// Mismatched are regular files with data not matching a recorded checksum
+	Mismatched []string
+	// Missing are manifest entries not found in the archive
+	Missing []string
+	// Unexpected are regular files not in the manifest
+	Unexpected []string
+	// Truncated is true if the archive ends early (for uncompressed archives also at an entry boundary,
+	// without the end-of-archive blocks) or a header is damaged, the entries up to there are checked
+	Truncated bool
+	// ArchiveMismatch is true if the archive file doesn't match the size and checksum in the manifest
+	ArchiveMismatch bool
+	// Manifest is true if a detached manifest was checked
+	Manifest bool
+}
+
+// OK reports if nothing was found altered, unchecked entries are allowed
+func (r *TarVerifyReport) OK() bool {
+	return !r.Truncated && !r.ArchiveMismatch && len(r.Mismatched) == 0 && len(r.Missing) == 0 && len(r.Unexpected) == 0
+}
+
+// versionKey identifies the n-th entry with the same name
+func versionKey(name string, n int) string {
+	return fmt.Sprintf("%s\x00%d", name, n)
+}
+
+// WriteTarManifest writes the detached manifest of tarfile, see WriteTarManifestFS
+func WriteTarManifest(tarfile string) (*TarManifest, error) {
+	return WriteTarManifestFS(fs, tarfile)
+}
+
+// WriteTarManifestFS checksums tarfile on given (afero) filesystem and its entries, and writes them
+// next to it (tarfile + TarManifestSuffix) for VerifyTar. The manifest has to be rewritten after appends
+func WriteTarManifestFS(filesystem afero.Fs, tarfile string) (*TarManifest, error) {
+	filesystem = orDefaultFS(filesystem)
+	defer lockPath(filesystem, tarfile)()
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	funlock, err := flockFile(f)
+	if err != nil {
+		return nil, err
+	}
+	defer funlock()
+	return writeTarManifest(filesystem, tarfile, f)
+}
+
+// writeTarManifest writes the manifest of the opened tarfile, the caller holds the archive locks
+func writeTarManifest(filesystem afero.Fs, tarfile string, f afero.File) (*TarManifest, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	cw := &countingWriter{w: h}
+	r := io.TeeReader(f, cw)
+	tr, done, err := openTar(r, tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	manifest := &TarManifest{Archive: filepath.Base(tarfile), Created: time.Now().UTC().Truncate(time.Second)}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &CorruptArchiveError{tarfile, err}
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		eh := sha256.New()
+		if _, err := io.Copy(eh, tr); err != nil {
+			return nil, &CorruptArchiveError{tarfile, err}
+		}
+		manifest.Entries = append(manifest.Entries, TarManifestEntry{hdr.Name, hdr.Size, hex.EncodeToString(eh.Sum(nil))})
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return nil, err
+	}
+	manifest.Size, manifest.SHA256 = cw.pos, hex.EncodeToString(h.Sum(nil))
+
+	bs, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tmpfile := tarfile + TarManifestSuffix + ".tmp"
+	if err := afero.WriteFile(filesystem, tmpfile, bs, 0644); err != nil {
+		return nil, err
+	}
+	if err := filesystem.Rename(tmpfile, tarfile+TarManifestSuffix); err != nil {
+		filesystem.Remove(tmpfile)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ReadTarManifest returns the detached manifest of tarfile, see ReadTarManifestFS
+func ReadTarManifest(tarfile string) (*TarManifest, error) {
+	return ReadTarManifestFS(fs, tarfile)
+}
+
+// ReadTarManifestFS returns the detached manifest of tarfile on given (afero) filesystem
+func ReadTarManifestFS(filesystem afero.Fs, tarfile string) (*TarManifest, error) {
+	bs, err := afero.ReadFile(orDefaultFS(filesystem), tarfile+TarManifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &TarManifest{}
+	if err := json.Unmarshal(bs, manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", tarfile+TarManifestSuffix, err)
+	}
+	return manifest, nil
+}
+
+// VerifyTar recomputes the checksums of tarfile, see VerifyTarFS
+func VerifyTar(tarfile string) (*TarVerifyReport, error) {
+	return VerifyTarFS(fs, tarfile)
+}
+
+// VerifyTarFS recomputes the checksums of the entries of tarfile on given (afero) filesystem and compares them
+// with the ones recorded by WriteTar (PAX records) and, if there is one, the detached manifest.
+// Problems found are in the report, the error is for failing to read the archive or manifest
+func VerifyTarFS(filesystem afero.Fs, tarfile string) (*TarVerifyReport, error) {
+	filesystem = orDefaultFS(filesystem)
+	report := &TarVerifyReport{}
+	manifest, err := ReadTarManifestFS(filesystem, tarfile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	expected := map[string]TarManifestEntry{}
+	if manifest != nil {
+		report.Manifest = true
+		seen := map[string]int{}
+		for _, e := range manifest.Entries {
+			expected[versionKey(e.Name, seen[e.Name])] = e
+			seen[e.Name]++
+		}
+	}
+
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	cw := &countingWriter{w: h}
+	r := io.TeeReader(f, cw)
+	head := make([]byte, 6)
+	n, _ := f.ReadAt(head, 0)
+	compressed := DetectCompression(head[:n]) != CompressNone
+	dr, done, err := decompressReader(r)
+	if err != nil {
+		return nil, &CorruptArchiveError{tarfile, err}
+	}
+	defer done()
+	// the tar stream is counted to tell the end-of-archive blocks from a stream cut at an entry boundary,
+	// tar returns io.EOF for both. Compressed archives are appended without them, cuts fail decompressing
+	tarPos := &countingWriter{w: ioutil.Discard}
+	tr := tar.NewReader(io.TeeReader(dr, tarPos))
+	seen := map[string]int{}
+	for {
+		start := tarPos.pos
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			// the entry data is read up to its padding (less than a block), the two zero blocks have to follow
+			report.Truncated = !compressed && tarPos.pos > 0 && tarPos.pos-start < 2<<9
+			break
+		}
+		if err != nil {
+			report.Truncated = true
+			break
+		}
+		report.Entries++
+		if hdr.Typeflag != tar.TypeReg {
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				report.Truncated = true
+				break
+			}
+			continue
+		}
+		key := versionKey(hdr.Name, seen[hdr.Name])
+		seen[hdr.Name]++
+		eh := sha256.New()
+		if _, err := io.Copy(eh, tr); err != nil {
+			delete(expected, key)
+			report.Truncated = true
+			report.Mismatched = append(report.Mismatched, hdr.Name)
+			break
+		}
+		sum := hex.EncodeToString(eh.Sum(nil))
+		recorded, checked := hdr.PAXRecords[TarChecksumRecord]
+		ok := !checked || recorded == sum
+		if e, found := expected[key]; found {
+			delete(expected, key)
+			checked = true
+			ok = ok && e.SHA256 == sum && e.Size == hdr.Size
+		} else if manifest != nil {
+			report.Unexpected = append(report.Unexpected, hdr.Name)
+		}
+		switch {
+		case !ok:
+			report.Mismatched = append(report.Mismatched, hdr.Name)
+		case checked:
+			report.Verified++
+		default:
+			report.Unchecked = append(report.Unchecked, hdr.Name)
+		}
+	}
+	if manifest == nil {
+		return report, nil
+	}
+	listed := map[string]int{}
+	for _, e := range manifest.Entries {
+		if _, missing := expected[versionKey(e.Name, listed[e.Name])]; missing {
+			report.Missing = append(report.Missing, e.Name)
+		}
+		listed[e.Name]++
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		report.Truncated = true
+	}
+	report.ArchiveMismatch = cw.pos != manifest.Size || hex.EncodeToString(h.Sum(nil)) != manifest.SHA256
+	return report, nil
+}
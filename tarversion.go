@@ -0,0 +1,143 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// TarVersion is one of the entries written with the same name, see TarHistory
+type TarVersion struct {
+	TarEntry
+	// Version is the number of earlier entries with the same name, 0 for the first one
+	Version int
+}
+
+// TarHistory returns the versions of filename in tarfile, oldest first
+func TarHistory(tarfile, filename string) ([]TarVersion, error) {
+	return TarHistoryFS(fs, tarfile, filename)
+}
+
+// TarHistoryFS returns the versions of filename in tarfile on given (afero) filesystem, oldest first,
+// the error wraps ErrNotInArchive if there is none
+func TarHistoryFS(filesystem afero.Fs, tarfile, filename string) ([]TarVersion, error) {
+	entries, err := ListTarEntriesFS(filesystem, tarfile)
+	if err != nil {
+		return nil, err
+	}
+	var ret []TarVersion
+	for _, e := range entries {
+		if e.Name == filename {
+			ret = append(ret, TarVersion{TarEntry: e, Version: len(ret)})
+		}
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("%s in %s: %w", filename, tarfile, ErrNotInArchive)
+	}
+	return ret, nil
+}
+
+// ReadTarVersion reads a version of filename from tarfile, see ReadTarVersionFS
+func ReadTarVersion(tarfile, filename string, version int) ([]byte, error) {
+	return ReadTarVersionFS(fs, tarfile, filename, version)
+}
+
+// ReadTarVersionFS reads a version of filename from tarfile on given (afero) filesystem: 0 is the first one,
+// negative versions count back from the latest (-1), hard links return the content their target had when
+// the link was written.
+// The error wraps ErrNotInArchive if there is no such version
+func ReadTarVersionFS(filesystem afero.Fs, tarfile, filename string, version int) ([]byte, error) {
+	filesystem = orDefaultFS(filesystem)
+	if version < 0 {
+		history, err := TarHistoryFS(filesystem, tarfile, filename)
+		if err != nil {
+			return nil, err
+		}
+		version += len(history)
+	}
+	notFound := fmt.Errorf("version %d of %s in %s: %w", version, filename, tarfile, ErrNotInArchive)
+	if version < 0 {
+		return nil, notFound
+	}
+	f, err := filesystem.Open(tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if idx, err := loadTarIndex(filesystem, tarfile, f); err == nil {
+		versions := idx.byName[filename]
+		if version >= len(versions) {
+			return nil, notFound
+		}
+		e := idx.entries[versions[version]]
+		if e.Link != "" {
+			return readTar(filesystem, tarfile, e.Link, versions[version])
+		}
+		// a stale index is found by the checksum, the archive is scanned then
+		if bs, err := readTarIndexEntry(f, tarfile, e); !errors.Is(err, ErrNoTarIndex) {
+			return bs, err
+		}
+	}
+
+	tarReader, done, err := openTar(f, tarfile)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	for n, pos := 0, 0; ; pos++ {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, notFound
+		}
+		if err != nil {
+			return nil, &CorruptArchiveError{tarfile, err}
+		}
+		if header.Name != filename {
+			continue
+		}
+		if n == version {
+			if header.Typeflag == tar.TypeLink {
+				return readTar(filesystem, tarfile, header.Linkname, pos)
+			}
+			r, err := entryData(tarfile, header, tarReader)
+			if err != nil {
+				return nil, err
+			}
+			bs, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, &CorruptArchiveError{tarfile, err}
+			}
+			return bs, nil
+		}
+		n++
+	}
+}
+
+// ReadTarAt reads the version of filename from tarfile that was current at given time, see ReadTarAtFS
+func ReadTarAt(tarfile, filename string, at time.Time) ([]byte, error) {
+	return ReadTarAtFS(fs, tarfile, filename, at)
+}
+
+// ReadTarAtFS reads the latest version of filename from tarfile on given (afero) filesystem with a modification
+// time (stored in seconds) not after at. The error wraps ErrNotInArchive if all versions are newer
+func ReadTarAtFS(filesystem afero.Fs, tarfile, filename string, at time.Time) ([]byte, error) {
+	history, err := TarHistoryFS(filesystem, tarfile, filename)
+	if err != nil {
+		return nil, err
+	}
+	version := -1
+	for _, v := range history {
+		if !v.ModTime.After(at) {
+			version = v.Version
+		}
+	}
+	if version < 0 {
+		return nil, fmt.Errorf("%s in %s at %s: %w", filename, tarfile, at.Format(time.RFC3339), ErrNotInArchive)
+	}
+	return ReadTarVersionFS(filesystem, tarfile, filename, version)
+}
@@ -0,0 +1,383 @@
+package filehelper
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shoobyban/slog"
+	"github.com/spf13/afero"
+)
+
+// TarWriter appends entries to a tar archive, keeping it open and locked (in-process mutex per path
+// and advisory file lock) until Close. Compressed archives (by content, or by extension for new files)
+// get one new compressed member per TarWriter holding the entries without the end of archive blocks,
+// which readers here handle
+type TarWriter struct {
+	// Dedup stores each distinct payload once, see TarBlobPrefix
+	Dedup bool
+
+	fs          afero.Fs
+	name        string
+	f           afero.File
+	cw          *countingWriter
+	zw          io.WriteCloser
+	tw          *tar.Writer
+	compression Compression
+	headerPos   int64
+	index       []TarIndexEntry
+	unlock      func()
+	// blobs are the payloads in the archive, loaded by the first deduplicated write
+	blobs map[string]bool
+}
+
+// countingWriter tracks the position of writes to w
+type countingWriter struct {
+	w   io.Writer
+	pos int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// pathLocks serialises writers of the same archive path in this process
+var pathLocks = struct {
+	sync.Mutex
+	m map[string]*pathLock
+}{m: map[string]*pathLock{}}
+
+// lockPath locks name on filesystem for this process, returns the unlock function.
+// Names are keyed by their real path, so views of the same file through a base path share the lock
+func lockPath(filesystem afero.Fs, name string) func() {
+	if bp, ok := filesystem.(*afero.BasePathFs); ok {
+		if realName, err := bp.RealPath(name); err == nil {
+			name = realName
+		}
+	}
+	key, err := filepath.Abs(name)
+	if err != nil {
+		key = filepath.Clean(name)
+	}
+	pathLocks.Lock()
+	l := pathLocks.m[key]
+	if l == nil {
+		l = &pathLock{}
+		pathLocks.m[key] = l
+	}
+	l.refs++
+	pathLocks.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		pathLocks.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(pathLocks.m, key)
+		}
+		pathLocks.Unlock()
+	}
+}
+
+// openLocked opens name with flag and takes its file lock, reopening it if the file was replaced
+// (renamed over or moved away by a rewrite) while waiting for the lock
+func openLocked(filesystem afero.Fs, name string, flag int) (afero.File, func(), error) {
+	for {
+		f, err := filesystem.OpenFile(name, flag, os.ModePerm)
+		if err != nil {
+			return nil, nil, err
+		}
+		funlock, err := flockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		if isCurrent(filesystem, name, f) {
+			return f, funlock, nil
+		}
+		funlock()
+		f.Close()
+	}
+}
+
+// osFile returns the OS file behind f, unwrapping the files of base path filesystems
+func osFile(f afero.File) (*os.File, bool) {
+	for {
+		switch v := f.(type) {
+		case *os.File:
+			return v, true
+		case *afero.BasePathFile:
+			f = v.File
+		default:
+			return nil, false
+		}
+	}
+}
+
+// isCurrent reports if the opened f is still the file at name, only OS files can be compared
+func isCurrent(filesystem afero.Fs, name string, f afero.File) bool {
+	if _, ok := osFile(f); !ok {
+		return true
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return true
+	}
+	cur, err := filesystem.Stat(name)
+	return err == nil && os.SameFile(fi, cur)
+}
+
+// createTemp creates a uniquely named file with mode next to name, for replacing name by a rename
+func createTemp(filesystem afero.Fs, name string, mode os.FileMode) (afero.File, error) {
+	tmp, err := afero.TempFile(filesystem, filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := filesystem.Chmod(tmp.Name(), mode); err != nil {
+		tmp.Close()
+		filesystem.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// NewTarWriter opens datafile for appending entries, see TarWriter
+func NewTarWriter(datafile string) (*TarWriter, error) {
+	return NewTarWriterFS(fs, datafile)
+}
+
+// NewTarWriterFS opens datafile on given (afero) filesystem for appending entries, see TarWriter
+func NewTarWriterFS(filesystem afero.Fs, datafile string) (*TarWriter, error) {
+	filesystem = orDefaultFS(filesystem)
+	unlock := lockPath(filesystem, datafile)
+	f, funlock, err := openLocked(filesystem, datafile, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	w := &TarWriter{fs: filesystem, name: datafile, f: f, unlock: func() {
+		funlock()
+		unlock()
+	}}
+	if err := w.seek(); err != nil {
+		w.abort()
+		return nil, err
+	}
+	w.cw = &countingWriter{w: f, pos: w.headerPos}
+	if w.compression == CompressNone {
+		w.tw = tar.NewWriter(w.cw)
+	}
+	return w, nil
+}
+
+// seek detects the compression and moves to the append position, which is after the last complete entry
+// even if a previous append was interrupted
+func (w *TarWriter) seek() error {
+	fi, err := w.f.Stat()
+	if err != nil {
+		return err
+	}
+	w.compression = CompressionFromName(w.name)
+	if fi.Size() > 0 {
+		head := make([]byte, 6)
+		n, _ := io.ReadFull(w.f, head)
+		w.compression = DetectCompression(head[:n])
+	}
+	switch {
+	case w.compression == CompressBzip2:
+		return fmt.Errorf("writing %s compressed archives is not supported", w.compression)
+	case w.compression != CompressNone:
+		_, err = w.f.Seek(0, io.SeekEnd)
+		return err
+	case fi.Size() == 0:
+		return nil
+	}
+	pos, clean := tarAppendPos(w.fs, w.name, w.f, fi.Size())
+	if !clean {
+		slog.Infof("Recovering damaged tar %s, dropping %d bytes after the last complete entry", w.name, fi.Size()-pos)
+		if err := w.f.Truncate(pos); err != nil {
+			return err
+		}
+	}
+	w.headerPos, err = w.f.Seek(pos, io.SeekStart)
+	return err
+}
+
+// Write appends filename with buf data
+func (w *TarWriter) Write(filename string, buf []byte) error {
+	return w.WriteEntry(TarEntry{Name: filename}, buf)
+}
+
+// WriteEntry appends an entry with the header fields of e and buf data
+func (w *TarWriter) WriteEntry(e TarEntry, buf []byte) error {
+	if err := e.checkRecords(); err != nil {
+		return err
+	}
+	if w.Dedup && !e.Encrypt && (e.Type == 0 || e.Type == tar.TypeReg) {
+		return w.writeDedup(e, buf)
+	}
+	hdr := e.header()
+	if e.Encrypt && hdr.Typeflag == tar.TypeReg {
+		var err error
+		if buf, err = encryptEntry(hdr.Name, e.KeyID, buf); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		hdr.Size = int64(len(buf))
+	}
+	return w.writeHeader(hdr, bytes.NewReader(buf))
+}
+
+// writeHeader appends hdr with hdr.Size bytes from r, regular files get their checksum recorded
+// in a PAX record, which needs the data hashed before the header is written.
+// Access and change times are dropped, they would force PAX or GNU headers for every entry
+func (w *TarWriter) writeHeader(hdr *tar.Header, r io.Reader) error {
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	if w.f == nil {
+		return fmt.Errorf("tar writer for %s is closed", w.name)
+	}
+	var sum string
+	if hdr.Typeflag == tar.TypeReg {
+		var err error
+		if sum, r, err = checksumData(r, hdr.Size); err != nil {
+			return fmt.Errorf("Error reading %s: %w", hdr.Name, err)
+		}
+		records := map[string]string{}
+		for k, v := range hdr.PAXRecords {
+			records[k] = v
+		}
+		// the computed checksum always wins, VerifyTar trusts it
+		records[TarChecksumRecord] = sum
+		hdr.PAXRecords, hdr.Format = records, tar.FormatPAX
+	}
+	if w.tw == nil {
+		zw, err := compressWriter(w.f, w.compression)
+		if err != nil {
+			return err
+		}
+		w.zw, w.tw = zw, tar.NewWriter(zw)
+	}
+	slog.Infof("Writing %s %d", hdr.Name, hdr.Size)
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("Error writing tar header: %w", err)
+	}
+	offset := w.cw.pos
+	if _, err := io.Copy(w.tw, r); err != nil {
+		return fmt.Errorf("Error writing tar data: %w", err)
+	}
+	if w.compression == CompressNone {
+		e := TarIndexEntry{
+			Name:    hdr.Name,
+			Offset:  offset,
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			Mode:    hdr.Mode,
+			SHA256:  sum,
+			End:     offset + blockPadded(hdr.Size),
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			e.Type = string(hdr.Typeflag)
+			e.SHA256 = emptySHA256
+		}
+		// deduplicated links record the checksum of their payload
+		if sum := hdr.PAXRecords[TarChecksumRecord]; sum != "" {
+			e.SHA256 = sum
+		}
+		e.Key, e.Encrypted = tarEncryption(hdr)
+		if hdr.Typeflag == tar.TypeLink {
+			e.Link = hdr.Linkname
+		}
+		w.index = append(w.index, e)
+	}
+	return nil
+}
+
+// emptySHA256 is the checksum of no data
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// checksumData returns the hex SHA-256 of size bytes from r and a reader of the same data,
+// seeking back if r can, reading it into memory otherwise
+func checksumData(r io.Reader, size int64) (string, io.Reader, error) {
+	h := sha256.New()
+	if rs, ok := r.(io.ReadSeeker); ok {
+		start, err := rs.Seek(0, io.SeekCurrent)
+		if err == nil {
+			if _, err := io.CopyN(h, rs, size); err != nil {
+				return "", nil, err
+			}
+			if _, err := rs.Seek(start, io.SeekStart); err != nil {
+				return "", nil, err
+			}
+			return hex.EncodeToString(h.Sum(nil)), io.LimitReader(rs, size), nil
+		}
+	}
+	bs, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return "", nil, err
+	}
+	if int64(len(bs)) < size {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	h.Write(bs)
+	return hex.EncodeToString(h.Sum(nil)), bytes.NewReader(bs), nil
+}
+
+// Close syncs the entries, finishes the archive, updates its index and releases the locks
+func (w *TarWriter) Close() error {
+	if w.f == nil {
+		return nil
+	}
+	defer w.abort()
+	if w.zw != nil {
+		if err := w.tw.Flush(); err != nil {
+			return fmt.Errorf("Error closing tar: %w", err)
+		}
+		if err := w.zw.Close(); err != nil {
+			return fmt.Errorf("Error closing %s stream: %w", w.compression, err)
+		}
+		return w.f.Sync()
+	}
+	if w.tw == nil {
+		return nil
+	}
+	// entries are synced before the end of archive blocks are written, so a crash leaves complete entries
+	if err := w.tw.Flush(); err != nil {
+		return fmt.Errorf("Error closing tar: %w", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	if err := w.tw.Close(); err != nil {
+		return fmt.Errorf("Error closing tar: %w", err)
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	updateTarIndex(w.fs, w.name, w.f, w.headerPos, w.index...)
+	return nil
+}
+
+// abort closes the file and releases the locks without finishing the archive
+func (w *TarWriter) abort() {
+	if w.f == nil {
+		return
+	}
+	w.f.Close()
+	w.f = nil
+	w.unlock()
+}
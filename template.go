@@ -5,9 +5,7 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/url"
-	"os"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -46,6 +44,8 @@ var fmap = template.FuncMap{
 	"toLower":         strings.ToLower,
 	"lower":           strings.ToLower,
 	"filter":          filterPath,
+	"query":           Query,          // query . "$.items[?(@.price > 10)].sku" => all matches
+	"queryOne":        QueryOne,       // queryOne . "items[sku=ABC].price" => first match
 	"concat":          concat,         // concat "a" "b" => "ab"
 	"empty":           empty,          // empty [] => "", ["bah"] => "bah"
 	"int":             toint,          // int "0123" => 123
@@ -69,12 +69,15 @@ var fmap = template.FuncMap{
 	"xml_decode":      xmlDecode,
 	"xml_encode":      xmlEncode,
 	"xml_array":       xmlArray,
+	"xml_marshal":     xmlMarshal, // xml_marshal . "root=products" "item=product" "indent=  " "order=sku,name" "cdata=desc" "header"
 	"in_array":        inArray,
 	"timeformat":      timeFormat,
 	"timeformatminus": timeFormatMinus,
 	"unique":          unique,
 	"setItem":         setItem,
 	"createMap":       createMap,
+	"merge":           mergeLayers,      // merge $base $overlay ... => deep merged map, overlay wins
+	"mergeByKey":      mergeLayersByKey, // mergeByKey "sku" $base $overlay ... => slice items merged by sku
 	"mkSlice":         mkSlice,
 	"escape":          escape,
 	"seq":             seq,
@@ -85,8 +88,6 @@ var fmap = template.FuncMap{
 	"json_escape":     JsonEscape,
 }
 
-var fs afero.Fs
-
 type variable struct {
 	Value interface{}
 }
@@ -775,30 +776,14 @@ func Template(str string, data interface{}) (string, error) {
 	return "", err
 }
 
-// RegisterFS (afero) virtual filesystem for ProcessTemplateFile
-func RegisterFS(filesystem afero.Fs) {
-	fs = filesystem
-}
-
 // ProcessTemplateFile processes golang template file
 func ProcessTemplateFile(template string, bundle interface{}) ([]byte, error) {
-	var byteValue []byte
-	var err error
-	if fs == nil {
-		tf, err := os.Open(template)
-		if err != nil {
-			return nil, err
-		}
-		defer tf.Close()
-		byteValue, err = ioutil.ReadAll(tf)
-	} else {
-		tf, err := fs.Open(template)
-		if err != nil {
-			return nil, err
-		}
-		byteValue, err = ioutil.ReadAll(tf)
-		defer tf.Close()
-	}
+	return ProcessTemplateFileFS(fs, template, bundle)
+}
+
+// ProcessTemplateFileFS processes golang template file from given (afero) filesystem
+func ProcessTemplateFileFS(filesystem afero.Fs, template string, bundle interface{}) ([]byte, error) {
+	byteValue, err := afero.ReadFile(orDefaultFS(filesystem), template)
 	if err != nil {
 		return nil, err
 	}
@@ -811,13 +796,16 @@ func ProcessTemplateFile(template string, bundle interface{}) ([]byte, error) {
 
 // MustProcessTemplateFile processes golang template file
 func MustProcessTemplateFile(template string, bundle interface{}) string {
-	tf, err := os.Open(template)
+	return MustProcessTemplateFileFS(fs, template, bundle)
+}
+
+// MustProcessTemplateFileFS processes golang template file from given (afero) filesystem
+func MustProcessTemplateFileFS(filesystem afero.Fs, template string, bundle interface{}) string {
+	byteValue, err := afero.ReadFile(orDefaultFS(filesystem), template)
 	if err != nil {
 		return ""
 	}
-	byteValue, _ := ioutil.ReadAll(tf)
 	output, _ := Template(string(byteValue), bundle)
-	defer tf.Close()
 	return output
 }
 
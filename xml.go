@@ -0,0 +1,422 @@
+package filehelper
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shoobyban/mxj"
+)
+
+// XMLOrderKey holds the document order of child elements and attributes in parsed maps
+// when XMLOptions.KeepOrder is set, and is honoured by XMLEncode
+const XMLOrderKey = "#order"
+
+// XMLOptions controls XML parsing (NewXMLParser) and encoding (XMLEncode).
+// The zero value parses into the same map shape as the default "xml" parser.
+type XMLOptions struct {
+	// AttrPrefix is prepended to attribute keys, "-" if empty
+	AttrPrefix string
+	// TextKey is the key of the text of elements with attributes or children, "#text" if empty
+	TextKey string
+	// KeepNamespaces keeps namespace prefixes in keys ("g:price") and xmlns attributes when parsing
+	KeepNamespaces bool
+	// KeepOrder records the order of children and attributes under XMLOrderKey when parsing
+	KeepOrder bool
+
+	// Root wraps the encoded value into a root element
+	Root string
+	// Item is the element name for slice values encoded with Root
+	Item string
+	// Xmlns declares namespaces (prefix => URI, "" for the default namespace) on the root element
+	Xmlns map[string]string
+	// Order lists keys encoded first in this order, when there is no XMLOrderKey, the rest is sorted
+	Order []string
+	// CDATA lists element names whose text is encoded as CDATA section, "*" for all
+	CDATA []string
+	// Prefix and Indent turn on indentation
+	Prefix, Indent string
+	// Header adds the <?xml?> declaration
+	Header bool
+}
+
+func (o XMLOptions) attrPrefix() string {
+	if o.AttrPrefix == "" {
+		return "-"
+	}
+	return o.AttrPrefix
+}
+
+func (o XMLOptions) textKey() string {
+	if o.TextKey == "" {
+		return "#text"
+	}
+	return o.TextKey
+}
+
+// ParseXMLOptions reads options from "key=value" strings, used by the xml_marshal template function:
+// root, item, prefix, indent, header, attrprefix, textkey, namespaces, keeporder,
+// order and cdata (comma separated lists), xmlns and xmlns:prefix (namespace URIs)
+func ParseXMLOptions(options ...string) (XMLOptions, error) {
+	opts := XMLOptions{Xmlns: map[string]string{}}
+	for _, o := range options {
+		kv := strings.SplitN(o, "=", 2)
+		key, value := strings.ToLower(kv[0]), "true"
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		var err error
+		switch {
+		case key == "root":
+			opts.Root = value
+		case key == "item":
+			opts.Item = value
+		case key == "prefix":
+			opts.Prefix = value
+		case key == "indent":
+			opts.Indent = value
+		case key == "attrprefix":
+			opts.AttrPrefix = value
+		case key == "textkey":
+			opts.TextKey = value
+		case key == "order":
+			opts.Order = strings.Split(value, ",")
+		case key == "cdata":
+			opts.CDATA = strings.Split(value, ",")
+		case key == "header":
+			opts.Header, err = strconv.ParseBool(value)
+		case key == "namespaces":
+			opts.KeepNamespaces, err = strconv.ParseBool(value)
+		case key == "keeporder":
+			opts.KeepOrder, err = strconv.ParseBool(value)
+		case key == "xmlns":
+			opts.Xmlns[""] = value
+		case strings.HasPrefix(key, "xmlns:"):
+			opts.Xmlns[kv[0][6:]] = value
+		default:
+			return opts, fmt.Errorf("unknown xml option %q", o)
+		}
+		if err != nil {
+			return opts, fmt.Errorf("invalid xml option %q: %v", o, err)
+		}
+	}
+	return opts, nil
+}
+
+// NewXMLParser returns an xml ParserFunc using opts, register it to override the default "xml" parser
+func NewXMLParser(opts XMLOptions) ParserFunc {
+	return func(content []byte) (interface{}, error) {
+		return DecodeXML(content, opts)
+	}
+}
+
+// DecodeXML parses an XML document into a map using opts
+func DecodeXML(content []byte, opts XMLOptions) (mxj.Map, error) {
+	d := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			return nil, errors.New("no root element")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := t.(xml.StartElement); ok {
+			v, err := decodeXMLElement(d, start, opts)
+			if err != nil {
+				return nil, err
+			}
+			return mxj.Map{xmlName(start.Name, opts): v}, nil
+		}
+	}
+}
+
+func xmlName(n xml.Name, opts XMLOptions) string {
+	if opts.KeepNamespaces && n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+func decodeXMLElement(d *xml.Decoder, start xml.StartElement, opts XMLOptions) (interface{}, error) {
+	m := map[string]interface{}{}
+	order := []string{}
+	for _, a := range start.Attr {
+		if !opts.KeepNamespaces && (a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns")) {
+			continue
+		}
+		key := opts.attrPrefix() + xmlName(a.Name, opts)
+		m[key] = a.Value
+		order = append(order, key)
+	}
+	var text bytes.Buffer
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("unexpected EOF in element %s", start.Name.Local)
+			}
+			return nil, err
+		}
+		switch tt := t.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(d, tt, opts)
+			if err != nil {
+				return nil, err
+			}
+			key := xmlName(tt.Name, opts)
+			if v, ok := m[key]; ok {
+				if s, ok := v.([]interface{}); ok {
+					m[key] = append(s, child)
+				} else {
+					m[key] = []interface{}{v, child}
+				}
+			} else if _, ok := child.(map[string]interface{}); ok {
+				// like the default parser, child elements with attributes or children are always slices
+				m[key] = []interface{}{child}
+			} else {
+				m[key] = child
+			}
+			order = append(order, key)
+		case xml.CharData:
+			text.Write(tt)
+		case xml.EndElement:
+			if tt.Name != start.Name {
+				return nil, fmt.Errorf("element <%s> closed by </%s>", xmlName(start.Name, opts), xmlName(tt.Name, opts))
+			}
+			s := strings.TrimSpace(text.String())
+			if len(m) == 0 {
+				return s, nil
+			}
+			if s != "" {
+				m[opts.textKey()] = s
+				order = append(order, opts.textKey())
+			}
+			if opts.KeepOrder {
+				m[XMLOrderKey] = order
+			}
+			return m, nil
+		}
+	}
+}
+
+// XMLEncode encodes a map (or a slice with Root and Item) into XML using opts
+func XMLEncode(v interface{}, opts XMLOptions) ([]byte, error) {
+	e := &xmlEncoder{opts: opts}
+	if opts.Header {
+		e.buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+		if opts.Indent != "" || opts.Prefix != "" {
+			e.buf.WriteString("\n")
+		}
+	}
+	if opts.Root != "" {
+		if s, ok := sliceValue(v); ok {
+			if opts.Item == "" {
+				return nil, errors.New("xml encoding a slice needs an item element name")
+			}
+			v = map[string]interface{}{opts.Item: s}
+		}
+		if err := e.element(opts.Root, v, 0, true); err != nil {
+			return nil, err
+		}
+		return e.buf.Bytes(), nil
+	}
+	m, ok := mapValue(v)
+	if !ok {
+		return nil, fmt.Errorf("xml encoding needs a map or a root element, got %T", v)
+	}
+	first := true
+	for _, key := range e.childOrder(m) {
+		if !first {
+			e.newline(0)
+		}
+		if err := e.element(key.name, key.value, 0, first); err != nil {
+			return nil, err
+		}
+		first = false
+	}
+	return e.buf.Bytes(), nil
+}
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;", "'", "&apos;")
+
+type xmlEncoder struct {
+	opts XMLOptions
+	buf  bytes.Buffer
+}
+
+type xmlChild struct {
+	name  string
+	value interface{}
+}
+
+func (e *xmlEncoder) indenting() bool {
+	return e.opts.Indent != "" || e.opts.Prefix != ""
+}
+
+func (e *xmlEncoder) newline(depth int) {
+	if e.indenting() {
+		e.buf.WriteString("\n" + e.opts.Prefix + strings.Repeat(e.opts.Indent, depth))
+	}
+}
+
+func (e *xmlEncoder) cdata(name string) bool {
+	for _, c := range e.opts.CDATA {
+		if c == name || c == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *xmlEncoder) text(name string, v interface{}) {
+	s := fmt.Sprintf("%v", v)
+	if e.cdata(name) {
+		e.buf.WriteString("<![CDATA[" + strings.Replace(s, "]]>", "]]]]><![CDATA[>", -1) + "]]>")
+		return
+	}
+	e.buf.WriteString(xmlEscaper.Replace(s))
+}
+
+// childOrder returns the keys of m in XMLOrderKey order, then opts.Order, then sorted,
+// repeating slice keys once per item when they are interleaved in XMLOrderKey
+func (e *xmlEncoder) childOrder(m map[string]interface{}) []xmlChild {
+	ret := []xmlChild{}
+	used := map[string]int{}
+	var order []string
+	if o, ok := sliceValue(m[XMLOrderKey]); ok {
+		for _, k := range o {
+			order = append(order, fmt.Sprintf("%v", k))
+		}
+	}
+	for _, k := range order {
+		v, ok := m[k]
+		if !ok {
+			continue
+		}
+		if s, ok := v.([]interface{}); ok {
+			if used[k] < len(s) {
+				ret = append(ret, xmlChild{k, s[used[k]]})
+				used[k]++
+			}
+			continue
+		}
+		if used[k] == 0 {
+			ret = append(ret, xmlChild{k, v})
+			used[k] = 1
+		}
+	}
+	rest := func(k string) {
+		v, ok := m[k]
+		if !ok || k == XMLOrderKey {
+			return
+		}
+		if s, ok := v.([]interface{}); ok {
+			for ; used[k] < len(s); used[k]++ {
+				ret = append(ret, xmlChild{k, s[used[k]]})
+			}
+			return
+		}
+		if used[k] == 0 {
+			ret = append(ret, xmlChild{k, v})
+			used[k] = 1
+		}
+	}
+	for _, k := range e.opts.Order {
+		rest(k)
+	}
+	for _, k := range sortedKeys(m) {
+		rest(k)
+	}
+	return ret
+}
+
+func (e *xmlEncoder) element(name string, v interface{}, depth int, root bool) error {
+	if name == "" || strings.ContainsAny(name, " <>&\"'") {
+		return fmt.Errorf("invalid element name %q", name)
+	}
+	if s, ok := sliceValue(v); ok {
+		for i, item := range s {
+			if i > 0 {
+				e.newline(depth)
+			}
+			if err := e.element(name, item, depth, root); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	e.buf.WriteString("<" + name)
+	if root {
+		prefixes := []string{}
+		for p := range e.opts.Xmlns {
+			prefixes = append(prefixes, p)
+		}
+		sort.Strings(prefixes)
+		for _, p := range prefixes {
+			attr := "xmlns"
+			if p != "" {
+				attr += ":" + p
+			}
+			e.buf.WriteString(" " + attr + "=\"" + xmlEscaper.Replace(e.opts.Xmlns[p]) + "\"")
+		}
+	}
+	m, ok := mapValue(v)
+	if !ok {
+		if v == nil {
+			e.buf.WriteString("/>")
+			return nil
+		}
+		e.buf.WriteString(">")
+		e.text(name, v)
+		e.buf.WriteString("</" + name + ">")
+		return nil
+	}
+	prefix, textKey := e.opts.attrPrefix(), e.opts.textKey()
+	children := []xmlChild{}
+	var text interface{}
+	for _, c := range e.childOrder(m) {
+		switch {
+		case c.name == textKey:
+			text = c.value
+		case strings.HasPrefix(c.name, prefix):
+			e.buf.WriteString(" " + c.name[len(prefix):] + "=\"" + xmlEscaper.Replace(fmt.Sprintf("%v", c.value)) + "\"")
+		default:
+			children = append(children, c)
+		}
+	}
+	if text == nil && len(children) == 0 {
+		e.buf.WriteString("/>")
+		return nil
+	}
+	e.buf.WriteString(">")
+	if text != nil {
+		e.text(name, text)
+	}
+	for _, c := range children {
+		e.newline(depth + 1)
+		if err := e.element(c.name, c.value, depth+1, false); err != nil {
+			return err
+		}
+	}
+	if len(children) > 0 {
+		e.newline(depth)
+	}
+	e.buf.WriteString("</" + name + ">")
+	return nil
+}
+
+// xmlMarshal is the xml_marshal template function
+func xmlMarshal(v interface{}, options ...string) (string, error) {
+	opts, err := ParseXMLOptions(options...)
+	if err != nil {
+		return "", err
+	}
+	b, err := XMLEncode(v, opts)
+	return string(b), err
+}
@@ -0,0 +1,161 @@
+package filehelper
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shoobyban/mxj"
+	"github.com/spf13/afero"
+)
+
+type testXMLStruct struct {
+	Input   string
+	Options XMLOptions
+	Result  interface{}
+}
+
+func TestDecodeXML(t *testing.T) {
+	tests := map[string]testXMLStruct{
+		"default": {
+			Input:  `<?xml version="1.0"?><a id="1"><b>B</b><c/><b>B2</b><d x="y">D</d></a>`,
+			Result: mxj.Map{"a": map[string]interface{}{"-id": "1", "b": []interface{}{"B", "B2"}, "c": "", "d": []interface{}{map[string]interface{}{"-x": "y", "#text": "D"}}}},
+		},
+		"namespaces": {
+			Input:   `<feed xmlns="http://www.w3.org/2005/Atom" xmlns:g="http://base.google.com/ns/1.0"><g:id>1</g:id><title><![CDATA[A & B]]></title></feed>`,
+			Options: XMLOptions{KeepNamespaces: true, AttrPrefix: "@"},
+			Result:  mxj.Map{"feed": map[string]interface{}{"@xmlns": "http://www.w3.org/2005/Atom", "@xmlns:g": "http://base.google.com/ns/1.0", "g:id": "1", "title": "A & B"}},
+		},
+		"order": {
+			Input:   `<a z="1"><y>1</y><x>2</x><y>3</y></a>`,
+			Options: XMLOptions{KeepOrder: true},
+			Result:  mxj.Map{"a": map[string]interface{}{"-z": "1", "y": []interface{}{"1", "3"}, "x": "2", XMLOrderKey: []string{"-z", "y", "x", "y"}}},
+		},
+	}
+	for name, test := range tests {
+		res, err := NewXMLParser(test.Options)([]byte(test.Input))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, test.Result) {
+			t.Errorf("%s: %#v != %#v", name, res, test.Result)
+		}
+	}
+	p := NewParser()
+	def, _ := p.ParseStruct([]byte(tests["default"].Input), "xml")
+	if !reflect.DeepEqual(def, tests["default"].Result) {
+		t.Errorf("default parser shape differs: %#v", def)
+	}
+	if _, err := DecodeXML([]byte(`<a><b></a>`), XMLOptions{}); err == nil {
+		t.Errorf("expected error for mismatched tags")
+	}
+}
+
+func TestXMLEncode(t *testing.T) {
+	ordered, _ := DecodeXML([]byte(`<a z="1"><y>1</y><x>2</x><y>3</y></a>`), XMLOptions{KeepOrder: true})
+	out, err := XMLEncode(ordered, XMLOptions{})
+	if err != nil || string(out) != `<a z="1"><y>1</y><x>2</x><y>3</y></a>` {
+		t.Errorf("roundtrip: %s %v", out, err)
+	}
+
+	products := []interface{}{
+		map[string]interface{}{"z": 1, "p": "a & b", "g:id": "X1", "desc": "<b>bold</b>", "@lang": "en"},
+		map[string]interface{}{"z": 2, "p": "b"},
+	}
+	res, err := Template(`{{xml_marshal .A "root=products" "item=product" "indent=  " "header" "order=z,p" "cdata=desc" "attrprefix=@" "xmlns:g=http://base.google.com/ns/1.0"}}`, map[string]interface{}{"A": products})
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<products xmlns:g="http://base.google.com/ns/1.0">
+  <product lang="en">
+    <z>1</z>
+    <p>a &amp; b</p>
+    <desc><![CDATA[<b>bold</b>]]></desc>
+    <g:id>X1</g:id>
+  </product>
+  <product>
+    <z>2</z>
+    <p>b</p>
+  </product>
+</products>`
+	if err != nil || res != expected {
+		t.Errorf("xml_marshal: %s != %s (%v)", res, expected, err)
+	}
+	if _, err := Template(`{{xml_marshal .A "root=products"}}`, map[string]interface{}{"A": products}); err == nil {
+		t.Errorf("expected error for slice without item")
+	}
+}
+
+func TestXMLStream(t *testing.T) {
+	doc := `<?xml version="1.0"?>
+<catalog><info><product>not this one</product></info><products>
+  <product id="1"><sku>A</sku><name>First</name></product>
+  <product id="2"><sku>B</sku></product>
+  <product/>
+</products></catalog>`
+	p := NewParser()
+	expected := []interface{}{}
+	for _, el := range []string{`<product id="1"><sku>A</sku><name>First</name></product>`, `<product id="2"><sku>B</sku></product>`, `<product/>`} {
+		v, _ := p.ParseStruct([]byte(el), "xml")
+		expected = append(expected, v)
+	}
+	res := []interface{}{}
+	err := StreamXML(strings.NewReader(doc), "catalog/products/product", func(v interface{}) error {
+		res = append(res, v)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("stream: %#v != %#v", res, expected)
+	}
+
+	mfs := afero.NewMemMapFs()
+	afero.WriteFile(mfs, "feed.xml", []byte(doc), 0644)
+	p.RegisterFS(mfs)
+	p.RegisterParser("xml", NewXMLParser(XMLOptions{AttrPrefix: "@"}))
+	ids := []interface{}{}
+	// * also matches info/product, which has no id
+	err = p.StreamXMLFile("feed.xml", "/catalog/*/product", func(v interface{}) error {
+		id, _ := QueryOne(v, "product.@id")
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(ids, []interface{}{nil, "1", "2", nil}) {
+		t.Errorf("stream file: %#v %v", ids, err)
+	}
+
+	s := NewXMLStream(strings.NewReader(`<a><b>1</b><b>2`), "a/b")
+	if _, err := s.Next(); err != nil {
+		t.Errorf("first element: %v", err)
+	}
+	if _, err := s.Next(); err == nil || err == io.EOF {
+		t.Errorf("expected error for truncated document, got %v", err)
+	}
+
+	// long feeds go past the compaction of the recorded bytes, elements are still cut out correctly
+	var feed strings.Builder
+	feed.WriteString("<feed>")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&feed, "<item><n>%d</n><pad>%s</pad></item>\n", i, strings.Repeat("x", 50))
+	}
+	feed.WriteString("</feed>")
+	s = NewXMLStream(strings.NewReader(feed.String()), "feed/item")
+	for i := 0; ; i++ {
+		v, err := s.Next()
+		if err == io.EOF {
+			if i != 5000 {
+				t.Errorf("long feed: %d items", i)
+			}
+			break
+		}
+		if n, _ := QueryOne(v, "item.n"); err != nil || n != fmt.Sprint(i) {
+			t.Fatalf("long feed item %d: %#v %v", i, v, err)
+		}
+	}
+	if len(s.rec.buf) > 2*recordingCompactSize+4096 {
+		t.Errorf("recorded bytes not dropped: %d", len(s.rec.buf))
+	}
+}
@@ -0,0 +1,153 @@
+package filehelper
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/shoobyban/mxj"
+)
+
+// XMLStream reads elements matching a path from an XML document one at a time,
+// keeping only the current element in memory, see NewXMLStream
+type XMLStream struct {
+	d     *xml.Decoder
+	rec   *recordingReader
+	path  []string
+	stack []string
+	parse ParserFunc
+}
+
+// recordingCompactSize is the number of discarded bytes kept in recordingReader before they are dropped
+const recordingCompactSize = 64 * 1024
+
+// recordingReader keeps the bytes read from r since the last discard,
+// so the raw bytes of an element can be cut out by decoder offsets
+type recordingReader struct {
+	r   io.Reader
+	buf []byte
+	// off is the start of the kept bytes in buf, at input offset base
+	off  int
+	base int64
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+// discard drops recorded bytes before offset, the buffer is only compacted once the dropped bytes
+// outweigh the kept ones, so discarding after every token doesn't copy the rest each time
+func (rr *recordingReader) discard(offset int64) {
+	if n := offset - rr.base; n > 0 {
+		rr.off += int(n)
+		rr.base = offset
+		if rr.off >= recordingCompactSize && rr.off >= len(rr.buf)-rr.off {
+			rr.buf = append(rr.buf[:0], rr.buf[rr.off:]...)
+			rr.off = 0
+		}
+	}
+}
+
+func (rr *recordingReader) slice(from, to int64) []byte {
+	return rr.buf[rr.off+int(from-rr.base) : rr.off+int(to-rr.base)]
+}
+
+// NewXMLStream returns a stream of the elements at path (e.g. "catalog/products/product",
+// * matches any element name) in r, parsed into the same map shape as the default "xml" parser
+func NewXMLStream(r io.Reader, path string) *XMLStream {
+	return newXMLStream(r, path, func(content []byte) (interface{}, error) {
+		return mxj.NewMapXml(content)
+	})
+}
+
+func newXMLStream(r io.Reader, path string, parse ParserFunc) *XMLStream {
+	rec := &recordingReader{r: r}
+	return &XMLStream{
+		d:     xml.NewDecoder(rec),
+		rec:   rec,
+		path:  strings.Split(strings.Trim(path, "/"), "/"),
+		parse: parse,
+	}
+}
+
+func (s *XMLStream) matches() bool {
+	if len(s.stack) != len(s.path) {
+		return false
+	}
+	for i, p := range s.path {
+		if p != "*" && p != s.stack[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Next returns the next matching element as a map ({"product": {...}}), io.EOF after the last one
+func (s *XMLStream) Next() (interface{}, error) {
+	start, depth := int64(-1), 0
+	for {
+		offset := s.d.InputOffset()
+		t, err := s.d.Token()
+		if err == io.EOF && start >= 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tt := t.(type) {
+		case xml.StartElement:
+			s.stack = append(s.stack, tt.Name.Local)
+			if start < 0 && s.matches() {
+				start, depth = offset, len(s.stack)
+			}
+		case xml.EndElement:
+			s.stack = s.stack[:len(s.stack)-1]
+			if start >= 0 && len(s.stack) < depth {
+				end := s.d.InputOffset()
+				content := append([]byte{}, s.rec.slice(start, end)...)
+				s.rec.discard(end)
+				v, err := s.parse(content)
+				if err != nil {
+					return nil, fmt.Errorf("Can't parse element at offset %d: %v", start, err)
+				}
+				return v, nil
+			}
+		}
+		if start < 0 {
+			s.rec.discard(s.d.InputOffset())
+		}
+	}
+}
+
+// StreamXML calls fn with each element at path in r, see NewXMLStream
+func StreamXML(r io.Reader, path string, fn func(interface{}) error) error {
+	return streamXML(NewXMLStream(r, path), fn)
+}
+
+func streamXML(s *XMLStream, fn func(interface{}) error) error {
+	for {
+		v, err := s.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+}
+
+// StreamXMLFile calls fn with each element at path in filename, parsed with the registered "xml" parser
+func (l *Parser) StreamXMLFile(filename, path string, fn func(interface{}) error) error {
+	f, err := orDefaultFS(l.fs).Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return streamXML(newXMLStream(f, path, l.parsers["xml"]), fn)
+}
@@ -0,0 +1,1416 @@
+package filehelper
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/spf13/afero"
+)
+
+const xsdNamespace = "http://www.w3.org/2001/XMLSchema"
+const xsiNamespace = "http://www.w3.org/2001/XMLSchema-instance"
+
+// Schema is a parsed XSD schema. It covers the common subset of XML Schema 1.0:
+// global and local elements (with ref, minOccurs, maxOccurs), named and anonymous complex types
+// with sequence, choice, all, any, groups, attributes and attribute groups, simple and complex
+// content extension, simple types with restriction facets (enumeration, pattern, length,
+// minLength, maxLength, minInclusive, maxInclusive, minExclusive, maxExclusive, totalDigits,
+// fractionDigits), lists, unions and the usual built-in types.
+// Namespaces are not validated, elements and attributes are matched by local name.
+type Schema struct {
+	elements   map[string]*xsdElement
+	attributes map[string]*xsdAttribute
+	types      map[string]*xsdType
+	groups     map[string]*xsdParticle
+	attrGroups map[string][]*xsdAttribute
+}
+
+type xsdElement struct {
+	name       string
+	ref        string
+	typeName   string
+	typ        *xsdType
+	minOccurs  int
+	maxOccurs  int
+	resolvedTo *xsdElement
+}
+
+type xsdAttribute struct {
+	name     string
+	ref      string
+	typeName string
+	simple   *xsdSimple
+	required bool
+	fixed    *string
+}
+
+type xsdType struct {
+	name    string
+	simple  *xsdSimple
+	complex *xsdComplex
+}
+
+type xsdComplex struct {
+	particle      *xsdParticle
+	attributes    []*xsdAttribute
+	attrGroupRefs []string
+	anyAttribute  bool
+	mixed         bool
+	simpleContent *xsdSimple
+	extends       string
+}
+
+type xsdParticle struct {
+	kind      string // sequence, choice, all, element, any, group
+	minOccurs int
+	maxOccurs int
+	element   *xsdElement
+	ref       string
+	children  []*xsdParticle
+}
+
+type xsdSimple struct {
+	builtin     string
+	base        string
+	baseType    *xsdSimple
+	list        *xsdSimple
+	listType    string
+	union       []*xsdSimple
+	unionTypes  []string
+	enumeration []string
+	patterns    []*regexp.Regexp
+	length      *int
+	minLength   *int
+	maxLength   *int
+	minIncl     *string
+	maxIncl     *string
+	minExcl     *string
+	maxExcl     *string
+	totalDigits *int
+	fracDigits  *int
+}
+
+// ValidationError is a single schema violation
+type ValidationError struct {
+	Path    string
+	Line    int
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("%s (line %d): %s", e.Path, e.Line, e.Message)
+}
+
+// ValidationErrors is the list of violations returned by Schema validation
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// xmlNode is a minimal DOM used for schemas and validated documents
+type xmlNode struct {
+	name     xml.Name
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     string
+	line     int
+	ns       map[string]string
+}
+
+func (n *xmlNode) attr(name string) (string, bool) {
+	for _, a := range n.attrs {
+		if a.Name.Local == name && a.Name.Space == "" {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+func parseXMLNodes(content []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(content))
+	var stack []*xmlNode
+	var root *xmlNode
+	line, counted := 1, int64(0)
+	for {
+		offset := d.InputOffset()
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line += bytes.Count(content[counted:offset], []byte("\n"))
+		counted = offset
+		switch tt := t.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: tt.Name, line: line, ns: map[string]string{}}
+			if len(stack) > 0 {
+				for k, v := range stack[len(stack)-1].ns {
+					n.ns[k] = v
+				}
+			}
+			for _, a := range tt.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					n.ns[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					n.ns[""] = a.Value
+				default:
+					n.attrs = append(n.attrs, a)
+				}
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(tt)
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("no root element")
+	}
+	return root, nil
+}
+
+// LoadXSD reads and parses an XSD file from the package default filesystem
+func LoadXSD(filename string) (*Schema, error) {
+	return LoadXSDFS(fs, filename)
+}
+
+// LoadXSDFS reads and parses an XSD file from given (afero) filesystem
+func LoadXSDFS(filesystem afero.Fs, filename string) (*Schema, error) {
+	content, err := afero.ReadFile(orDefaultFS(filesystem), filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseXSD(content)
+}
+
+// ParseXSD parses an XSD schema
+func ParseXSD(content []byte) (*Schema, error) {
+	root, err := parseXMLNodes(content)
+	if err != nil {
+		return nil, err
+	}
+	if root.name.Local != "schema" {
+		return nil, fmt.Errorf("root element is %s, not schema", root.name.Local)
+	}
+	s := &Schema{
+		elements:   map[string]*xsdElement{},
+		attributes: map[string]*xsdAttribute{},
+		types:      map[string]*xsdType{},
+		groups:     map[string]*xsdParticle{},
+		attrGroups: map[string][]*xsdAttribute{},
+	}
+	for _, c := range root.children {
+		name, _ := c.attr("name")
+		var err error
+		switch c.name.Local {
+		case "element":
+			var e *xsdElement
+			if e, err = s.parseElement(c); err == nil {
+				s.elements[name] = e
+			}
+		case "attribute":
+			var a *xsdAttribute
+			if a, err = s.parseAttribute(c); err == nil {
+				s.attributes[name] = a
+			}
+		case "complexType":
+			var ct *xsdComplex
+			if ct, err = s.parseComplex(c); err == nil {
+				s.types[name] = &xsdType{name: name, complex: ct}
+			}
+		case "simpleType":
+			var st *xsdSimple
+			if st, err = s.parseSimple(c); err == nil {
+				s.types[name] = &xsdType{name: name, simple: st}
+			}
+		case "group":
+			var p *xsdParticle
+			if p, err = s.parseGroupContent(c); err == nil {
+				s.groups[name] = p
+			}
+		case "attributeGroup":
+			var attrs []*xsdAttribute
+			if attrs, err = s.parseAttributeGroup(c); err == nil {
+				s.attrGroups[name] = attrs
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := s.resolve(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// localName strips the namespace prefix of a QName
+func localName(qname string) string {
+	if i := strings.IndexByte(qname, ':'); i >= 0 {
+		return qname[i+1:]
+	}
+	return qname
+}
+
+// isXSDName tells if qname refers to the XML Schema namespace in the context of n
+func isXSDName(n *xmlNode, qname string) bool {
+	prefix := ""
+	if i := strings.IndexByte(qname, ':'); i >= 0 {
+		prefix = qname[:i]
+	}
+	return n.ns[prefix] == xsdNamespace
+}
+
+func parseOccurs(n *xmlNode) (int, int, error) {
+	min, max := 1, 1
+	if v, ok := n.attr("minOccurs"); ok {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, fmt.Errorf("line %d: invalid minOccurs %q", n.line, v)
+		}
+		min = i
+	}
+	if v, ok := n.attr("maxOccurs"); ok {
+		if v == "unbounded" {
+			max = -1
+		} else {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return 0, 0, fmt.Errorf("line %d: invalid maxOccurs %q", n.line, v)
+			}
+			max = i
+		}
+	}
+	return min, max, nil
+}
+
+func (s *Schema) typeRef(n *xmlNode, qname string) string {
+	if isXSDName(n, qname) {
+		return "xs:" + localName(qname)
+	}
+	return localName(qname)
+}
+
+func (s *Schema) parseElement(n *xmlNode) (*xsdElement, error) {
+	e := &xsdElement{}
+	e.name, _ = n.attr("name")
+	if ref, ok := n.attr("ref"); ok {
+		e.ref = localName(ref)
+	}
+	if t, ok := n.attr("type"); ok {
+		e.typeName = s.typeRef(n, t)
+	}
+	var err error
+	if e.minOccurs, e.maxOccurs, err = parseOccurs(n); err != nil {
+		return nil, err
+	}
+	for _, c := range n.children {
+		switch c.name.Local {
+		case "complexType":
+			ct, err := s.parseComplex(c)
+			if err != nil {
+				return nil, err
+			}
+			e.typ = &xsdType{complex: ct}
+		case "simpleType":
+			st, err := s.parseSimple(c)
+			if err != nil {
+				return nil, err
+			}
+			e.typ = &xsdType{simple: st}
+		}
+	}
+	if e.name == "" && e.ref == "" {
+		return nil, fmt.Errorf("line %d: element without name or ref", n.line)
+	}
+	return e, nil
+}
+
+func (s *Schema) parseAttribute(n *xmlNode) (*xsdAttribute, error) {
+	a := &xsdAttribute{}
+	a.name, _ = n.attr("name")
+	if ref, ok := n.attr("ref"); ok {
+		a.ref = localName(ref)
+	}
+	if t, ok := n.attr("type"); ok {
+		a.typeName = s.typeRef(n, t)
+	}
+	if use, _ := n.attr("use"); use == "required" {
+		a.required = true
+	}
+	if fixed, ok := n.attr("fixed"); ok {
+		a.fixed = &fixed
+	}
+	for _, c := range n.children {
+		if c.name.Local == "simpleType" {
+			st, err := s.parseSimple(c)
+			if err != nil {
+				return nil, err
+			}
+			a.simple = st
+		}
+	}
+	if a.name == "" && a.ref == "" {
+		return nil, fmt.Errorf("line %d: attribute without name or ref", n.line)
+	}
+	return a, nil
+}
+
+func (s *Schema) parseAttributeGroup(n *xmlNode) ([]*xsdAttribute, error) {
+	attrs := []*xsdAttribute{}
+	for _, c := range n.children {
+		switch c.name.Local {
+		case "attribute":
+			a, err := s.parseAttribute(c)
+			if err != nil {
+				return nil, err
+			}
+			attrs = append(attrs, a)
+		case "attributeGroup":
+			ref, _ := c.attr("ref")
+			attrs = append(attrs, &xsdAttribute{ref: "group:" + localName(ref)})
+		}
+	}
+	return attrs, nil
+}
+
+func (s *Schema) parseGroupContent(n *xmlNode) (*xsdParticle, error) {
+	for _, c := range n.children {
+		switch c.name.Local {
+		case "sequence", "choice", "all":
+			return s.parseParticle(c)
+		}
+	}
+	return &xsdParticle{kind: "sequence", minOccurs: 1, maxOccurs: 1}, nil
+}
+
+func (s *Schema) parseParticle(n *xmlNode) (*xsdParticle, error) {
+	p := &xsdParticle{kind: n.name.Local}
+	var err error
+	if p.minOccurs, p.maxOccurs, err = parseOccurs(n); err != nil {
+		return nil, err
+	}
+	switch p.kind {
+	case "element":
+		if p.element, err = s.parseElement(n); err != nil {
+			return nil, err
+		}
+		p.minOccurs, p.maxOccurs = p.element.minOccurs, p.element.maxOccurs
+		return p, nil
+	case "any":
+		return p, nil
+	case "group":
+		ref, _ := n.attr("ref")
+		p.ref = localName(ref)
+		return p, nil
+	}
+	for _, c := range n.children {
+		switch c.name.Local {
+		case "element", "sequence", "choice", "all", "any", "group":
+			child, err := s.parseParticle(c)
+			if err != nil {
+				return nil, err
+			}
+			p.children = append(p.children, child)
+		}
+	}
+	return p, nil
+}
+
+func (s *Schema) parseComplex(n *xmlNode) (*xsdComplex, error) {
+	ct := &xsdComplex{}
+	if mixed, _ := n.attr("mixed"); mixed == "true" {
+		ct.mixed = true
+	}
+	if err := s.parseComplexBody(n, ct); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+func (s *Schema) parseComplexBody(n *xmlNode, ct *xsdComplex) error {
+	for _, c := range n.children {
+		switch c.name.Local {
+		case "sequence", "choice", "all", "group":
+			p, err := s.parseParticle(c)
+			if err != nil {
+				return err
+			}
+			ct.particle = p
+		case "attribute":
+			a, err := s.parseAttribute(c)
+			if err != nil {
+				return err
+			}
+			ct.attributes = append(ct.attributes, a)
+		case "attributeGroup":
+			ref, _ := c.attr("ref")
+			ct.attrGroupRefs = append(ct.attrGroupRefs, localName(ref))
+		case "anyAttribute":
+			ct.anyAttribute = true
+		case "complexContent":
+			if mixed, _ := c.attr("mixed"); mixed == "true" {
+				ct.mixed = true
+			}
+			for _, d := range c.children {
+				if d.name.Local == "extension" || d.name.Local == "restriction" {
+					if d.name.Local == "extension" {
+						base, _ := d.attr("base")
+						ct.extends = s.typeRef(d, base)
+					}
+					if err := s.parseComplexBody(d, ct); err != nil {
+						return err
+					}
+				}
+			}
+		case "simpleContent":
+			for _, d := range c.children {
+				if d.name.Local == "extension" || d.name.Local == "restriction" {
+					st, err := s.parseRestriction(d)
+					if err != nil {
+						return err
+					}
+					ct.simpleContent = st
+					if err := s.parseComplexBody(d, ct); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) parseSimple(n *xmlNode) (*xsdSimple, error) {
+	for _, c := range n.children {
+		switch c.name.Local {
+		case "restriction":
+			return s.parseRestriction(c)
+		case "list":
+			st := &xsdSimple{}
+			if t, ok := c.attr("itemType"); ok {
+				st.listType = s.typeRef(c, t)
+			}
+			for _, d := range c.children {
+				if d.name.Local == "simpleType" {
+					item, err := s.parseSimple(d)
+					if err != nil {
+						return nil, err
+					}
+					st.list = item
+				}
+			}
+			if st.list == nil && st.listType == "" {
+				return nil, fmt.Errorf("line %d: list without item type", c.line)
+			}
+			return st, nil
+		case "union":
+			st := &xsdSimple{}
+			if t, ok := c.attr("memberTypes"); ok {
+				for _, m := range strings.Fields(t) {
+					st.unionTypes = append(st.unionTypes, s.typeRef(c, m))
+				}
+			}
+			for _, d := range c.children {
+				if d.name.Local == "simpleType" {
+					member, err := s.parseSimple(d)
+					if err != nil {
+						return nil, err
+					}
+					st.union = append(st.union, member)
+				}
+			}
+			return st, nil
+		}
+	}
+	return &xsdSimple{builtin: "anySimpleType"}, nil
+}
+
+func (s *Schema) parseRestriction(n *xmlNode) (*xsdSimple, error) {
+	st := &xsdSimple{}
+	if base, ok := n.attr("base"); ok {
+		st.base = s.typeRef(n, base)
+	}
+	intFacet := func(c *xmlNode) (*int, error) {
+		v, _ := c.attr("value")
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid %s %q", c.line, c.name.Local, v)
+		}
+		return &i, nil
+	}
+	for _, c := range n.children {
+		value, _ := c.attr("value")
+		var err error
+		switch c.name.Local {
+		case "simpleType":
+			st.baseType, err = s.parseSimple(c)
+		case "enumeration":
+			st.enumeration = append(st.enumeration, value)
+		case "pattern":
+			var re *regexp.Regexp
+			if re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+				err = fmt.Errorf("line %d: unsupported pattern %q: %v", c.line, value, err)
+			}
+			st.patterns = append(st.patterns, re)
+		case "length":
+			st.length, err = intFacet(c)
+		case "minLength":
+			st.minLength, err = intFacet(c)
+		case "maxLength":
+			st.maxLength, err = intFacet(c)
+		case "totalDigits":
+			st.totalDigits, err = intFacet(c)
+		case "fractionDigits":
+			st.fracDigits, err = intFacet(c)
+		case "minInclusive":
+			st.minIncl = &value
+		case "maxInclusive":
+			st.maxIncl = &value
+		case "minExclusive":
+			st.minExcl = &value
+		case "maxExclusive":
+			st.maxExcl = &value
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// resolve links type, element, group and attribute references
+func (s *Schema) resolve() error {
+	for _, t := range s.types {
+		if err := s.resolveType(t); err != nil {
+			return err
+		}
+	}
+	for _, e := range s.elements {
+		if err := s.resolveElement(e); err != nil {
+			return err
+		}
+	}
+	for _, a := range s.attributes {
+		if err := s.resolveAttribute(a); err != nil {
+			return err
+		}
+	}
+	for _, g := range s.groups {
+		if err := s.resolveParticle(g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) simpleType(name string) (*xsdSimple, error) {
+	if strings.HasPrefix(name, "xs:") {
+		b := name[3:]
+		if _, ok := xsdBuiltins[b]; !ok && b != "anySimpleType" && b != "anyType" {
+			return nil, fmt.Errorf("unsupported built-in type %s", b)
+		}
+		return &xsdSimple{builtin: b}, nil
+	}
+	t, ok := s.types[name]
+	if !ok {
+		if _, ok := xsdBuiltins[name]; ok {
+			return &xsdSimple{builtin: name}, nil
+		}
+		return nil, fmt.Errorf("unknown type %s", name)
+	}
+	if t.simple == nil {
+		return nil, fmt.Errorf("%s is not a simple type", name)
+	}
+	return t.simple, nil
+}
+
+func (s *Schema) resolveSimple(st *xsdSimple) error {
+	if st == nil {
+		return nil
+	}
+	var err error
+	if st.base != "" && st.baseType == nil {
+		if st.baseType, err = s.simpleType(st.base); err != nil {
+			return err
+		}
+	}
+	if st.listType != "" && st.list == nil {
+		if st.list, err = s.simpleType(st.listType); err != nil {
+			return err
+		}
+	}
+	for _, u := range st.unionTypes {
+		member, err := s.simpleType(u)
+		if err != nil {
+			return err
+		}
+		st.union = append(st.union, member)
+	}
+	st.unionTypes = nil
+	if st.baseType != nil && st.baseType != st {
+		if err := s.resolveSimple(st.baseType); err != nil {
+			return err
+		}
+	}
+	if st.list != nil {
+		if err := s.resolveSimple(st.list); err != nil {
+			return err
+		}
+	}
+	for _, u := range st.union {
+		if err := s.resolveSimple(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) resolveType(t *xsdType) error {
+	if t.simple != nil {
+		return s.resolveSimple(t.simple)
+	}
+	ct := t.complex
+	if ct.extends != "" {
+		if strings.HasPrefix(ct.extends, "xs:") {
+			ct.extends = ""
+		} else {
+			base, ok := s.types[ct.extends]
+			if !ok || base.complex == nil {
+				return fmt.Errorf("unknown complex type %s", ct.extends)
+			}
+			ct.extends = ""
+			if err := s.resolveType(base); err != nil {
+				return err
+			}
+			ct.attributes = append(append([]*xsdAttribute{}, base.complex.attributes...), ct.attributes...)
+			ct.anyAttribute = ct.anyAttribute || base.complex.anyAttribute
+			if base.complex.simpleContent != nil && ct.simpleContent == nil {
+				ct.simpleContent = base.complex.simpleContent
+			}
+			if base.complex.particle != nil {
+				if ct.particle == nil {
+					ct.particle = base.complex.particle
+				} else {
+					ct.particle = &xsdParticle{kind: "sequence", minOccurs: 1, maxOccurs: 1, children: []*xsdParticle{base.complex.particle, ct.particle}}
+				}
+			}
+		}
+	}
+	for _, g := range ct.attrGroupRefs {
+		attrs, err := s.attributeGroup(g)
+		if err != nil {
+			return err
+		}
+		ct.attributes = append(ct.attributes, attrs...)
+	}
+	ct.attrGroupRefs = nil
+	for _, a := range ct.attributes {
+		if err := s.resolveAttribute(a); err != nil {
+			return err
+		}
+	}
+	if err := s.resolveSimple(ct.simpleContent); err != nil {
+		return err
+	}
+	if ct.particle != nil {
+		return s.resolveParticle(ct.particle)
+	}
+	return nil
+}
+
+func (s *Schema) attributeGroup(name string) ([]*xsdAttribute, error) {
+	attrs, ok := s.attrGroups[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown attribute group %s", name)
+	}
+	ret := []*xsdAttribute{}
+	for _, a := range attrs {
+		if strings.HasPrefix(a.ref, "group:") {
+			nested, err := s.attributeGroup(a.ref[6:])
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, nested...)
+			continue
+		}
+		ret = append(ret, a)
+	}
+	return ret, nil
+}
+
+func (s *Schema) resolveAttribute(a *xsdAttribute) error {
+	if a.ref != "" {
+		global, ok := s.attributes[a.ref]
+		if !ok {
+			return fmt.Errorf("unknown attribute %s", a.ref)
+		}
+		if err := s.resolveAttribute(global); err != nil {
+			return err
+		}
+		a.name, a.simple, a.ref = global.name, global.simple, ""
+		if a.fixed == nil {
+			a.fixed = global.fixed
+		}
+		return nil
+	}
+	if a.simple == nil {
+		if a.typeName == "" {
+			a.simple = &xsdSimple{builtin: "anySimpleType"}
+			return nil
+		}
+		var err error
+		if a.simple, err = s.simpleType(a.typeName); err != nil {
+			return err
+		}
+	}
+	return s.resolveSimple(a.simple)
+}
+
+func (s *Schema) resolveElement(e *xsdElement) error {
+	if e.ref != "" {
+		global, ok := s.elements[e.ref]
+		if !ok {
+			return fmt.Errorf("unknown element %s", e.ref)
+		}
+		e.resolvedTo = global
+		e.name = global.name
+		return nil
+	}
+	if e.typ == nil && e.typeName != "" {
+		if strings.HasPrefix(e.typeName, "xs:") {
+			st, err := s.simpleType(e.typeName)
+			if err != nil {
+				return err
+			}
+			e.typ = &xsdType{simple: st}
+		} else {
+			t, ok := s.types[e.typeName]
+			if !ok {
+				return fmt.Errorf("unknown type %s", e.typeName)
+			}
+			e.typ = t
+			return nil
+		}
+	}
+	if e.typ != nil {
+		return s.resolveType(e.typ)
+	}
+	return nil
+}
+
+func (s *Schema) resolveParticle(p *xsdParticle) error {
+	switch p.kind {
+	case "element":
+		return s.resolveElement(p.element)
+	case "group":
+		if p.children == nil {
+			g, ok := s.groups[p.ref]
+			if !ok {
+				return fmt.Errorf("unknown group %s", p.ref)
+			}
+			p.children = []*xsdParticle{g}
+		}
+		return nil
+	}
+	for _, c := range p.children {
+		if err := s.resolveParticle(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *xsdElement) decl() *xsdElement {
+	if e.resolvedTo != nil {
+		return e.resolvedTo
+	}
+	return e
+}
+
+// Validate checks an XML document against the schema, returns ValidationErrors on violations
+func (s *Schema) Validate(content []byte) error {
+	root, err := parseXMLNodes(content)
+	if err != nil {
+		return err
+	}
+	return s.validateRoot(root)
+}
+
+// ValidateFile checks an XML file on the package default filesystem against the schema
+func (s *Schema) ValidateFile(filename string) error {
+	return s.ValidateFileFS(fs, filename)
+}
+
+// ValidateFileFS checks an XML file on given (afero) filesystem against the schema
+func (s *Schema) ValidateFileFS(filesystem afero.Fs, filename string) error {
+	content, err := afero.ReadFile(orDefaultFS(filesystem), filename)
+	if err != nil {
+		return err
+	}
+	return s.Validate(content)
+}
+
+// ValidateMap checks a map parsed by the "xml" parser (or built for xml_encode) against the schema.
+// As maps don't keep element order, children are checked in the order the schema expects.
+func (s *Schema) ValidateMap(v interface{}) error {
+	m, ok := mapValue(v)
+	if !ok || len(m) != 1 {
+		return errors.New("validating a map needs a map with a single root key")
+	}
+	for name, value := range m {
+		e, ok := s.elements[name]
+		if !ok {
+			return ValidationErrors{{Path: "/" + name, Message: "no global element declaration"}}
+		}
+		return s.validateRoot(s.mapToNode(name, value, e.decl()))
+	}
+	return nil
+}
+
+func (s *Schema) mapToNode(name string, v interface{}, e *xsdElement) *xmlNode {
+	n := &xmlNode{name: xml.Name{Local: name}}
+	m, ok := mapValue(v)
+	if !ok {
+		if v != nil {
+			n.text = fmt.Sprintf("%v", v)
+		}
+		return n
+	}
+	var decls map[string]*xsdElement
+	var order []string
+	if e != nil && e.typ != nil && e.typ.complex != nil && e.typ.complex.particle != nil {
+		decls = map[string]*xsdElement{}
+		collectElements(e.typ.complex.particle, decls, &order, map[*xsdParticle]bool{})
+	}
+	rank := func(k string) int {
+		for i, o := range order {
+			if o == k {
+				return i
+			}
+		}
+		return len(order)
+	}
+	keys := sortedKeys(m)
+	sort.SliceStable(keys, func(i, j int) bool { return rank(keys[i]) < rank(keys[j]) })
+	for _, k := range keys {
+		switch {
+		case k == "#text":
+			n.text = fmt.Sprintf("%v", m[k])
+		case k == XMLOrderKey:
+		case strings.HasPrefix(k, "-"):
+			n.attrs = append(n.attrs, xml.Attr{Name: xml.Name{Local: k[1:]}, Value: fmt.Sprintf("%v", m[k])})
+		default:
+			items, ok := sliceValue(m[k])
+			if !ok {
+				items = []interface{}{m[k]}
+			}
+			for _, item := range items {
+				n.children = append(n.children, s.mapToNode(k, item, decls[k]))
+			}
+		}
+	}
+	return n
+}
+
+// collectElements lists element declarations of a content model in schema order
+func collectElements(p *xsdParticle, decls map[string]*xsdElement, order *[]string, seen map[*xsdParticle]bool) {
+	if seen[p] {
+		return
+	}
+	seen[p] = true
+	if p.kind == "element" {
+		e := p.element.decl()
+		if _, ok := decls[e.name]; !ok {
+			decls[e.name] = e
+			*order = append(*order, e.name)
+		}
+		return
+	}
+	for _, c := range p.children {
+		collectElements(c, decls, order, seen)
+	}
+}
+
+type xsdValidator struct {
+	schema *Schema
+	errors ValidationErrors
+}
+
+func (v *xsdValidator) errorf(n *xmlNode, path, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Path: path, Line: n.line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (s *Schema) validateRoot(root *xmlNode) error {
+	v := &xsdValidator{schema: s}
+	path := "/" + root.name.Local
+	e, ok := s.elements[root.name.Local]
+	if !ok {
+		v.errorf(root, path, "no global element declaration for %s", root.name.Local)
+	} else {
+		v.validateElement(root, e.decl(), path)
+	}
+	if len(v.errors) > 0 {
+		return v.errors
+	}
+	return nil
+}
+
+func (v *xsdValidator) validateElement(n *xmlNode, e *xsdElement, path string) {
+	if nilled, _ := xsiAttr(n, "nil"); nilled == "true" {
+		return
+	}
+	if e.typ == nil {
+		return // anyType
+	}
+	if st := e.typ.simple; st != nil {
+		if len(n.children) > 0 {
+			v.errorf(n, path, "element has simple type but contains elements")
+		}
+		for _, a := range n.attrs {
+			if a.Name.Space != xsiNamespace {
+				v.errorf(n, path, "unexpected attribute %s", a.Name.Local)
+			}
+		}
+		if err := st.validate(n.text); err != nil {
+			v.errorf(n, path, "%v", err)
+		}
+		return
+	}
+	ct := e.typ.complex
+	v.validateAttributes(n, ct, path)
+	if ct.simpleContent != nil {
+		if len(n.children) > 0 {
+			v.errorf(n, path, "element has simple content but contains elements")
+		}
+		if err := ct.simpleContent.validate(n.text); err != nil {
+			v.errorf(n, path, "%v", err)
+		}
+		return
+	}
+	if !ct.mixed && strings.TrimSpace(n.text) != "" {
+		v.errorf(n, path, "text is not allowed in element")
+	}
+	if ct.particle == nil {
+		if len(n.children) > 0 {
+			v.errorf(n, path, "element must be empty")
+		}
+		return
+	}
+	m := &contentMatcher{children: n.children}
+	if !m.match(ct.particle, 0)[len(n.children)] {
+		expected := "nothing"
+		if len(m.expected) > 0 {
+			expected = strings.Join(m.expected, " or ")
+		}
+		if m.furthest < len(n.children) {
+			c := n.children[m.furthest]
+			v.errorf(c, path, "unexpected element %s, expected %s", c.name.Local, expected)
+		} else {
+			v.errorf(n, path, "missing element %s", expected)
+		}
+	}
+	decls := map[string]*xsdElement{}
+	order := []string{}
+	collectElements(ct.particle, decls, &order, map[*xsdParticle]bool{})
+	counts := map[string]int{}
+	for _, c := range n.children {
+		counts[c.name.Local]++
+		childPath := path + "/" + c.name.Local
+		if counts[c.name.Local] > 1 {
+			childPath += "[" + strconv.Itoa(counts[c.name.Local]) + "]"
+		}
+		if d, ok := decls[c.name.Local]; ok {
+			v.validateElement(c, d, childPath)
+		} else if d, ok := v.schema.elements[c.name.Local]; ok && containsAny(ct.particle) {
+			v.validateElement(c, d.decl(), childPath)
+		}
+	}
+}
+
+func xsiAttr(n *xmlNode, name string) (string, bool) {
+	for _, a := range n.attrs {
+		if a.Name.Space == xsiNamespace && a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+func (v *xsdValidator) validateAttributes(n *xmlNode, ct *xsdComplex, path string) {
+	declared := map[string]*xsdAttribute{}
+	for _, a := range ct.attributes {
+		declared[a.name] = a
+	}
+	present := map[string]bool{}
+	for _, a := range n.attrs {
+		if a.Name.Space == xsiNamespace || a.Name.Space == "xml" || a.Name.Space == "http://www.w3.org/XML/1998/namespace" {
+			continue
+		}
+		present[a.Name.Local] = true
+		d, ok := declared[a.Name.Local]
+		if !ok {
+			if !ct.anyAttribute {
+				v.errorf(n, path+"/@"+a.Name.Local, "unexpected attribute")
+			}
+			continue
+		}
+		if d.fixed != nil && a.Value != *d.fixed {
+			v.errorf(n, path+"/@"+a.Name.Local, "value must be %q", *d.fixed)
+		}
+		if err := d.simple.validate(a.Value); err != nil {
+			v.errorf(n, path+"/@"+a.Name.Local, "%v", err)
+		}
+	}
+	for _, a := range ct.attributes {
+		if a.required && !present[a.name] {
+			v.errorf(n, path+"/@"+a.name, "missing required attribute")
+		}
+	}
+}
+
+func containsAny(p *xsdParticle) bool {
+	if p.kind == "any" {
+		return true
+	}
+	for _, c := range p.children {
+		if containsAny(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentMatcher matches child elements against a content model, remembering how far it got
+// and which elements it expected there for error messages
+type contentMatcher struct {
+	children []*xmlNode
+	furthest int
+	expected []string
+}
+
+func (m *contentMatcher) attempt(pos int, name string, ok bool) {
+	if ok && pos+1 > m.furthest {
+		m.furthest, m.expected = pos+1, nil
+	}
+	if !ok && pos == m.furthest {
+		for _, e := range m.expected {
+			if e == name {
+				return
+			}
+		}
+		m.expected = append(m.expected, name)
+	}
+}
+
+// match returns the set of positions where matching p (with its occurrences) starting at pos can end
+func (m *contentMatcher) match(p *xsdParticle, pos int) map[int]bool {
+	res := map[int]bool{}
+	if p.minOccurs == 0 {
+		res[pos] = true
+	}
+	current := map[int]bool{pos: true}
+	seen := map[int]bool{pos: true}
+	for i := 1; p.maxOccurs < 0 || i <= p.maxOccurs; i++ {
+		next := map[int]bool{}
+		for c := range current {
+			for e := range m.matchOnce(p, c) {
+				next[e] = true
+			}
+		}
+		progress := map[int]bool{}
+		for e := range next {
+			if i >= p.minOccurs {
+				res[e] = true
+			}
+			if !seen[e] || i < p.minOccurs {
+				progress[e] = true
+				seen[e] = true
+			}
+		}
+		if len(progress) == 0 {
+			break
+		}
+		current = progress
+	}
+	return res
+}
+
+func (m *contentMatcher) matchOnce(p *xsdParticle, pos int) map[int]bool {
+	res := map[int]bool{}
+	switch p.kind {
+	case "element":
+		name := p.element.decl().name
+		ok := pos < len(m.children) && m.children[pos].name.Local == name
+		m.attempt(pos, name, ok)
+		if ok {
+			res[pos+1] = true
+		}
+	case "any":
+		ok := pos < len(m.children)
+		m.attempt(pos, "any element", ok)
+		if ok {
+			res[pos+1] = true
+		}
+	case "sequence", "group":
+		current := map[int]bool{pos: true}
+		for _, c := range p.children {
+			next := map[int]bool{}
+			for s := range current {
+				for e := range m.match(c, s) {
+					next[e] = true
+				}
+			}
+			current = next
+		}
+		return current
+	case "choice":
+		for _, c := range p.children {
+			for e := range m.match(c, pos) {
+				res[e] = true
+			}
+		}
+	case "all":
+		used := map[*xsdParticle]bool{}
+		i := pos
+	next:
+		for i < len(m.children) {
+			for _, c := range p.children {
+				if !used[c] && m.matchOnce(c, i)[i+1] {
+					used[c] = true
+					i++
+					continue next
+				}
+			}
+			break
+		}
+		for _, c := range p.children {
+			if !used[c] && c.minOccurs > 0 {
+				m.matchOnce(c, i)
+				return res
+			}
+		}
+		res[i] = true
+	}
+	return res
+}
+
+var xsdBuiltins = map[string]*regexp.Regexp{
+	"string":             nil,
+	"normalizedString":   nil,
+	"token":              nil,
+	"anyURI":             nil,
+	"base64Binary":       regexp.MustCompile(`^[A-Za-z0-9+/\s]*=?\s*=?\s*$`),
+	"hexBinary":          regexp.MustCompile(`^([0-9a-fA-F]{2})*$`),
+	"boolean":            regexp.MustCompile(`^(true|false|1|0)$`),
+	"decimal":            regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)$`),
+	"float":              regexp.MustCompile(`^([+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?|-?INF|NaN)$`),
+	"double":             regexp.MustCompile(`^([+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?|-?INF|NaN)$`),
+	"integer":            regexp.MustCompile(`^[+-]?\d+$`),
+	"int":                regexp.MustCompile(`^[+-]?\d+$`),
+	"long":               regexp.MustCompile(`^[+-]?\d+$`),
+	"short":              regexp.MustCompile(`^[+-]?\d+$`),
+	"byte":               regexp.MustCompile(`^[+-]?\d+$`),
+	"nonNegativeInteger": regexp.MustCompile(`^(\+?\d+|-0+)$`),
+	"positiveInteger":    regexp.MustCompile(`^\+?0*[1-9]\d*$`),
+	"nonPositiveInteger": regexp.MustCompile(`^(-\d+|\+?0+)$`),
+	"negativeInteger":    regexp.MustCompile(`^-0*[1-9]\d*$`),
+	"unsignedLong":       regexp.MustCompile(`^\+?\d+$`),
+	"unsignedInt":        regexp.MustCompile(`^\+?\d+$`),
+	"unsignedShort":      regexp.MustCompile(`^\+?\d+$`),
+	"unsignedByte":       regexp.MustCompile(`^\+?\d+$`),
+	"date":               regexp.MustCompile(`^-?\d{4,}-(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])(Z|[+-]\d{2}:\d{2})?$`),
+	"dateTime":           regexp.MustCompile(`^-?\d{4,}-(0[1-9]|1[0-2])-(0[1-9]|[12]\d|3[01])T([01]\d|2[0-3]):[0-5]\d:[0-5]\d(\.\d+)?(Z|[+-]\d{2}:\d{2})?$`),
+	"time":               regexp.MustCompile(`^([01]\d|2[0-3]):[0-5]\d:[0-5]\d(\.\d+)?(Z|[+-]\d{2}:\d{2})?$`),
+	"gYear":              regexp.MustCompile(`^-?\d{4,}(Z|[+-]\d{2}:\d{2})?$`),
+	"gYearMonth":         regexp.MustCompile(`^-?\d{4,}-(0[1-9]|1[0-2])(Z|[+-]\d{2}:\d{2})?$`),
+	"duration":           regexp.MustCompile(`^-?P(\d+Y)?(\d+M)?(\d+D)?(T(\d+H)?(\d+M)?(\d+(\.\d+)?S)?)?$`),
+	"language":           regexp.MustCompile(`^[a-zA-Z]{1,8}(-[a-zA-Z0-9]{1,8})*$`),
+	"Name":               regexp.MustCompile(`^[A-Za-z_:][\w.:-]*$`),
+	"NCName":             regexp.MustCompile(`^[A-Za-z_][\w.-]*$`),
+	"ID":                 regexp.MustCompile(`^[A-Za-z_][\w.-]*$`),
+	"IDREF":              regexp.MustCompile(`^[A-Za-z_][\w.-]*$`),
+	"NMTOKEN":            regexp.MustCompile(`^[\w.:-]+$`),
+	"QName":              regexp.MustCompile(`^([A-Za-z_][\w.-]*:)?[A-Za-z_][\w.-]*$`),
+}
+
+var xsdIntRanges = map[string][2]int64{
+	"byte":          {-128, 127},
+	"short":         {-32768, 32767},
+	"int":           {-2147483648, 2147483647},
+	"unsignedByte":  {0, 255},
+	"unsignedShort": {0, 65535},
+	"unsignedInt":   {0, 4294967295},
+}
+
+var xsdNumeric = map[string]bool{
+	"decimal": true, "float": true, "double": true, "integer": true, "int": true, "long": true,
+	"short": true, "byte": true, "nonNegativeInteger": true, "positiveInteger": true,
+	"nonPositiveInteger": true, "negativeInteger": true, "unsignedLong": true, "unsignedInt": true,
+	"unsignedShort": true, "unsignedByte": true,
+}
+
+// primitive returns the built-in type the simple type derives from
+func (st *xsdSimple) primitive() string {
+	for t := st; t != nil; t = t.baseType {
+		if t.builtin != "" {
+			return t.builtin
+		}
+	}
+	return "anySimpleType"
+}
+
+func (st *xsdSimple) validate(value string) error {
+	if p := st.primitive(); p != "string" && p != "normalizedString" {
+		value = strings.Join(strings.Fields(value), " ")
+	}
+	if st.list != nil {
+		items := strings.Fields(value)
+		for _, item := range items {
+			if err := st.list.validate(item); err != nil {
+				return err
+			}
+		}
+		return st.checkFacets(value, len(items))
+	}
+	if len(st.union) > 0 {
+		for _, u := range st.union {
+			if u.validate(value) == nil {
+				return st.checkFacets(value, -1)
+			}
+		}
+		return fmt.Errorf("%q doesn't match any member of the union", value)
+	}
+	if st.builtin != "" {
+		if re := xsdBuiltins[st.builtin]; re != nil && !re.MatchString(value) {
+			return fmt.Errorf("%q is not a valid %s", value, st.builtin)
+		}
+		if r, ok := xsdIntRanges[st.builtin]; ok {
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || i < r[0] || i > r[1] {
+				return fmt.Errorf("%q is out of range for %s", value, st.builtin)
+			}
+		}
+		return nil
+	}
+	if st.baseType != nil {
+		if err := st.baseType.validate(value); err != nil {
+			return err
+		}
+	}
+	return st.checkFacets(value, -1)
+}
+
+func (st *xsdSimple) checkFacets(value string, items int) error {
+	if len(st.enumeration) > 0 {
+		found := false
+		for _, e := range st.enumeration {
+			if e == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%q is not one of %s", value, strings.Join(st.enumeration, ", "))
+		}
+	}
+	for _, re := range st.patterns {
+		if !re.MatchString(value) {
+			return fmt.Errorf("%q doesn't match pattern %s", value, re.String()[4:len(re.String())-2])
+		}
+	}
+	length := items
+	if length < 0 {
+		length = utf8.RuneCountInString(value)
+	}
+	if st.length != nil && length != *st.length {
+		return fmt.Errorf("%q must have length %d", value, *st.length)
+	}
+	if st.minLength != nil && length < *st.minLength {
+		return fmt.Errorf("%q is shorter than %d", value, *st.minLength)
+	}
+	if st.maxLength != nil && length > *st.maxLength {
+		return fmt.Errorf("%q is longer than %d", value, *st.maxLength)
+	}
+	numeric := xsdNumeric[st.primitive()]
+	bound := func(limit *string, ok func(int) bool, desc string) error {
+		if limit == nil {
+			return nil
+		}
+		if c, comparable := compareXSDValues(value, *limit, numeric); !comparable || !ok(c) {
+			return fmt.Errorf("%q must be %s %s", value, desc, *limit)
+		}
+		return nil
+	}
+	if err := bound(st.minIncl, func(c int) bool { return c >= 0 }, ">="); err != nil {
+		return err
+	}
+	if err := bound(st.maxIncl, func(c int) bool { return c <= 0 }, "<="); err != nil {
+		return err
+	}
+	if err := bound(st.minExcl, func(c int) bool { return c > 0 }, ">"); err != nil {
+		return err
+	}
+	if err := bound(st.maxExcl, func(c int) bool { return c < 0 }, "<"); err != nil {
+		return err
+	}
+	if st.totalDigits != nil || st.fracDigits != nil {
+		digits := strings.TrimLeft(strings.TrimLeft(value, "+-"), "0")
+		frac := ""
+		if i := strings.IndexByte(digits, '.'); i >= 0 {
+			frac = strings.TrimRight(digits[i+1:], "0")
+			digits = digits[:i] + frac
+		}
+		if st.totalDigits != nil && len(digits) > *st.totalDigits {
+			return fmt.Errorf("%q has more than %d digits", value, *st.totalDigits)
+		}
+		if st.fracDigits != nil && len(frac) > *st.fracDigits {
+			return fmt.Errorf("%q has more than %d fraction digits", value, *st.fracDigits)
+		}
+	}
+	return nil
+}
+
+// compareXSDValues compares numbers numerically, anything else (dates, times) as strings
+func compareXSDValues(a, b string, numeric bool) (int, bool) {
+	if numeric {
+		fa, erra := strconv.ParseFloat(a, 64)
+		fb, errb := strconv.ParseFloat(b, 64)
+		if erra != nil || errb != nil {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	return strings.Compare(a, b), true
+}
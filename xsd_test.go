@@ -0,0 +1,132 @@
+package filehelper
+
+import (
+	"strings"
+	"testing"
+)
+
+const testXSD = `<?xml version="1.0"?>
+<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <xs:simpleType name="skuType">
+    <xs:restriction base="xs:string">
+      <xs:pattern value="[A-Z]{3}-\d+"/>
+    </xs:restriction>
+  </xs:simpleType>
+  <xs:simpleType name="priceType">
+    <xs:restriction base="xs:decimal">
+      <xs:minExclusive value="0"/>
+      <xs:fractionDigits value="2"/>
+    </xs:restriction>
+  </xs:simpleType>
+  <xs:attributeGroup name="common">
+    <xs:attribute name="lang" type="xs:language"/>
+  </xs:attributeGroup>
+  <xs:complexType name="productType">
+    <xs:sequence>
+      <xs:element name="sku" type="skuType"/>
+      <xs:element name="name">
+        <xs:simpleType>
+          <xs:restriction base="xs:string">
+            <xs:minLength value="1"/>
+            <xs:maxLength value="10"/>
+          </xs:restriction>
+        </xs:simpleType>
+      </xs:element>
+      <xs:choice>
+        <xs:element name="price" type="priceType"/>
+        <xs:element name="onRequest" type="xs:boolean"/>
+      </xs:choice>
+      <xs:element name="tag" type="xs:string" minOccurs="0" maxOccurs="3"/>
+    </xs:sequence>
+    <xs:attribute name="status" use="required">
+      <xs:simpleType>
+        <xs:restriction base="xs:string">
+          <xs:enumeration value="active"/>
+          <xs:enumeration value="discontinued"/>
+        </xs:restriction>
+      </xs:simpleType>
+    </xs:attribute>
+    <xs:attributeGroup ref="common"/>
+  </xs:complexType>
+  <xs:element name="products">
+    <xs:complexType>
+      <xs:sequence>
+        <xs:element name="product" type="productType" maxOccurs="unbounded"/>
+      </xs:sequence>
+      <xs:attribute name="date" type="xs:date"/>
+    </xs:complexType>
+  </xs:element>
+</xs:schema>`
+
+func TestXSDValidate(t *testing.T) {
+	schema, err := ParseXSD([]byte(testXSD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]struct {
+		Input  string
+		Errors []string
+	}{
+		"valid": {
+			Input: `<products date="2019-02-01"><product status="active" lang="en"><sku>ABC-1</sku><name>Thing</name><price>9.99</price><tag>a</tag><tag>b</tag></product>
+<product status="discontinued"><sku>DEF-2</sku><name>Other</name><onRequest>true</onRequest></product></products>`,
+		},
+		"invalid": {
+			Input: `<products date="01/02/2019">
+<product status="gone" color="red"><sku>abc</sku><name>Far too long name</name><price>-1.999</price></product>
+<product><sku>DEF-2</sku><price>1</price></product>
+<product status="active"><sku>DEF-3</sku><name>X</name></product>
+</products>`,
+			Errors: []string{
+				`/products/@date (line 1): "01/02/2019" is not a valid date`,
+				`/products/product/@status (line 2): "gone" is not one of active, discontinued`,
+				`/products/product/@color (line 2): unexpected attribute`,
+				`/products/product/sku (line 2): "abc" doesn't match pattern [A-Z]{3}-\d+`,
+				`/products/product/name (line 2): "Far too long name" is longer than 10`,
+				`/products/product/price (line 2): "-1.999" must be > 0`,
+				`/products/product[2]/@status (line 3): missing required attribute`,
+				`/products/product[2] (line 3): unexpected element price, expected name`,
+				`/products/product[3] (line 4): missing element price or onRequest`,
+			},
+		},
+		"root": {
+			Input:  `<product status="active"/>`,
+			Errors: []string{`/product (line 1): no global element declaration for product`},
+		},
+	}
+	for name, test := range tests {
+		err := schema.Validate([]byte(test.Input))
+		if len(test.Errors) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected errors", name)
+			continue
+		}
+		if err.Error() != strings.Join(test.Errors, "\n") {
+			t.Errorf("%s:\n%v\n!=\n%s", name, err, strings.Join(test.Errors, "\n"))
+		}
+	}
+}
+
+func TestXSDValidateMap(t *testing.T) {
+	schema, err := ParseXSD([]byte(testXSD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewParser()
+	doc, _ := p.ParseStruct([]byte(`<products><product status="active"><tag>x</tag><price>1.50</price><name>N</name><sku>ABC-9</sku></product></products>`), "xml")
+	if err := schema.ValidateMap(doc); err != nil {
+		t.Errorf("parsed map: %v", err)
+	}
+	out, _ := Template(`{{xml_array .A "products" "product"}}`, map[string]interface{}{"A": []interface{}{map[string]interface{}{"-status": "active", "sku": "ABC-1", "name": "N", "price": "0"}}})
+	if err := schema.Validate([]byte(out)); err == nil || !strings.Contains(err.Error(), `"0" must be > 0`) {
+		t.Errorf("xml_array output: %v", err)
+	}
+	if _, err := ParseXSD([]byte(`<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema"><xs:element name="a" type="missing"/></xs:schema>`)); err == nil {
+		t.Errorf("expected error for unknown type")
+	}
+}
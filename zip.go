@@ -0,0 +1,220 @@
+package filehelper
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/shoobyban/slog"
+	"github.com/spf13/afero"
+)
+
+// WriteZip will append to datafile with filename using buf data
+func WriteZip(datafile, filename string, buf []byte) error {
+	return WriteZipFS(fs, datafile, filename, buf)
+}
+
+// WriteZipFS will append to datafile on given (afero) filesystem with filename using buf data.
+// Existing entries are copied into a temporary file which then replaces datafile, holding the same
+// locks as TarWriter so concurrent appends don't lose entries
+func WriteZipFS(filesystem afero.Fs, datafile, filename string, buf []byte) (err error) {
+	filesystem = orDefaultFS(filesystem)
+	defer lockPath(filesystem, datafile)()
+	src, funlock, err := openLocked(filesystem, datafile, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	defer funlock()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	var existing *zip.Reader
+	if fi.Size() > 0 {
+		if existing, err = openZip(src, datafile); err != nil {
+			return err
+		}
+	} else {
+		// the empty file created for locking isn't left behind
+		defer func() {
+			if err != nil {
+				filesystem.Remove(datafile)
+			}
+		}()
+	}
+
+	tmp, err := createTemp(filesystem, datafile, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	tmpfile := tmp.Name()
+	zw := zip.NewWriter(tmp)
+	if err := copyZipEntries(zw, existing, datafile); err != nil {
+		tmp.Close()
+		filesystem.Remove(tmpfile)
+		return err
+	}
+	slog.Infof("Writing %s %d", filename, int64(len(buf)))
+	hdr := &zip.FileHeader{Name: filename, Method: zip.Deflate}
+	hdr.SetModTime(time.Now())
+	hdr.SetMode(0644)
+	w, err := zw.CreateHeader(hdr)
+	if err == nil {
+		_, err = w.Write(buf)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		filesystem.Remove(tmpfile)
+		return fmt.Errorf("Error writing zip: %w", err)
+	}
+	// renamed while holding the file lock, writers waiting for it reopen the new file
+	if err := filesystem.Rename(tmpfile, datafile); err != nil {
+		filesystem.Remove(tmpfile)
+		return err
+	}
+	return nil
+}
+
+// copyZipEntries copies the entries of zr (if there is one) to zw
+func copyZipEntries(zw *zip.Writer, zr *zip.Reader, datafile string) error {
+	if zr == nil {
+		return nil
+	}
+	// entries are copied as stored, so appending doesn't decompress and compress the whole archive again
+	for _, zf := range zr.File {
+		r, err := zf.OpenRaw()
+		if err != nil {
+			return &CorruptArchiveError{datafile, err}
+		}
+		hdr := zf.FileHeader
+		w, err := zw.CreateRaw(&hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return &CorruptArchiveError{datafile, err}
+		}
+	}
+	return nil
+}
+
+// openZip returns a zip reader of an opened afero file
+func openZip(f afero.File, datafile string) (*zip.Reader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		return nil, &CorruptArchiveError{datafile, err}
+	}
+	return zr, nil
+}
+
+// ListZip will return file list from given zip file
+func ListZip(filename string) ([]string, error) {
+	return ListZipFS(fs, filename)
+}
+
+// ListZipFS will return file list from given zip file on given (afero) filesystem
+func ListZipFS(filesystem afero.Fs, filename string) ([]string, error) {
+	f, err := orDefaultFS(filesystem).Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := openZip(f, filename)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, zf := range zr.File {
+		ret = append(ret, zf.Name)
+	}
+	return ret, nil
+}
+
+// ReadZip reads filename from given zip file and returns content
+func ReadZip(zipfile, filename string) ([]byte, error) {
+	return ReadZipFS(fs, zipfile, filename)
+}
+
+// ReadZipFS reads filename from given zip file on given (afero) filesystem and returns content
+// (the latest entry if it was appended more than once), the error wraps ErrNotInArchive if filename
+// is not in the zip file
+func ReadZipFS(filesystem afero.Fs, zipfile, filename string) ([]byte, error) {
+	f, err := orDefaultFS(filesystem).Open(zipfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := openZip(f, zipfile)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(zr.File) - 1; i >= 0; i-- {
+		if zr.File[i].Name == filename {
+			return readZipEntry(zr.File[i], zipfile)
+		}
+	}
+	return nil, fmt.Errorf("%s in %s: %w", filename, zipfile, ErrNotInArchive)
+}
+
+func readZipEntry(zf *zip.File, zipfile string) ([]byte, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return nil, &CorruptArchiveError{zipfile, err}
+	}
+	defer r.Close()
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &CorruptArchiveError{zipfile, err}
+	}
+	return bs, nil
+}
+
+// FindInZip looks for search string in zip file, returns list of filenames and matches
+func FindInZip(zipfile, search string) (map[string]string, error) {
+	return FindInZipFS(fs, zipfile, search)
+}
+
+// FindInZipFS looks for search string in the latest entry of each name in zip file on given (afero) filesystem,
+// returns list of filenames and matches
+func FindInZipFS(filesystem afero.Fs, zipfile, search string) (map[string]string, error) {
+	f, err := orDefaultFS(filesystem).Open(zipfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := openZip(f, zipfile)
+	if err != nil {
+		return nil, err
+	}
+	latest := map[string]int{}
+	for i, zf := range zr.File {
+		latest[zf.Name] = i
+	}
+	res := map[string]string{}
+	for i, zf := range zr.File {
+		if latest[zf.Name] != i {
+			continue
+		}
+		bs, err := readZipEntry(zf, zipfile)
+		if err != nil {
+			return res, err
+		}
+		if match, ok := findSnippet(bs, search); ok {
+			res[zf.Name] = match
+		}
+	}
+	return res, nil
+}